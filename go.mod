@@ -15,4 +15,5 @@ require (
 	golang.org/x/crypto v0.0.0-20181112202954-3d3f9f413869 // indirect
 	golang.org/x/sys v0.0.0-20181116161606-93218def8b18 // indirect
 	gopkg.in/jmcvetta/napping.v3 v3.2.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -1,6 +1,7 @@
 package neoutils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
@@ -9,7 +10,6 @@ import (
 
 	"github.com/Financial-Times/go-logger/v2"
 
-	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
 	"github.com/jmcvetta/neoism"
 )
 
@@ -18,7 +18,7 @@ var (
 	notConnectedError = errors.New("not connected to neo4j database")
 )
 
-func connectAuto(neoURL string, connect func() (NeoConnection, error), delay time.Duration, log *logger.UPPLogger) (NeoConnection, error) {
+func connectAuto(neoURL string, connect func() (NeoConnection, error), policy ReconnectPolicy, log *logger.UPPLogger) (NeoConnection, error) {
 
 	// check that at least we have a valid url
 	parsed, _ := url.Parse(neoURL)
@@ -30,8 +30,11 @@ func connectAuto(neoURL string, connect func() (NeoConnection, error), delay tim
 		url:          neoURL,
 		connect:      connect,
 		needsConnect: make(chan struct{}, 1),
-		delay:        delay,
+		policy:       policy,
 		log:          log,
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		state:        newConnectionState(),
 	}
 
 	a.needsConnect <- struct{}{}
@@ -43,34 +46,79 @@ func connectAuto(neoURL string, connect func() (NeoConnection, error), delay tim
 type AutoConnectTransactional struct {
 	url     string
 	connect func() (NeoConnection, error)
-	delay   time.Duration
+	policy  ReconnectPolicy
 
 	lk          sync.RWMutex
 	conn        NeoConnection
 	indexes     []map[string]string
 	constraints []map[string]string
+	schemas     []schemaSpec
+	// gaveUpErr is set once the reconnect policy is exhausted
+	gaveUpErr error
+	// children are the connections returned by WithDatabase, closed with this one
+	children []*AutoConnectTransactional
 
 	needsConnect chan struct{}
 	log          *logger.UPPLogger
+	state        *connectionState
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
 }
 
 func (a *AutoConnectTransactional) mainLoop() {
+	defer close(a.stopped)
 	for {
-		<-a.needsConnect
+		select {
+		case <-a.needsConnect:
+		case <-a.stop:
+			return
+		}
 
-		for {
+		// failures counts consecutive failures to connect. Failing to apply
+		// schema isn't counted, as giving up would stop the connection that
+		// was made from being used.
+		failures := 0
+		for attempt := 1; ; attempt++ {
+			a.state.set(Connecting, nil)
 			err := a.doConnect()
 			if err == nil {
 				break
 			}
-			a.log.WithError(err).Warnf("connection to neo4j failed. Sleeping for %s", a.delay)
-			time.Sleep(a.delay)
+			if _, ok := err.(schemaError); ok {
+				failures = 0
+				a.state.set(SchemaFailed, err)
+			} else {
+				failures++
+				if a.policy.exhausted(failures) {
+					a.giveUp(fmt.Errorf("%w %v after %d attempts: %v", ErrGaveUpConnecting, a.url, failures, err))
+					return
+				}
+				a.state.set(Disconnected, err)
+			}
+			delay := a.policy.delay(attempt)
+			a.log.WithError(err).Warnf("connection to neo4j failed. Sleeping for %s", delay)
+			select {
+			case <-time.After(delay):
+			case <-a.stop:
+				return
+			}
 		}
 
 		a.log.Infof("connected to %v", a.url)
+		a.state.set(Connected, nil)
 	}
 }
 
+func (a *AutoConnectTransactional) giveUp(err error) {
+	a.log.WithError(err).Error("not retrying connection to neo4j")
+	a.lk.Lock()
+	a.gaveUpErr = err
+	a.lk.Unlock()
+	a.state.set(Disconnected, err)
+}
+
 func (a *AutoConnectTransactional) doConnect() error {
 	newConn, err := a.connect()
 	if err != nil {
@@ -85,41 +133,184 @@ func (a *AutoConnectTransactional) postConnect(newConn NeoConnection) error {
 	a.lk.Lock()
 	defer a.lk.Unlock()
 
+	if a.conn != nil && a.conn != newConn {
+		// the old connection may still be flushing queries, so don't wait for it
+		go closeRunner(context.Background(), a.conn)
+	}
 	a.conn = newConn
 
 	for _, i := range a.indexes {
 		if err := a.conn.EnsureIndexes(i); err != nil {
-			return fmt.Errorf("failed to apply indexes: %v\n", err)
+			return schemaError{fmt.Errorf("failed to apply indexes: %v\n", err)}
 		}
 	}
 	a.indexes = nil
 	for _, c := range a.constraints {
 		if err := a.conn.EnsureConstraints(c); err != nil {
-			return fmt.Errorf("failed to apply constraints: %v\n", err)
+			return schemaError{fmt.Errorf("failed to apply constraints: %v\n", err)}
 		}
 	}
 	a.constraints = nil
+	for _, s := range a.schemas {
+		se, ok := a.conn.(SchemaEnsurer)
+		if !ok {
+			return schemaError{fmt.Errorf("%v cannot manage schema", a.conn)}
+		}
+		if err := se.EnsureSchema(s.constraints, s.indexes); err != nil {
+			return schemaError{fmt.Errorf("failed to apply schema: %v\n", err)}
+		}
+	}
+	a.schemas = nil
 	return nil
 }
 
+// schemaSpec holds the arguments of an EnsureSchema call until there is a connection.
+type schemaSpec struct {
+	constraints []SchemaConstraint
+	indexes     []SchemaIndex
+}
+
+// schemaError is returned by postConnect when a connection was made but the
+// indexes or constraints could not be applied.
+type schemaError struct {
+	error
+}
+
+// address is the current connection's, which may be to a failover URL.
+func (a *AutoConnectTransactional) address() string {
+	a.lk.RLock()
+	defer a.lk.RUnlock()
+	if conn, ok := a.conn.(addresser); ok {
+		return conn.address()
+	}
+	return urlHost(a.url)
+}
+
+// current returns the connection in use, for callers such as SchemaMigrator
+// that need to apply schema straight away rather than have it queued.
+func (a *AutoConnectTransactional) current() (NeoConnection, error) {
+	if a.isClosed() {
+		return nil, ErrClosed
+	}
+	a.lk.RLock()
+	defer a.lk.RUnlock()
+	if a.gaveUpErr != nil {
+		return nil, a.gaveUpErr
+	}
+	if a.conn == nil {
+		return nil, notConnectedError
+	}
+	return a.conn, nil
+}
+
+// unbatched is the current connection's, or a itself while not connected so
+// that queries fail as they would for any other caller.
+func (a *AutoConnectTransactional) unbatched() CypherRunner {
+	a.lk.RLock()
+	defer a.lk.RUnlock()
+	if a.conn == nil {
+		return a
+	}
+	return unbatched(a.conn)
+}
+
 func (a *AutoConnectTransactional) String() string {
 	return fmt.Sprintf("AutoConnectDb(%v)", a.url)
 }
 
 func (a *AutoConnectTransactional) CypherBatch(queries []*neoism.CypherQuery) error {
+	return a.CypherBatchContext(context.Background(), queries)
+}
+
+func (a *AutoConnectTransactional) CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return a.run(func(conn NeoConnection) error {
+		return cypherBatchContext(ctx, conn, queries)
+	})
+}
+
+func (a *AutoConnectTransactional) ReadCypherBatch(queries []*neoism.CypherQuery) error {
+	return a.ReadCypherBatchContext(context.Background(), queries)
+}
+
+// ReadCypherBatchContext runs read-only queries as the current connection
+// does, reconnecting as CypherBatchContext does.
+func (a *AutoConnectTransactional) ReadCypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return a.run(func(conn NeoConnection) error {
+		return readCypherBatchContext(ctx, conn, queries)
+	})
+}
+
+// TrySubmit runs the queries with the current connection, failing with
+// ErrQueueFull rather than waiting if its batch queue is full.
+func (a *AutoConnectTransactional) TrySubmit(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return a.run(func(conn NeoConnection) error {
+		return trySubmit(ctx, conn, queries)
+	})
+}
+
+func (a *AutoConnectTransactional) Submit(queries []*neoism.CypherQuery) *Future {
+	return a.SubmitContext(context.Background(), queries)
+}
+
+// SubmitContext queues the queries with the current connection, without
+// waiting for them to be written.
+func (a *AutoConnectTransactional) SubmitContext(ctx context.Context, queries []*neoism.CypherQuery) *Future {
+	var f *Future
+	if err := a.run(func(conn NeoConnection) error {
+		f = submit(ctx, conn, queries)
+		return nil
+	}); err != nil {
+		return failedFuture(err)
+	}
+	return f.chain(a.checkErr)
+}
+
+// BeginTx begins an explicit transaction with the current connection.
+func (a *AutoConnectTransactional) BeginTx(ctx context.Context) (Tx, error) {
+	var tx Tx
+	err := a.run(func(conn NeoConnection) error {
+		var err error
+		tx, err = beginTx(ctx, conn)
+		return err
+	})
+	return tx, err
+}
+
+// run calls f with the current connection, and asks for a reconnect if the
+// error it returns suggests the connection is broken.
+func (a *AutoConnectTransactional) run(f func(conn NeoConnection) error) error {
+	if a.isClosed() {
+		return ErrClosed
+	}
 	a.lk.RLock()
 	defer a.lk.RUnlock()
+	if a.gaveUpErr != nil {
+		return a.gaveUpErr
+	}
 	if a.conn == nil {
 		return notConnectedError
 	}
-	err := a.conn.CypherBatch(queries)
+	return a.checkErr(f(a.conn))
+}
+
+// checkErr asks for a reconnect if err, from using the current connection,
+// suggests it is broken, and returns err.
+func (a *AutoConnectTransactional) checkErr(err error) error {
 	if err != nil {
+		// the caller gave up, which says nothing about the connection
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		// the server answered, or the queries were never sent, so the
+		// connection is fine
+		var neoErr *Neo4jError
+		if errors.As(err, &neoErr) || isStatementError(err) || isQueueError(err) {
+			return err
+		}
 
 		needReconnect := false
 
 		switch e := err.(type) {
-		case rwapi.ConstraintOrTransactionError:
-			// no reconnect needed
 		case *url.Error:
 			if !e.Temporary() {
 				needReconnect = true
@@ -144,8 +335,14 @@ func (a *AutoConnectTransactional) CypherBatch(queries []*neoism.CypherQuery) er
 }
 
 func (a *AutoConnectTransactional) EnsureConstraints(constraints map[string]string) error {
+	if a.isClosed() {
+		return ErrClosed
+	}
 	a.lk.Lock()
 	defer a.lk.Unlock()
+	if a.gaveUpErr != nil {
+		return a.gaveUpErr
+	}
 	a.constraints = append(a.constraints, constraints)
 	select {
 	case a.needsConnect <- struct{}{}:
@@ -155,8 +352,14 @@ func (a *AutoConnectTransactional) EnsureConstraints(constraints map[string]stri
 }
 
 func (a *AutoConnectTransactional) EnsureIndexes(indexes map[string]string) error {
+	if a.isClosed() {
+		return ErrClosed
+	}
 	a.lk.Lock()
 	defer a.lk.Unlock()
+	if a.gaveUpErr != nil {
+		return a.gaveUpErr
+	}
 	a.indexes = append(a.indexes, indexes)
 	select {
 	case a.needsConnect <- struct{}{}:
@@ -164,3 +367,201 @@ func (a *AutoConnectTransactional) EnsureIndexes(indexes map[string]string) erro
 	}
 	return nil
 }
+
+// EnsureSchema queues the constraints and indexes to be created once
+// connected, and again on every reconnect until they have been applied. An
+// invalid constraint or index is reported straight away.
+func (a *AutoConnectTransactional) EnsureSchema(constraints []SchemaConstraint, indexes []SchemaIndex) error {
+	for _, c := range constraints {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, i := range indexes {
+		if err := i.Validate(); err != nil {
+			return err
+		}
+	}
+	if a.isClosed() {
+		return ErrClosed
+	}
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if a.gaveUpErr != nil {
+		return a.gaveUpErr
+	}
+	a.schemas = append(a.schemas, schemaSpec{constraints, indexes})
+	select {
+	case a.needsConnect <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// DiffSchema compares the declared constraints and indexes with the
+// database's, which needs a connection.
+func (a *AutoConnectTransactional) DiffSchema(constraints []SchemaConstraint, indexes []SchemaIndex) (*SchemaDiff, error) {
+	sd, err := a.schemaDiffer()
+	if err != nil {
+		return nil, err
+	}
+	return sd.DiffSchema(constraints, indexes)
+}
+
+// PruneSchema drops the extra indexes and constraints of diff, which needs a connection.
+func (a *AutoConnectTransactional) PruneSchema(diff *SchemaDiff) error {
+	sd, err := a.schemaDiffer()
+	if err != nil {
+		return err
+	}
+	return sd.PruneSchema(diff)
+}
+
+func (a *AutoConnectTransactional) schemaDiffer() (SchemaDiffer, error) {
+	if a.isClosed() {
+		return nil, ErrClosed
+	}
+	a.lk.RLock()
+	defer a.lk.RUnlock()
+	if a.gaveUpErr != nil {
+		return nil, a.gaveUpErr
+	}
+	if a.conn == nil {
+		return nil, notConnectedError
+	}
+	sd, ok := a.conn.(SchemaDiffer)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot manage schema", a.conn)
+	}
+	return sd, nil
+}
+
+// WithDatabase returns a connection to another database that connects in the
+// background through whichever connection this one has at the time. It has
+// its own state and reconnects on its own, typically when its queries fail
+// because this one has reconnected. Closing this connection closes it too.
+func (a *AutoConnectTransactional) WithDatabase(name string) (NeoConnection, error) {
+	child, err := connectAuto(a.url, func() (NeoConnection, error) {
+		if a.isClosed() {
+			return nil, ErrClosed
+		}
+		a.lk.RLock()
+		conn := a.conn
+		a.lk.RUnlock()
+		if conn == nil {
+			return nil, notConnectedError
+		}
+		dc, ok := conn.(DatabaseConnector)
+		if !ok {
+			return nil, fmt.Errorf("%v cannot connect to other databases", conn)
+		}
+		return dc.WithDatabase(name)
+	}, a.policy, a.log)
+	if err != nil {
+		return nil, err
+	}
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	// Close reads the children after stopping, under the lock
+	if a.isClosed() {
+		go closeRunner(context.Background(), child)
+		return nil, ErrClosed
+	}
+	a.children = append(a.children, child.(*AutoConnectTransactional))
+	return child, nil
+}
+
+// Close stops the reconnect loop and closes the current connection, and those
+// returned by WithDatabase, waiting until ctx is done for queries they have
+// already accepted to be written.
+func (a *AutoConnectTransactional) Close(ctx context.Context) error {
+	a.stopOnce.Do(func() { close(a.stop) })
+
+	// a connection attempt in progress has to finish before the loop stops
+	select {
+	case <-a.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	a.state.set(Disconnected, ErrClosed)
+
+	a.lk.RLock()
+	conn := a.conn
+	children := a.children
+	a.lk.RUnlock()
+
+	// the children may share the connection's pool, so go first
+	var err error
+	for _, child := range children {
+		if childErr := child.Close(ctx); err == nil {
+			err = childErr
+		}
+	}
+	if conn != nil {
+		if connErr := closeRunner(ctx, conn); err == nil {
+			err = connErr
+		}
+	}
+	return err
+}
+
+// State returns the current state of the connection, and the error that
+// caused it for Disconnected and SchemaFailed.
+func (a *AutoConnectTransactional) State() (ConnectionState, error) {
+	state, err, _ := a.state.get()
+	return state, err
+}
+
+// WaitReady blocks until the connection is Connected, or returns an error if
+// ctx is done first or the connection has given up or been closed.
+func (a *AutoConnectTransactional) WaitReady(ctx context.Context) error {
+	for {
+		state, _, changed := a.state.get()
+		if state == Connected {
+			return nil
+		}
+		if a.isClosed() {
+			return ErrClosed
+		}
+		a.lk.RLock()
+		err := a.gaveUpErr
+		a.lk.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-a.stop:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Subscribe calls f on every change of state, with the error that caused
+// Disconnected and SchemaFailed. f is called in order, from the goroutine that
+// connects in the background, including when it gives up, or from Close for
+// the final Disconnected once that goroutine has stopped. It should return
+// quickly, and not call Close. The returned function stops further calls.
+func (a *AutoConnectTransactional) Subscribe(f func(state ConnectionState, err error)) func() {
+	return a.state.subscribe(f)
+}
+
+func (a *AutoConnectTransactional) isClosed() bool {
+	select {
+	case <-a.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+var _ ContextCypherRunner = (*AutoConnectTransactional)(nil)
+var _ ReadCypherRunner = (*AutoConnectTransactional)(nil)
+var _ TxBeginner = (*AutoConnectTransactional)(nil)
+var _ Closer = (*AutoConnectTransactional)(nil)
+var _ ConnectionStateWatcher = (*AutoConnectTransactional)(nil)
+var _ SchemaEnsurer = (*AutoConnectTransactional)(nil)
+var _ SchemaDiffer = (*AutoConnectTransactional)(nil)
+var _ DatabaseConnector = (*AutoConnectTransactional)(nil)
@@ -1,8 +1,11 @@
 package neoutils
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,17 +18,17 @@ var period = 100 * time.Millisecond
 func TestAutoConnectBadURL(t *testing.T) {
 	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
 	mock := newMockNeoConnection()
-	if _, err := connectAuto("", func() (NeoConnection, error) { return mock, nil }, period, l); err == nil {
+	if _, err := connectAuto("", func() (NeoConnection, error) { return mock, nil }, ReconnectPolicy{InitialDelay: period}, l); err == nil {
 		t.Error("expected an error with bad url")
 	}
-	if _, err := connectAuto("foo", func() (NeoConnection, error) { return mock, nil }, period, l); err == nil {
+	if _, err := connectAuto("foo", func() (NeoConnection, error) { return mock, nil }, ReconnectPolicy{InitialDelay: period}, l); err == nil {
 		t.Error("expected an error with bad url")
 	}
 }
 
 func TestAutoConnectInitialWithDBDown(t *testing.T) {
 	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
-	_, err := connectAuto("http://valid.url/foo/bar/", func() (NeoConnection, error) { return nil, errors.New("db down") }, period, l)
+	_, err := connectAuto("http://valid.url/foo/bar/", func() (NeoConnection, error) { return nil, errors.New("db down") }, ReconnectPolicy{InitialDelay: period}, l)
 	if err != nil {
 		t.Errorf("didn't expect an error, despite neo being down. got %v, a %T\n", err, err)
 	}
@@ -37,7 +40,7 @@ func TestAutoConnectConnects(t *testing.T) {
 
 	connected := make(chan struct{}, 1)
 
-	_, err := connectAuto("http://localhost:9999/db/data/", func() (NeoConnection, error) { connected <- struct{}{}; return mock, nil }, period, l)
+	_, err := connectAuto("http://localhost:9999/db/data/", func() (NeoConnection, error) { connected <- struct{}{}; return mock, nil }, ReconnectPolicy{InitialDelay: period}, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +60,7 @@ func TestNewIndexedAreCreatedAfterConnection(t *testing.T) {
 
 	connected := make(chan struct{}, 1)
 
-	conn, err := connectAuto("http://localhost:9999/db/data/", func() (NeoConnection, error) { connected <- struct{}{}; return mock, nil }, period, l)
+	conn, err := connectAuto("http://localhost:9999/db/data/", func() (NeoConnection, error) { connected <- struct{}{}; return mock, nil }, ReconnectPolicy{InitialDelay: period}, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,7 +98,7 @@ func TestAutoDoesIndexesAfterConnect(t *testing.T) {
 		return mock, nil
 	}
 
-	conn, err := connectAuto("http://localhost:9999/db/data/", connect, period, l)
+	conn, err := connectAuto("http://localhost:9999/db/data/", connect, ReconnectPolicy{InitialDelay: period}, l)
 
 	if err != nil {
 		t.Fatal(err)
@@ -166,7 +169,7 @@ func TestFailIndexesFailsConnect(t *testing.T) {
 		return mock, nil
 	}
 
-	conn, err := connectAuto("http://localhost:9999/db/data/", connect, period, l)
+	conn, err := connectAuto("http://localhost:9999/db/data/", connect, ReconnectPolicy{InitialDelay: period}, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -240,7 +243,7 @@ func TestFailConstraintsFailsConnect(t *testing.T) {
 		return mock, nil
 	}
 
-	conn, err := connectAuto("http://localhost:9999/db/data/", connect, period, l)
+	conn, err := connectAuto("http://localhost:9999/db/data/", connect, ReconnectPolicy{InitialDelay: period}, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -305,7 +308,7 @@ func TestFailConstraintsFailsConnect(t *testing.T) {
 
 func TestCypherFailsBeforeConnected(t *testing.T) {
 	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
-	conn, err := connectAuto("http://valid.url/foo/bar/", func() (NeoConnection, error) { return nil, errors.New("db down") }, period, l)
+	conn, err := connectAuto("http://valid.url/foo/bar/", func() (NeoConnection, error) { return nil, errors.New("db down") }, ReconnectPolicy{InitialDelay: period}, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -318,6 +321,173 @@ func TestCypherFailsBeforeConnected(t *testing.T) {
 
 }
 
+func TestAutoConnectGivesUp(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	triedConnect := make(chan struct{}, 16)
+	conn, err := connectAuto("http://valid.url/foo/bar/", func() (NeoConnection, error) {
+		triedConnect <- struct{}{}
+		return nil, errors.New("db down")
+	}, ReconnectPolicy{InitialDelay: period / 10, MaxAttempts: 3}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(period)
+	if len(triedConnect) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(triedConnect))
+	}
+	for len(triedConnect) > 0 {
+		<-triedConnect
+	}
+
+	err = conn.CypherBatch([]*neoism.CypherQuery{})
+	if !errors.Is(err, ErrGaveUpConnecting) {
+		t.Errorf("expected ErrGaveUpConnecting, got %v", err)
+	}
+	if err := conn.EnsureIndexes(map[string]string{"foo": "bar"}); !errors.Is(err, ErrGaveUpConnecting) {
+		t.Errorf("expected ErrGaveUpConnecting, got %v", err)
+	}
+	select {
+	case <-triedConnect:
+		t.Fatal("tried to connect after giving up")
+	case <-time.After(period):
+	}
+}
+
+func TestAutoConnectDoesNotGiveUpOnSchema(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	var lk sync.Mutex
+	schemaFailures := 0
+	connect := func() (NeoConnection, error) {
+		mock := newMockNeoConnection()
+		mock.indexFunc = func(indexes map[string]string) error {
+			lk.Lock()
+			defer lk.Unlock()
+			if schemaFailures < 4 {
+				schemaFailures++
+				return errors.New("schema broken")
+			}
+			return nil
+		}
+		return mock, nil
+	}
+	conn, err := connectAuto("http://localhost:9999/db/data/", connect, ReconnectPolicy{InitialDelay: period / 10, MaxAttempts: 2}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := conn.(*AutoConnectTransactional)
+	defer a.Close(context.Background())
+	a.EnsureIndexes(map[string]string{"foo": "bar"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CypherBatch([]*neoism.CypherQuery{}); err != nil {
+		t.Errorf("expected the connection to be usable, got %v", err)
+	}
+}
+
+func TestWaitReadyAndStateTransitions(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	dbDown := errors.New("db down")
+	subscribed := make(chan struct{})
+	attempts := 0
+	connect := func() (NeoConnection, error) {
+		attempts++
+		switch attempts {
+		case 1:
+			<-subscribed
+			return nil, dbDown
+		case 2:
+			mock := newMockNeoConnection()
+			mock.indexFunc = func(indexes map[string]string) error { return errors.New("schema broken") }
+			return mock, nil
+		}
+		return newMockNeoConnection(), nil
+	}
+
+	conn, err := connectAuto("http://localhost:9999/db/data/", connect, ReconnectPolicy{InitialDelay: period / 10}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := conn.(*AutoConnectTransactional)
+
+	transitions := make(chan ConnectionState, 16)
+	unsubscribe := a.Subscribe(func(state ConnectionState, err error) {
+		transitions <- state
+	})
+	defer unsubscribe()
+	a.EnsureIndexes(map[string]string{"foo": "bar"})
+	close(subscribed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := a.State(); state != Connected || err != nil {
+		t.Errorf("expected Connected, got %v %v", state, err)
+	}
+
+	expected := []ConnectionState{Disconnected, Connecting, SchemaFailed, Connecting, Connected}
+	var got []ConnectionState
+	for range expected {
+		select {
+		case state := <-transitions:
+			got = append(got, state)
+		case <-time.After(time.Second):
+			t.Fatalf("expected transitions %v, got %v", expected, got)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected transitions %v, got %v", expected, got)
+	}
+
+	if err := a.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := a.State(); state != Disconnected || err != ErrClosed {
+		t.Errorf("expected Disconnected by ErrClosed, got %v %v", state, err)
+	}
+	if err := a.WaitReady(ctx); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestWaitReadyTimesOut(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	conn, err := connectAuto("http://valid.url/foo/bar/", func() (NeoConnection, error) { return nil, errors.New("db down") }, ReconnectPolicy{InitialDelay: period}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.(Closer).Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), period/2)
+	defer cancel()
+	if err := conn.(ConnectionStateWatcher).WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	if state, err := conn.(ConnectionStateWatcher).State(); state != Disconnected || err == nil {
+		t.Errorf("expected Disconnected with an error, got %v %v", state, err)
+	}
+}
+
+func TestWaitReadyFailsWhenGivenUp(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	conn, err := connectAuto("http://valid.url/foo/bar/", func() (NeoConnection, error) { return nil, errors.New("db down") }, ReconnectPolicy{InitialDelay: period / 10, MaxAttempts: 2}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.(ConnectionStateWatcher).WaitReady(ctx); !errors.Is(err, ErrGaveUpConnecting) {
+		t.Errorf("expected ErrGaveUpConnecting, got %v", err)
+	}
+}
+
 func TestCypherNonTemporaryURLErrorCausesReconnect(t *testing.T) {
 	testCypherErrorCausesReconnect(t, &url.Error{Op: "foo", Err: errors.New("generic error"), URL: "http://foo.bar/"}, true)
 }
@@ -335,6 +505,16 @@ func TestCypherErrorPermanentURLErrorCausesReconnect(t *testing.T) {
 	testCypherErrorCausesReconnect(t, &url.Error{Op: "foo", Err: tempError{}, URL: "http://foo.bar/"}, false)
 }
 
+func TestCypherContextErrorDoesNotCauseReconnect(t *testing.T) {
+	testCypherErrorCausesReconnect(t, &url.Error{Op: "foo", Err: context.Canceled, URL: "http://foo.bar/"}, false)
+	testCypherErrorCausesReconnect(t, context.DeadlineExceeded, false)
+}
+
+func TestCypherQueueErrorDoesNotCauseReconnect(t *testing.T) {
+	testCypherErrorCausesReconnect(t, ErrQueueFull, false)
+	testCypherErrorCausesReconnect(t, fmt.Errorf("%w: 3 parameters", ErrBatchTooLarge), false)
+}
+
 func testCypherErrorCausesReconnect(t *testing.T, theError error, expectReconnect bool) {
 	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
 	mock := newMockNeoConnection()
@@ -349,7 +529,7 @@ func testCypherErrorCausesReconnect(t *testing.T, theError error, expectReconnec
 		return mock, nil
 	}
 
-	conn, err := connectAuto("http://localhost:9999/db/data/", connect, period, l)
+	conn, err := connectAuto("http://localhost:9999/db/data/", connect, ReconnectPolicy{InitialDelay: period}, l)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -383,6 +563,133 @@ func testCypherErrorCausesReconnect(t *testing.T, theError error, expectReconnec
 	}
 }
 
+func TestCloseStopsReconnecting(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	triedConnect := make(chan struct{}, 16)
+	conn, err := connectAuto("http://localhost:9999/db/data/", func() (NeoConnection, error) {
+		triedConnect <- struct{}{}
+		return nil, errors.New("db down")
+	}, ReconnectPolicy{InitialDelay: period}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-triedConnect
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.(*AutoConnectTransactional).Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for len(triedConnect) > 0 {
+		<-triedConnect
+	}
+	select {
+	case <-triedConnect:
+		t.Fatal("tried to connect after close")
+	case <-time.After(period + 50*time.Millisecond):
+	}
+
+	if err := conn.CypherBatch([]*neoism.CypherQuery{}); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err := conn.EnsureIndexes(map[string]string{"foo": "bar"}); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestCloseClosesConnections(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	closed := make(chan *closableMockNeoConnection, 2)
+	connected := make(chan struct{}, 2)
+	connect := func() (NeoConnection, error) {
+		mock := &closableMockNeoConnection{newMockNeoConnection(), closed}
+		mock.cypherFunc = func(queries []*neoism.CypherQuery) error { return errors.New("generic error") }
+		connected <- struct{}{}
+		return mock, nil
+	}
+
+	conn, err := connectAuto("http://localhost:9999/db/data/", connect, ReconnectPolicy{InitialDelay: period}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+
+	// a failure makes it reconnect, and the replaced connection is closed
+	conn.CypherBatch([]*neoism.CypherQuery{})
+	<-connected
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("replaced connection was not closed")
+	}
+
+	if err := conn.(*AutoConnectTransactional).Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	default:
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestAutoConnectWithDatabase(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	mock := &databaseMockNeoConnection{newMockNeoConnection(), make(chan string, 1)}
+	conn, err := connectAuto("http://localhost:9999/db/data/", func() (NeoConnection, error) { return mock, nil }, ReconnectPolicy{InitialDelay: period}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := conn.(DatabaseConnector).WithDatabase("concepts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := other.(ConnectionStateWatcher).WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-mock.databases; name != "concepts" {
+		t.Errorf("expected a connection to concepts, got %s", name)
+	}
+	if err := other.CypherBatch([]*neoism.CypherQuery{}); err != nil {
+		t.Error(err)
+	}
+
+	// closing the connection closes those to other databases
+	if err := conn.(Closer).Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.CypherBatch([]*neoism.CypherQuery{}); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := conn.(DatabaseConnector).WithDatabase("concepts"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+type databaseMockNeoConnection struct {
+	*mockNeoConnection
+	databases chan string
+}
+
+func (m *databaseMockNeoConnection) WithDatabase(name string) (NeoConnection, error) {
+	m.databases <- name
+	return newMockNeoConnection(), nil
+}
+
+type closableMockNeoConnection struct {
+	*mockNeoConnection
+	closed chan *closableMockNeoConnection
+}
+
+func (m *closableMockNeoConnection) Close(ctx context.Context) error {
+	m.closed <- m
+	return nil
+}
+
 func newMockNeoConnection() *mockNeoConnection {
 	return &mockNeoConnection{
 		cypherFunc:      func(queries []*neoism.CypherQuery) error { return nil },
@@ -1,8 +1,13 @@
 package neoutils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
 	"github.com/jmcvetta/neoism"
@@ -10,9 +15,98 @@ import (
 )
 
 func NewBatchCypherRunner(cypherRunner CypherRunner, count int) CypherRunner {
-	cr := BatchCypherRunner{cypherRunner, make(chan cypherQueryBatch, count), count}
+	return NewBatchCypherRunnerWithOptions(cypherRunner, count, BatchOptions{})
+}
+
+// BatchOptions tunes the behaviour of a BatchCypherRunner. The zero value
+// gives the default behaviour.
+type BatchOptions struct {
+	// IsolateFailures makes a batch that fails because of one of its
+	// statements be retried in halves, until the failure is narrowed down
+	// to the callers whose queries caused it. Queries from other callers are
+	// committed, rather than every caller in the batch getting the error.
+	// A single call's queries are never split between transactions.
+	IsolateFailures bool
+	// Linger makes a batch wait up to this long after its first queries
+	// arrive for others to join it, until it holds at least count queries.
+	// This trades latency for fewer, larger transactions when writes arrive
+	// steadily. 0 runs a batch with whatever is queued as soon as the
+	// previous one finishes.
+	Linger time.Duration
+	// Workers is the number of batches run at the same time, each in its
+	// own transaction. 0 or 1 runs one batch at a time. With several
+	// workers, queries written with a context from WithPartitionKey are run
+	// in order with the others with the same key, while queries without a
+	// key are run by whichever worker is free.
+	Workers int
+	// MaxBytes limits a batch by the estimated size of its statements and
+	// parameters encoded as JSON, and MaxParameters by the number of
+	// parameters it has, with each element of a list parameter counting as
+	// one. A call whose queries are over a limit on their own fails with
+	// ErrBatchTooLarge. 0 means no limit.
+	MaxBytes      int
+	MaxParameters int
+	// QueueSize is the number of calls that can be waiting to join a batch,
+	// for each worker's queue of partitioned queries as well as the queue
+	// shared by the workers. 0 means the batch count.
+	QueueSize int
+	// QueueTimeout is how long a call waits for room in a full queue before
+	// failing with ErrQueueFull. 0 waits until the call's context is done.
+	// TrySubmit never waits.
+	QueueTimeout time.Duration
+}
+
+type partitionKeyContextKey struct{}
 
-	go cr.batcher()
+// WithPartitionKey returns a context that makes a BatchCypherRunner with
+// several Workers run the queries written with it in the order they were
+// written relative to other queries with the same key, such as the UUID of
+// the concept they write. It has no effect on other runners.
+func WithPartitionKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, partitionKeyContextKey{}, key)
+}
+
+func NewBatchCypherRunnerWithOptions(cypherRunner CypherRunner, count int, opts BatchOptions) CypherRunner {
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = count
+	}
+	cr := BatchCypherRunner{
+		cr:      cypherRunner,
+		ch:      make(chan cypherQueryBatch, queueSize),
+		count:   count,
+		opts:    opts,
+		closing: make(chan struct{}),
+		abort:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts.Workers > 1 {
+		cr.partitions = make([]chan cypherQueryBatch, opts.Workers)
+		for i := range cr.partitions {
+			cr.partitions[i] = make(chan cypherQueryBatch, queueSize)
+		}
+	}
+
+	n := opts.Workers
+	if n < 1 {
+		n = 1
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < n; i++ {
+		q := batchQueue{shared: cr.ch}
+		if cr.partitions != nil {
+			q.own = cr.partitions[i]
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			cr.batcher(q)
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(cr.done)
+	}()
 
 	return &cr
 }
@@ -21,59 +115,451 @@ type BatchCypherRunner struct {
 	cr    CypherRunner
 	ch    chan cypherQueryBatch
 	count int
+	opts  BatchOptions
+	// partitions are the channels of each worker, for queries with a
+	// partition key, while ch is shared by all of them
+	partitions []chan cypherQueryBatch
+	// queued is the number of queries taken from the channels and not yet
+	// run, for the batchQueueSize gauge
+	queued int64
+
+	// lk guards sending on ch against it being closed
+	lk        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	abortOnce sync.Once
+	closing   chan struct{}
+	abort     chan struct{}
+	done      chan struct{}
+	// unwritten counts the batches that failed after Close was called,
+	// guarded by errLk
+	errLk     sync.Mutex
+	unwritten int
+	lastErr   error
+}
+
+// unbatcher is implemented by connections and runners that can run queries
+// without them joining a batch, for queries such as the schema lock's that
+// mustn't share a transaction with, or wait behind, other writers.
+type unbatcher interface {
+	unbatched() CypherRunner
+}
+
+// unbatched returns the runner under any batching done by cr.
+func unbatched(cr CypherRunner) CypherRunner {
+	if u, ok := cr.(unbatcher); ok {
+		return u.unbatched()
+	}
+	return cr
+}
+
+func (bcr *BatchCypherRunner) unbatched() CypherRunner {
+	return unbatched(bcr.cr)
 }
 
 func (bcr *BatchCypherRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	return bcr.CypherBatchContext(context.Background(), queries)
+}
+
+// CypherBatchContext queues the queries to be run in the next batch. If ctx is
+// done before the batch is sent the queries are dropped from it. A batch that
+// is already running is only aborted once every caller with queries in it has
+// given up, so one caller cancelling doesn't fail writes for the others.
+func (bcr *BatchCypherRunner) CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return bcr.queue(ctx, queries, true).Wait(ctx)
+}
+
+// TrySubmit is CypherBatchContext, except that it fails straight away with
+// ErrQueueFull rather than waiting for room in the queue, so that a caller
+// such as a message consumer can pause instead.
+func (bcr *BatchCypherRunner) TrySubmit(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return bcr.queue(ctx, queries, false).Wait(ctx)
+}
+
+func (bcr *BatchCypherRunner) Submit(queries []*neoism.CypherQuery) *Future {
+	return bcr.SubmitContext(context.Background(), queries)
+}
 
-	errCh := make(chan error)
-	bcr.ch <- cypherQueryBatch{queries, errCh}
-	return <-errCh
+// SubmitContext queues the queries to be run in the next batch, returning
+// once they are queued rather than once they are written. It waits for room
+// in the queue like CypherBatchContext, and the Future fails with the error
+// if they can't be queued.
+func (bcr *BatchCypherRunner) SubmitContext(ctx context.Context, queries []*neoism.CypherQuery) *Future {
+	return bcr.queue(ctx, queries, true)
+}
+
+// queue queues the queries, waiting for room if block is set.
+func (bcr *BatchCypherRunner) queue(ctx context.Context, queries []*neoism.CypherQuery, block bool) *Future {
+	size, err := bcr.opts.sizeOf(queries)
+	if err != nil {
+		return failedFuture(err)
+	}
+	if err := bcr.opts.checkSize(size); err != nil {
+		return failedFuture(err)
+	}
+	f := newFuture()
+	if err := bcr.enqueue(ctx, cypherQueryBatch{ctx, queries, f, size}, block); err != nil {
+		return failedFuture(err)
+	}
+	return f
+}
+
+func (bcr *BatchCypherRunner) ReadCypherBatch(queries []*neoism.CypherQuery) error {
+	return bcr.ReadCypherBatchContext(context.Background(), queries)
+}
+
+// ReadCypherBatchContext runs read-only queries straight away with the
+// underlying runner, rather than queueing them behind writes.
+func (bcr *BatchCypherRunner) ReadCypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	select {
+	case <-bcr.closing:
+		return ErrClosed
+	default:
+	}
+	return readCypherBatchContext(ctx, bcr.cr, queries)
+}
+
+// BeginTx begins a transaction with the underlying runner, outside of any
+// batch.
+func (bcr *BatchCypherRunner) BeginTx(ctx context.Context) (Tx, error) {
+	select {
+	case <-bcr.closing:
+		return nil, ErrClosed
+	default:
+	}
+	return beginTx(ctx, bcr.cr)
+}
+
+// enqueue queues cb, failing with ErrQueueFull if there's no room for it
+// without blocking, or within QueueTimeout.
+func (bcr *BatchCypherRunner) enqueue(ctx context.Context, cb cypherQueryBatch, block bool) error {
+	select {
+	case <-bcr.closing:
+		return ErrClosed
+	default:
+	}
+
+	ch := bcr.ch
+	if key, ok := ctx.Value(partitionKeyContextKey{}).(string); ok && bcr.partitions != nil {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		ch = bcr.partitions[h.Sum32()%uint32(len(bcr.partitions))]
+	}
+
+	bcr.lk.RLock()
+	defer bcr.lk.RUnlock()
+	if bcr.closed {
+		return ErrClosed
+	}
+	select {
+	case ch <- cb:
+		return nil
+	default:
+	}
+	if !block {
+		return bcr.queueFull()
+	}
+	var timeout <-chan time.Time
+	if bcr.opts.QueueTimeout > 0 {
+		timer := time.NewTimer(bcr.opts.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case ch <- cb:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return bcr.queueFull()
+	}
+}
+
+func (bcr *BatchCypherRunner) queueFull() error {
+	metrics.GetOrRegisterCounter("batchQueueFull", metrics.DefaultRegistry).Inc(1)
+	return ErrQueueFull
+}
+
+// Close stops the runner accepting new queries, then waits for the queries
+// already queued to be written. If ctx is done first, the running batch is
+// aborted and queued queries fail with ErrClosed. The underlying CypherRunner
+// is closed either way. Close returns an error if any queued queries could
+// not be written or ctx is done, wrapping that error alongside any error
+// from closing the underlying runner.
+func (bcr *BatchCypherRunner) Close(ctx context.Context) error {
+	bcr.closeOnce.Do(func() {
+		close(bcr.closing)
+		go func() {
+			// waits for senders that got in before closing
+			bcr.lk.Lock()
+			bcr.closed = true
+			close(bcr.ch)
+			for _, ch := range bcr.partitions {
+				close(ch)
+			}
+			bcr.lk.Unlock()
+		}()
+	})
+
+	var err error
+	select {
+	case <-bcr.done:
+		bcr.errLk.Lock()
+		unwritten, lastErr := bcr.unwritten, bcr.lastErr
+		bcr.errLk.Unlock()
+		if unwritten > 0 {
+			err = fmt.Errorf("%d batches could not be written while closing: %w", unwritten, lastErr)
+		}
+	case <-ctx.Done():
+		bcr.abortOnce.Do(func() { close(bcr.abort) })
+		err = ctx.Err()
+	}
+
+	closeErr := closeRunner(ctx, bcr.cr)
+	switch {
+	case err == nil:
+		return closeErr
+	case closeErr != nil:
+		return fmt.Errorf("%w (closing the underlying runner also failed: %v)", err, closeErr)
+	}
+	return err
 }
 
 type cypherQueryBatch struct {
+	ctx     context.Context
 	queries []*neoism.CypherQuery
-	err     chan error
+	result  *Future
+	size    batchSize
 }
 
-func (bcr *BatchCypherRunner) batcher() {
+// batchQueue is what a worker takes queries from: its own channel, for
+// queries with a partition key, and the channel shared by all the workers. A
+// channel is set to nil once it is closed. Queries that didn't fit in the last
+// batch are held to start the next one.
+type batchQueue struct {
+	own    chan cypherQueryBatch
+	shared chan cypherQueryBatch
+	held   *cypherQueryBatch
+}
+
+func (q *batchQueue) hold(cb cypherQueryBatch) {
+	q.held = &cb
+}
+
+// wait returns the next queries queued, or false once both channels are
+// closed or stop or timeout fire first.
+func (q *batchQueue) wait(stop <-chan struct{}, timeout <-chan time.Time) (cypherQueryBatch, bool) {
+	if cb, ok := q.takeHeld(); ok {
+		return cb, true
+	}
+	for q.own != nil || q.shared != nil {
+		select {
+		case cb, ok := <-q.own:
+			if ok {
+				return cb, true
+			}
+			q.own = nil
+		case cb, ok := <-q.shared:
+			if ok {
+				return cb, true
+			}
+			q.shared = nil
+		case <-stop:
+			return cypherQueryBatch{}, false
+		case <-timeout:
+			return cypherQueryBatch{}, false
+		}
+	}
+	return cypherQueryBatch{}, false
+}
+
+// pending returns queries that are already queued, without waiting.
+func (q *batchQueue) pending() (cypherQueryBatch, bool) {
+	if cb, ok := q.takeHeld(); ok {
+		return cb, true
+	}
+	for _, ch := range []*chan cypherQueryBatch{&q.own, &q.shared} {
+		if *ch == nil {
+			continue
+		}
+		select {
+		case cb, ok := <-*ch:
+			if ok {
+				return cb, true
+			}
+			*ch = nil
+		default:
+		}
+	}
+	return cypherQueryBatch{}, false
+}
+
+func (q *batchQueue) takeHeld() (cypherQueryBatch, bool) {
+	if q.held == nil {
+		return cypherQueryBatch{}, false
+	}
+	cb := *q.held
+	q.held = nil
+	return cb, true
+}
+
+// batcher is a worker, running one batch at a time from q.
+func (bcr *BatchCypherRunner) batcher(q batchQueue) {
 	g := metrics.GetOrRegisterGauge("batchQueueSize", metrics.DefaultRegistry)
 	b := metrics.GetOrRegisterMeter("batchThroughput", metrics.DefaultRegistry)
 	for {
 		var currentQueries []*neoism.CypherQuery
-		var currentErrorChannels []chan error
+		var currentBatches []cypherQueryBatch
+		var size batchSize
+		add := func(cb cypherQueryBatch) {
+			currentBatches = append(currentBatches, cb)
+			currentQueries = append(currentQueries, cb.queries...)
+			size = size.add(cb.size)
+			g.Update(atomic.AddInt64(&bcr.queued, int64(len(cb.queries))))
+		}
+		// addIfFits adds cb unless it would take the batch over the size
+		// limits, in which case it is held for the next batch
+		addIfFits := func(cb cypherQueryBatch) bool {
+			if !bcr.opts.fits(size.add(cb.size)) {
+				q.hold(cb)
+				return false
+			}
+			add(cb)
+			return true
+		}
 		// wait for at least one
-		cb := <-bcr.ch
-		currentErrorChannels = append(currentErrorChannels, cb.err)
-		for _, query := range cb.queries {
-			currentQueries = append(currentQueries, query)
-			g.Update(int64(len(currentQueries)))
+		cb, ok := q.wait(nil, nil)
+		if !ok {
+			return
 		}
+		add(cb)
 		// add any others pending (up to max size)
-		for len(bcr.ch) > 0 && len(currentQueries) < bcr.count {
-			cb = <-bcr.ch
-			currentErrorChannels = append(currentErrorChannels, cb.err)
-			for _, query := range cb.queries {
-				currentQueries = append(currentQueries, query)
-				g.Update(int64(len(currentQueries)))
+		for len(currentQueries) < bcr.count {
+			cb, ok := q.pending()
+			if !ok || !addIfFits(cb) {
+				break
 			}
-
+		}
+		// with Linger, wait for others to join the batch. This stops early
+		// when the runner is closing, so Close doesn't wait out the linger.
+		if bcr.opts.Linger > 0 && len(currentQueries) < bcr.count {
+			timer := time.NewTimer(bcr.opts.Linger)
+			for len(currentQueries) < bcr.count {
+				cb, ok := q.wait(bcr.closing, timer.C)
+				if !ok || !addIfFits(cb) {
+					break
+				}
+			}
+			timer.Stop()
+		}
+		collected := int64(len(currentQueries))
+		// drop the queries of callers that have already given up
+		currentBatches, currentQueries = bcr.liveBatches(currentBatches)
+		if len(currentBatches) == 0 {
+			g.Update(atomic.AddInt64(&bcr.queued, -collected))
+			continue
 		}
 		// run the batch of queries
 		t := metrics.GetOrRegisterTimer("execute-neo4j-batch", metrics.DefaultRegistry)
-		var err error
+		var errs []error
 		t.Time(func() {
-			err = processCypherBatch(bcr, currentQueries)
+			ctx, cancel := batchContext(currentBatches, bcr.abort)
+			defer cancel()
+			errs = bcr.run(ctx, currentBatches)
 		})
-		for _, cec := range currentErrorChannels {
-			cec <- err
+		for i, cb := range currentBatches {
+			bcr.countUnwritten(errs[i])
+			cb.result.resolve(errs[i])
 		}
 		b.Mark(int64(len(currentQueries)))
-		g.Update(0)
+		g.Update(atomic.AddInt64(&bcr.queued, -collected))
+	}
+}
+
+// run runs the batches in a single transaction and returns the error for each
+// of them. With IsolateFailures, a transaction that fails because of a
+// statement is bisected and each half is retried.
+func (bcr *BatchCypherRunner) run(ctx context.Context, batches []cypherQueryBatch) []error {
+	var queries []*neoism.CypherQuery
+	for _, cb := range batches {
+		queries = append(queries, cb.queries...)
+	}
+	err := processCypherBatch(ctx, bcr, queries)
+
+	errs := make([]error, len(batches))
+	if !isStatementError(err) || !bcr.opts.IsolateFailures || len(batches) == 1 {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	metrics.GetOrRegisterCounter("batchFailureBisections", metrics.DefaultRegistry).Inc(1)
+	mid := len(batches) / 2
+	copy(errs, bcr.run(ctx, batches[:mid]))
+	copy(errs[mid:], bcr.run(ctx, batches[mid:]))
+	return errs
+}
+
+// liveBatches returns the batches whose context is not yet done, and their
+// queries. The other batches are sent their context's error, or ErrClosed if
+// Close has given up waiting for them.
+func (bcr *BatchCypherRunner) liveBatches(batches []cypherQueryBatch) ([]cypherQueryBatch, []*neoism.CypherQuery) {
+	var live []cypherQueryBatch
+	var queries []*neoism.CypherQuery
+	for _, cb := range batches {
+		if err := cb.ctx.Err(); err != nil {
+			cb.result.resolve(err)
+			continue
+		}
+		select {
+		case <-bcr.abort:
+			bcr.countUnwritten(ErrClosed)
+			cb.result.resolve(ErrClosed)
+			continue
+		default:
+		}
+		live = append(live, cb)
+		queries = append(queries, cb.queries...)
+	}
+	return live, queries
+}
+
+func (bcr *BatchCypherRunner) countUnwritten(err error) {
+	if err == nil {
+		return
+	}
+	select {
+	case <-bcr.closing:
+		bcr.errLk.Lock()
+		bcr.unwritten++
+		bcr.lastErr = err
+		bcr.errLk.Unlock()
+	default:
 	}
 }
 
-func processCypherBatch(bcr *BatchCypherRunner, currentQueries []*neoism.CypherQuery) error {
-	err := bcr.cr.CypherBatch(currentQueries)
+// batchContext returns a context that is done once the contexts of all the
+// batches are done, or abort is closed.
+func batchContext(batches []cypherQueryBatch, abort <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		for _, cb := range batches {
+			select {
+			case <-cb.ctx.Done():
+			case <-abort:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+func processCypherBatch(ctx context.Context, bcr *BatchCypherRunner, currentQueries []*neoism.CypherQuery) error {
+	err := cypherBatchContext(ctx, bcr.cr, currentQueries)
 	if err != nil {
 		if neoErr, ok := err.(neoism.NeoError); ok && neoErr.Exception == "BatchOperationFailedException" {
 			neoErrMsg := struct {
@@ -86,10 +572,13 @@ func processCypherBatch(bcr *BatchCypherRunner, currentQueries []*neoism.CypherQ
 			}
 
 			for _, nerr := range neoErrMsg.Errors {
-				if nerr.Code == "Neo.ClientError.Schema.ConstraintViolation" || nerr.Code == "Neo.ClientError.Schema.ConstraintValidationFailed" {
+				if newNeo4jError(nerr.Code, nerr.Message, -1).IsConstraintViolation() {
 					return rwapi.ConstraintOrTransactionError{Message: nerr.Message}
 				}
 			}
+			if len(neoErrMsg.Errors) > 0 {
+				return newNeo4jError(neoErrMsg.Errors[0].Code, neoErrMsg.Errors[0].Message, -1)
+			}
 		}
 	}
 	return err
@@ -1,7 +1,9 @@
 package neoutils
 
 import (
+	"context"
 	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -92,6 +94,151 @@ func TestQueryBatching(t *testing.T) {
 
 }
 
+func TestLingerWaitsForBatchToFill(t *testing.T) {
+	dr := &delayRunner{make(chan []*neoism.CypherQuery)}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(dr, 3, BatchOptions{Linger: time.Second})
+
+	errCh := make(chan error)
+	start := time.Now()
+	for _, statement := range []string{"First", "Second", "Third"} {
+		statement := statement
+		go func() {
+			errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: statement}})
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the batch runs as soon as it is full, without waiting out the linger
+	assert.Len(t, <-dr.queriesRun, 3)
+	assert.True(t, time.Since(start) < time.Second)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-errCh)
+	}
+}
+
+func TestLingerRunsPartialBatchAfterWaiting(t *testing.T) {
+	dr := &delayRunner{make(chan []*neoism.CypherQuery)}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(dr, 3, BatchOptions{Linger: 50 * time.Millisecond})
+
+	errCh := make(chan error)
+	start := time.Now()
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Second"}})
+	}()
+
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First"}, {Statement: "Second"}}, <-dr.queriesRun)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errCh)
+	}
+}
+
+func TestCloseDoesNotWaitForLinger(t *testing.T) {
+	mr := &mockRunner{}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(mr, 3, BatchOptions{Linger: time.Hour}).(*BatchCypherRunner)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, batchCypherRunner.Close(ctx))
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First"}}, mr.queriesRun)
+}
+
+func TestWorkersRunBatchesConcurrently(t *testing.T) {
+	gr := &gateRunner{started: make(chan []*neoism.CypherQuery), release: make(chan struct{})}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(gr, 3, BatchOptions{Workers: 2})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	}()
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First"}}, <-gr.started)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Second"}})
+	}()
+	// the second batch starts while the first is still running
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "Second"}}, <-gr.started)
+
+	close(gr.release)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errCh)
+	}
+}
+
+func TestPartitionKeysKeepOrder(t *testing.T) {
+	gr := &gateRunner{started: make(chan []*neoism.CypherQuery), release: make(chan struct{})}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(gr, 3, BatchOptions{Workers: 4}).(*BatchCypherRunner)
+	write := func(key, statement string, errCh chan error) {
+		errCh <- batchCypherRunner.CypherBatchContext(WithPartitionKey(context.Background(), key), []*neoism.CypherQuery{{Statement: statement}})
+	}
+
+	errCh := make(chan error)
+	go write("a", "First a", errCh)
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First a"}}, <-gr.started)
+	go write("a", "Second a", errCh)
+	time.Sleep(10 * time.Millisecond)
+	go write("b", "First b", errCh)
+
+	// b doesn't wait for a, but the second write for a waits for the first
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First b"}}, <-gr.started)
+	select {
+	case queries := <-gr.started:
+		t.Fatalf("%s ran before the first write for its key finished", queries[0].Statement)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(gr.release)
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "Second a"}}, <-gr.started)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-errCh)
+	}
+	assert.NoError(t, batchCypherRunner.Close(context.Background()))
+}
+
+func TestFullQueue(t *testing.T) {
+	gr := &gateRunner{started: make(chan []*neoism.CypherQuery), release: make(chan struct{})}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(gr, 1, BatchOptions{QueueSize: 1, QueueTimeout: 20 * time.Millisecond}).(*BatchCypherRunner)
+	conn := &DefaultNeoConnection{cr: batchCypherRunner}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Running"}})
+	}()
+	<-gr.started
+	go func() {
+		errCh <- conn.TrySubmit(context.Background(), []*neoism.CypherQuery{{Statement: "Queued"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, ErrQueueFull, conn.TrySubmit(context.Background(), []*neoism.CypherQuery{{Statement: "Dropped"}}))
+	start := time.Now()
+	assert.Equal(t, ErrQueueFull, batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Timed out"}}))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	close(gr.release)
+	assert.Equal(t, "Queued", (<-gr.started)[0].Statement)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errCh)
+	}
+}
+
+func TestTrySubmitWithoutQueue(t *testing.T) {
+	mr := &mockRunner{}
+	conn := &DefaultNeoConnection{cr: mr}
+	assert.NoError(t, conn.TrySubmit(context.Background(), []*neoism.CypherQuery{{Statement: "First"}}))
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First"}}, mr.queriesRun)
+}
+
 func TestEveryoneGetsErrorOnFailure(t *testing.T) {
 	mr := &failRunner{}
 	batchCypherRunner := NewBatchCypherRunner(mr, 3)
@@ -119,6 +266,219 @@ func TestEveryoneGetsErrorOnFailure(t *testing.T) {
 	assert.Equal(t, len(errCh), 0, "too many errors")
 }
 
+func TestBatchOperationFailuresAreClassified(t *testing.T) {
+	er := &errorRunner{neoism.NeoError{
+		Exception: "BatchOperationFailedException",
+		Message:   `{"message":"failed","errors":[{"code":"Neo.ClientError.Schema.ConstraintValidationFailed","message":"Node(0) already exists"}]}`,
+	}}
+	batchCypherRunner := NewBatchCypherRunner(er, 3)
+
+	err := batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	assert.Equal(t, rwapi.ConstraintOrTransactionError{Message: "Node(0) already exists"}, err)
+	assert.True(t, IsConstraintViolation(err))
+
+	er.err = neoism.NeoError{
+		Exception: "BatchOperationFailedException",
+		Message:   `{"message":"failed","errors":[{"code":"Neo.TransientError.Transaction.DeadlockDetected","message":"deadlock"}]}`,
+	}
+	err = batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	assert.Equal(t, &Neo4jError{Code: "Neo.TransientError.Transaction.DeadlockDetected", Message: "deadlock", StatementIndex: -1}, err)
+	assert.True(t, IsRetryable(err))
+}
+
+func TestCancelledQueriesAreDroppedFromBatch(t *testing.T) {
+	dr := &delayRunner{make(chan []*neoism.CypherQuery)}
+	batchCypherRunner := NewBatchCypherRunner(dr, 3).(*BatchCypherRunner)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// "First" is now running, so these are queued for the next batch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelledErrCh := make(chan error)
+	go func() {
+		cancelledErrCh <- batchCypherRunner.CypherBatchContext(ctx, []*neoism.CypherQuery{{Statement: "Second"}})
+	}()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Third"}})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-cancelledErrCh)
+
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First"}}, <-dr.queriesRun)
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "Third"}}, <-dr.queriesRun)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errCh)
+	}
+}
+
+func TestCypherBatchContextDoesNotQueueWithDoneContext(t *testing.T) {
+	mr := &mockRunner{}
+	batchCypherRunner := NewBatchCypherRunner(mr, 3).(*BatchCypherRunner)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := batchCypherRunner.CypherBatchContext(ctx, []*neoism.CypherQuery{{Statement: "First"}})
+	assert.Equal(t, context.Canceled, err)
+
+	assert.NoError(t, batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Second"}}))
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "Second"}}, mr.queriesRun)
+}
+
+func TestBatchContextIsDoneWhenAllCallersGiveUp(t *testing.T) {
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	ctx, cancel := batchContext([]cypherQueryBatch{{ctx: ctx1}, {ctx: ctx2}}, nil)
+	defer cancel()
+
+	cancel1()
+	select {
+	case <-ctx.Done():
+		t.Fatal("batch context done while a caller is still waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancel2()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("batch context not done after all callers gave up")
+	}
+}
+
+func TestIsolateFailuresOnlyFailsOffendingCallers(t *testing.T) {
+	ir := &isolationRunner{release: make(chan struct{})}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(ir, 10, BatchOptions{IsolateFailures: true})
+
+	blockErr := make(chan error)
+	go func() {
+		blockErr <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Block"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// these are queued while "Block" runs, so end up in the same batch
+	errs := make([]chan error, 3)
+	for i, statement := range []string{"A", "Bad", "C"} {
+		errs[i] = make(chan error)
+		go func(statement string, errCh chan error) {
+			errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: statement}, {Statement: statement + "2"}})
+		}(statement, errs[i])
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(ir.release)
+
+	assert.NoError(t, <-blockErr)
+	assert.NoError(t, <-errs[0])
+	assert.IsType(t, rwapi.ConstraintOrTransactionError{}, <-errs[1])
+	assert.NoError(t, <-errs[2])
+
+	assert.Equal(t, [][]string{
+		{"Block"},
+		{"A", "A2", "Bad", "Bad2", "C", "C2"},
+		{"A", "A2"},
+		{"Bad", "Bad2", "C", "C2"},
+		{"Bad", "Bad2"},
+		{"C", "C2"},
+	}, ir.transactions)
+}
+
+func TestIsolateFailuresDoesNotRetryOtherErrors(t *testing.T) {
+	mr := &failRunner{}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(mr, 3, BatchOptions{IsolateFailures: true})
+	assert.Error(t, batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}}))
+}
+
+func TestCloseFlushesQueuedQueries(t *testing.T) {
+	dr := &delayRunner{make(chan []*neoism.CypherQuery)}
+	batchCypherRunner := NewBatchCypherRunner(dr, 3).(*BatchCypherRunner)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Second"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closeErr := make(chan error)
+	go func() {
+		closeErr <- batchCypherRunner.Close(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, ErrClosed, batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Third"}}))
+
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "First"}}, <-dr.queriesRun)
+	assert.Equal(t, []*neoism.CypherQuery{{Statement: "Second"}}, <-dr.queriesRun)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errCh)
+	}
+	assert.NoError(t, <-closeErr)
+
+	// closing again is harmless
+	assert.NoError(t, batchCypherRunner.Close(context.Background()))
+}
+
+func TestCloseReportsUnwrittenQueries(t *testing.T) {
+	ir := &isolationRunner{release: make(chan struct{})}
+	batchCypherRunner := NewBatchCypherRunner(ir, 3).(*BatchCypherRunner)
+
+	blockErr := make(chan error)
+	go func() {
+		blockErr <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Block"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	badErr := make(chan error)
+	go func() {
+		badErr <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Bad"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closeErr := make(chan error)
+	go func() {
+		closeErr <- batchCypherRunner.Close(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(ir.release)
+
+	assert.NoError(t, <-blockErr)
+	assert.Error(t, <-badErr)
+	assert.Error(t, <-closeErr)
+	assert.True(t, ir.closed, "the underlying runner should be closed")
+}
+
+func TestCloseAbortsWhenContextIsDone(t *testing.T) {
+	br := &blockingContextRunner{started: make(chan struct{}, 1)}
+	batchCypherRunner := NewBatchCypherRunner(br, 3).(*BatchCypherRunner)
+
+	runningErr := make(chan error)
+	go func() {
+		runningErr <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	}()
+	<-br.started
+	queuedErr := make(chan error)
+	go func() {
+		queuedErr <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "Second"}})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(batchCypherRunner.Close(ctx), context.DeadlineExceeded))
+
+	assert.Equal(t, context.Canceled, <-runningErr)
+	assert.Equal(t, ErrClosed, <-queuedErr)
+	assert.True(t, br.closed(), "the underlying runner should be closed")
+}
+
 func TestAttemptToWriteConflictItem(t *testing.T) {
 	db := connectTest(t)
 	mr := StringerDb{db}
@@ -158,6 +518,24 @@ func TestAttemptToWriteConflictItem(t *testing.T) {
 	err = <-errCh
 	assert.Error(t, err)
 	assert.IsType(t, rwapi.ConstraintOrTransactionError{}, err)
+	assert.True(t, IsConstraintViolation(err))
+}
+
+// gateRunner sends the queries of each batch on started, then runs them once
+// release is closed.
+type gateRunner struct {
+	started chan []*neoism.CypherQuery
+	release chan struct{}
+}
+
+func (gr *gateRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	gr.started <- queries
+	<-gr.release
+	return nil
+}
+
+func (gr *gateRunner) String() string {
+	return "URL"
 }
 
 type mockRunner struct {
@@ -184,6 +562,14 @@ func (mr *failRunner) String() string {
 	return "URL"
 }
 
+type errorRunner struct {
+	err error
+}
+
+func (er *errorRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	return er.err
+}
+
 type delayRunner struct {
 	queriesRun chan []*neoism.CypherQuery
 }
@@ -196,3 +582,58 @@ func (dr *delayRunner) CypherBatch(queries []*neoism.CypherQuery) error {
 func (dr *delayRunner) String() string {
 	return "URL"
 }
+
+// isolationRunner fails any transaction containing the "Bad" statement, and
+// blocks on the "Block" statement until released.
+type isolationRunner struct {
+	release      chan struct{}
+	transactions [][]string
+	closed       bool
+}
+
+func (ir *isolationRunner) Close(ctx context.Context) error {
+	ir.closed = true
+	return nil
+}
+
+func (ir *isolationRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	var statements []string
+	for _, q := range queries {
+		statements = append(statements, q.Statement)
+	}
+	ir.transactions = append(ir.transactions, statements)
+	for _, s := range statements {
+		switch s {
+		case "Block":
+			<-ir.release
+		case "Bad":
+			return rwapi.ConstraintOrTransactionError{Message: "constraint violated"}
+		}
+	}
+	return nil
+}
+
+// blockingContextRunner blocks every batch until its context is done.
+type blockingContextRunner struct {
+	started  chan struct{}
+	isClosed int32
+}
+
+func (br *blockingContextRunner) Close(ctx context.Context) error {
+	atomic.StoreInt32(&br.isClosed, 1)
+	return nil
+}
+
+func (br *blockingContextRunner) closed() bool {
+	return atomic.LoadInt32(&br.isClosed) == 1
+}
+
+func (br *blockingContextRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	return br.CypherBatchContext(context.Background(), queries)
+}
+
+func (br *blockingContextRunner) CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	br.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
@@ -0,0 +1,77 @@
+package neoutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// ErrBatchTooLarge is wrapped by the error returned by a BatchCypherRunner
+// for a call whose queries alone are over BatchOptions.MaxBytes or
+// MaxParameters, and so could never be sent.
+var ErrBatchTooLarge = errors.New("neoutils: queries are larger than the batch limit")
+
+// batchSize is the estimated size of some queries, as counted by the limits in
+// BatchOptions.
+type batchSize struct {
+	bytes  int
+	params int
+}
+
+func (s batchSize) add(o batchSize) batchSize {
+	return batchSize{s.bytes + o.bytes, s.params + o.params}
+}
+
+// sizeOf estimates the size of queries, only working out what opts limits.
+func (opts BatchOptions) sizeOf(queries []*neoism.CypherQuery) (batchSize, error) {
+	var size batchSize
+	for _, q := range queries {
+		if opts.MaxBytes > 0 {
+			b, err := json.Marshal(struct {
+				Statement  string                 `json:"statement"`
+				Parameters map[string]interface{} `json:"parameters,omitempty"`
+			}{q.Statement, q.Parameters})
+			if err != nil {
+				return batchSize{}, fmt.Errorf("neoutils: cannot encode parameters: %w", err)
+			}
+			size.bytes += len(b)
+		}
+		if opts.MaxParameters > 0 {
+			for _, v := range q.Parameters {
+				size.params += paramCount(v)
+			}
+		}
+	}
+	return size, nil
+}
+
+// paramCount counts each element of a list parameter, such as one used with
+// UNWIND, and any other parameter as one.
+func paramCount(v interface{}) int {
+	rv := reflect.ValueOf(v)
+	if (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() != reflect.Uint8 {
+		return rv.Len()
+	}
+	return 1
+}
+
+// fits says if a batch of size is within the limits.
+func (opts BatchOptions) fits(size batchSize) bool {
+	return (opts.MaxBytes <= 0 || size.bytes <= opts.MaxBytes) &&
+		(opts.MaxParameters <= 0 || size.params <= opts.MaxParameters)
+}
+
+// checkSize returns an error wrapping ErrBatchTooLarge if a call's queries
+// of size don't fit in a batch on their own.
+func (opts BatchOptions) checkSize(size batchSize) error {
+	if opts.MaxBytes > 0 && size.bytes > opts.MaxBytes {
+		return fmt.Errorf("%w: about %d bytes, over the limit of %d", ErrBatchTooLarge, size.bytes, opts.MaxBytes)
+	}
+	if opts.MaxParameters > 0 && size.params > opts.MaxParameters {
+		return fmt.Errorf("%w: %d parameters, over the limit of %d", ErrBatchTooLarge, size.params, opts.MaxParameters)
+	}
+	return nil
+}
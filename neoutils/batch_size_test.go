@@ -0,0 +1,86 @@
+package neoutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchSizeEstimates(t *testing.T) {
+	opts := BatchOptions{MaxBytes: 1, MaxParameters: 1}
+	size, err := opts.sizeOf([]*neoism.CypherQuery{
+		{Statement: "UNWIND $rows AS row CREATE (:Thing {uuid: row})", Parameters: map[string]interface{}{"rows": []string{"1", "2", "3"}}},
+		{Statement: "MATCH (t:Thing {uuid: $uuid}) SET t.data = $data", Parameters: map[string]interface{}{"uuid": "1", "data": []byte("abc")}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, size.params)
+	assert.Equal(t, 203, size.bytes)
+
+	_, err = opts.sizeOf([]*neoism.CypherQuery{{Statement: "RETURN $f", Parameters: map[string]interface{}{"f": func() {}}}})
+	assert.Error(t, err)
+
+	// only what is limited is worked out
+	size, err = BatchOptions{}.sizeOf([]*neoism.CypherQuery{{Statement: "RETURN $n", Parameters: map[string]interface{}{"n": 1}}})
+	assert.NoError(t, err)
+	assert.Equal(t, batchSize{}, size)
+}
+
+func TestOversizedCallsAreRejected(t *testing.T) {
+	mr := &mockRunner{}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(mr, 10, BatchOptions{MaxBytes: 100, MaxParameters: 2})
+
+	err := batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "UNWIND $rows AS row RETURN row", Parameters: map[string]interface{}{"rows": []int{1, 2, 3}}}})
+	assert.True(t, errors.Is(err, ErrBatchTooLarge), "got %v", err)
+	assert.EqualError(t, err, "neoutils: queries are larger than the batch limit: 3 parameters, over the limit of 2")
+
+	long := make([]byte, 100)
+	for i := range long {
+		long[i] = 'x'
+	}
+	err = batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: string(long)}})
+	assert.True(t, errors.Is(err, ErrBatchTooLarge), "got %v", err)
+	assert.Empty(t, mr.queriesRun)
+
+	assert.NoError(t, batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: "RETURN $n", Parameters: map[string]interface{}{"n": 1}}}))
+}
+
+func TestBatchesAreSplitBySize(t *testing.T) {
+	gr := &gateRunner{started: make(chan []*neoism.CypherQuery), release: make(chan struct{})}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(gr, 10, BatchOptions{MaxParameters: 3}).(*BatchCypherRunner)
+	write := func(statement string, params int, errCh chan error) {
+		p := map[string]interface{}{}
+		for i := 0; i < params; i++ {
+			p[string(rune('a'+i))] = i
+		}
+		errCh <- batchCypherRunner.CypherBatch([]*neoism.CypherQuery{{Statement: statement, Parameters: p}})
+	}
+
+	errCh := make(chan error)
+	go write("Block", 0, errCh)
+	assert.Equal(t, "Block", (<-gr.started)[0].Statement)
+	for _, w := range []struct {
+		statement string
+		params    int
+	}{{"First", 2}, {"Second", 1}, {"Third", 1}, {"Fourth", 2}} {
+		go write(w.statement, w.params, errCh)
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(gr.release)
+
+	var batches [][]string
+	for i := 0; i < 2; i++ {
+		var statements []string
+		for _, q := range <-gr.started {
+			statements = append(statements, q.Statement)
+		}
+		batches = append(batches, statements)
+	}
+	// Third didn't fit with First and Second, so starts the next batch
+	assert.Equal(t, [][]string{{"First", "Second"}, {"Third", "Fourth"}}, batches)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, <-errCh)
+	}
+}
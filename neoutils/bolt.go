@@ -0,0 +1,458 @@
+package neoutils
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bolt message signatures, protocol version 4.x.
+const (
+	boltMsgHello    = 0x01
+	boltMsgGoodbye  = 0x02
+	boltMsgReset    = 0x0F
+	boltMsgRun      = 0x10
+	boltMsgBegin    = 0x11
+	boltMsgCommit   = 0x12
+	boltMsgRollback = 0x13
+	boltMsgPull     = 0x3F
+
+	boltMsgSuccess = 0x70
+	boltMsgRecord  = 0x71
+	boltMsgIgnored = 0x7E
+	boltMsgFailure = 0x7F
+)
+
+const boltMaxChunkSize = 0xFFFF
+
+// defaultBoltIOTimeout is used when ConnectionConfig.IOTimeout is 0.
+const defaultBoltIOTimeout = 5 * time.Minute
+
+var (
+	boltMagic = []byte{0x60, 0x60, 0xB0, 0x17}
+	// proposes 4.4 down to 4.3 as a range, then 4.2 for servers that predate
+	// version ranges. This covers Neo4j 4.2 onwards, including 5.x.
+	boltVersions = []byte{
+		0x00, 0x01, 0x04, 0x04,
+		0x00, 0x00, 0x02, 0x04,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	errBoltIgnored = errors.New("bolt: request ignored by server after an earlier failure")
+)
+
+// newBoltFailure converts a FAILURE message returned by the server into an
+// error not yet attributed to a statement.
+func newBoltFailure(msg *packStreamStruct) *Neo4jError {
+	meta := messageMetadata(msg)
+	code, _ := meta["code"].(string)
+	message, _ := meta["message"].(string)
+	return newNeo4jError(code, message, -1)
+}
+
+// IsBoltURL reports whether neoURL uses one of the Bolt schemes
+// (bolt, bolt+s, bolt+ssc, neo4j, neo4j+s, neo4j+ssc) rather than the HTTP REST API.
+func IsBoltURL(neoURL string) bool {
+	u, err := url.Parse(neoURL)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "bolt", "bolt+s", "bolt+ssc", "neo4j", "neo4j+s", "neo4j+ssc":
+		return true
+	}
+	return false
+}
+
+// boltConn is a single Bolt connection. It is not safe for concurrent use.
+type boltConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	major   byte
+	minor   byte
+	server  string
+	healthy bool
+	// timeout limits how long each read or write may take, 0 for no limit
+	timeout time.Duration
+	// idleSince is when the connection was returned to the pool
+	idleSince time.Time
+
+	// deadlineLk guards setting the deadline for the next read or write
+	// against the connection being interrupted
+	deadlineLk  sync.Mutex
+	interrupted bool
+}
+
+// boltDialer holds everything needed to open and authenticate new Bolt connections.
+type boltDialer struct {
+	address   string
+	tlsConfig *tls.Config
+	auth      map[string]interface{}
+	userAgent string
+	dialer    net.Dialer
+	// ioTimeout is the timeout of the connections dialled, see
+	// ConnectionConfig.IOTimeout
+	ioTimeout time.Duration
+}
+
+func newBoltDialer(neoURL string, userAgent string) (*boltDialer, error) {
+	u, err := url.Parse(neoURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, urlError
+	}
+
+	d := &boltDialer{
+		address:   u.Host,
+		userAgent: userAgent,
+		auth:      map[string]interface{}{"scheme": "none"},
+		ioTimeout: defaultBoltIOTimeout,
+		dialer: net.Dialer{
+			Timeout:   60 * time.Second,
+			KeepAlive: 60 * time.Second,
+		},
+	}
+	if u.Port() == "" {
+		d.address = net.JoinHostPort(u.Hostname(), "7687")
+	}
+
+	switch {
+	case strings.HasSuffix(u.Scheme, "+s"):
+		d.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	case strings.HasSuffix(u.Scheme, "+ssc"):
+		d.tlsConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: true}
+	}
+
+	if u.User != nil {
+		password, _ := u.User.Password()
+		d.auth = map[string]interface{}{
+			"scheme":      "basic",
+			"principal":   u.User.Username(),
+			"credentials": password,
+		}
+	}
+	return d, nil
+}
+
+func (d *boltDialer) dial(ctx context.Context) (*boltConn, error) {
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+	if d.tlsConfig != nil {
+		conn = tls.Client(conn, d.tlsConfig)
+	}
+
+	c := &boltConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		timeout: d.ioTimeout,
+	}
+	stop := c.watch(ctx)
+	defer stop()
+
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.hello(d.userAgent, d.auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.healthy = true
+	return c, nil
+}
+
+func (c *boltConn) handshake() error {
+	c.extendDeadline()
+	if _, err := c.w.Write(boltMagic); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(boltVersions); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	var agreed [4]byte
+	if _, err := io.ReadFull(c.r, agreed[:]); err != nil {
+		return err
+	}
+	if agreed == [4]byte{} {
+		return errors.New("bolt: server does not support protocol version 4.2 or later")
+	}
+	c.major, c.minor = agreed[3], agreed[2]
+	return nil
+}
+
+func (c *boltConn) hello(userAgent string, auth map[string]interface{}) error {
+	extra := map[string]interface{}{"user_agent": userAgent}
+	for k, v := range auth {
+		extra[k] = v
+	}
+	meta, err := c.request(boltMsgHello, extra)
+	if err != nil {
+		return err
+	}
+	c.server, _ = meta["server"].(string)
+	return nil
+}
+
+// serverVersion parses the server agent sent in reply to HELLO, e.g. "Neo4j/4.4.12".
+func (c *boltConn) serverVersion() (major, minor int) {
+	return parseServerVersion(c.server)
+}
+
+// send buffers a message; it is written to the network on the next flush.
+func (c *boltConn) send(signature byte, fields ...interface{}) error {
+	p := packer{}
+	if err := p.packStruct(signature, fields...); err != nil {
+		return err
+	}
+	msg := p.buf
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > boltMaxChunkSize {
+			n = boltMaxChunkSize
+		}
+		if _, err := c.w.Write(appendUint16(nil, uint16(n))); err != nil {
+			return c.fail(err)
+		}
+		if _, err := c.w.Write(msg[:n]); err != nil {
+			return c.fail(err)
+		}
+		msg = msg[n:]
+	}
+	if _, err := c.w.Write([]byte{0, 0}); err != nil {
+		return c.fail(err)
+	}
+	return nil
+}
+
+func (c *boltConn) flush() error {
+	c.extendDeadline()
+	return c.fail(c.w.Flush())
+}
+
+// receive reads the next message from the server.
+func (c *boltConn) receive() (*packStreamStruct, error) {
+	var msg []byte
+	var header [2]byte
+	for {
+		// each chunk, including the NOOPs sent during long queries, shows
+		// the server is still there
+		c.extendDeadline()
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, c.fail(err)
+		}
+		n := int(binary.BigEndian.Uint16(header[:]))
+		if n == 0 {
+			if len(msg) == 0 {
+				// a NOOP chunk, sent by the server to keep the connection alive
+				continue
+			}
+			break
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, n)...)
+		if _, err := io.ReadFull(c.r, msg[start:]); err != nil {
+			return nil, c.fail(err)
+		}
+	}
+
+	u := unpacker{buf: msg}
+	v, err := u.unpack()
+	if err != nil {
+		return nil, c.fail(err)
+	}
+	s, ok := v.(*packStreamStruct)
+	if !ok {
+		return nil, c.fail(fmt.Errorf("bolt: expected a message structure, got %T", v))
+	}
+	return s, nil
+}
+
+// watch interrupts any I/O on the connection once ctx is done, which leaves
+// the connection unusable. The returned function stops watching.
+func (c *boltConn) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.interrupt()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		c.deadlineLk.Lock()
+		c.interrupted = false
+		c.conn.SetDeadline(time.Time{})
+		c.deadlineLk.Unlock()
+	}
+}
+
+// interrupt makes any I/O on the connection fail straight away, which leaves
+// the connection unusable.
+func (c *boltConn) interrupt() {
+	c.deadlineLk.Lock()
+	defer c.deadlineLk.Unlock()
+	c.interrupted = true
+	c.conn.SetDeadline(time.Unix(1, 0))
+}
+
+// extendDeadline gives the next read or write the connection's timeout,
+// unless the connection has been interrupted. Without it, a read from a
+// server that has gone away without closing the connection never returns.
+func (c *boltConn) extendDeadline() {
+	if c.timeout <= 0 {
+		return
+	}
+	c.deadlineLk.Lock()
+	defer c.deadlineLk.Unlock()
+	if !c.interrupted {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// fail marks the connection as unusable if err is non-nil, and returns err.
+func (c *boltConn) fail(err error) error {
+	if err != nil {
+		c.healthy = false
+	}
+	return err
+}
+
+// summary reads the response to a single request, discarding any records.
+func (c *boltConn) summary() (map[string]interface{}, error) {
+	for {
+		msg, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Tag {
+		case boltMsgRecord:
+			continue
+		case boltMsgSuccess:
+			return messageMetadata(msg), nil
+		case boltMsgIgnored:
+			return nil, errBoltIgnored
+		case boltMsgFailure:
+			return nil, newBoltFailure(msg)
+		default:
+			return nil, c.fail(fmt.Errorf("bolt: unexpected message 0x%02X", msg.Tag))
+		}
+	}
+}
+
+func messageMetadata(msg *packStreamStruct) map[string]interface{} {
+	if len(msg.Fields) > 0 {
+		if m, ok := msg.Fields[0].(map[string]interface{}); ok {
+			return m
+		}
+	}
+	return map[string]interface{}{}
+}
+
+func (c *boltConn) request(signature byte, fields ...interface{}) (map[string]interface{}, error) {
+	if err := c.send(signature, fields...); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	return c.summary()
+}
+
+// run executes a statement and pulls all of its records. extra holds the
+// metadata for an auto-commit transaction, and must be empty inside an
+// explicit one. When run fails the connection must be reset before it is used
+// again.
+func (c *boltConn) run(statement string, params, extra map[string]interface{}) ([]string, [][]interface{}, error) {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	if extra == nil {
+		extra = map[string]interface{}{}
+	}
+	if err := c.send(boltMsgRun, statement, params, extra); err != nil {
+		return nil, nil, err
+	}
+	if err := c.send(boltMsgPull, map[string]interface{}{"n": int64(-1)}); err != nil {
+		return nil, nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, nil, err
+	}
+
+	meta, runErr := c.summary()
+	var columns []string
+	if runErr == nil {
+		fields, _ := meta["fields"].([]interface{})
+		for _, f := range fields {
+			name, _ := f.(string)
+			columns = append(columns, name)
+		}
+	}
+
+	var rows [][]interface{}
+	for {
+		msg, err := c.receive()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch msg.Tag {
+		case boltMsgRecord:
+			if len(msg.Fields) > 0 {
+				row, _ := msg.Fields[0].([]interface{})
+				rows = append(rows, row)
+			}
+			continue
+		case boltMsgSuccess, boltMsgIgnored:
+			if runErr != nil {
+				return nil, nil, runErr
+			}
+			return columns, rows, nil
+		case boltMsgFailure:
+			return nil, nil, newBoltFailure(msg)
+		default:
+			return nil, nil, c.fail(fmt.Errorf("bolt: unexpected message 0x%02X", msg.Tag))
+		}
+	}
+}
+
+// reset returns the connection to a clean state after a failure, rolling back
+// any open transaction.
+func (c *boltConn) reset() error {
+	_, err := c.request(boltMsgReset)
+	return c.fail(err)
+}
+
+func (c *boltConn) close() error {
+	if c.healthy {
+		c.send(boltMsgGoodbye)
+		c.flush()
+	}
+	c.healthy = false
+	return c.conn.Close()
+}
@@ -0,0 +1,731 @@
+package neoutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// boltIdleCheckAfter is how long a connection can be idle before it is
+// checked when taken from the pool.
+const boltIdleCheckAfter = 10 * time.Second
+
+// boltPool keeps idle Bolt connections for reuse. New connections are dialled
+// on demand, so the number of connections in use is unbounded, but at most
+// cap(idle) are kept open while idle.
+type boltPool struct {
+	dialer *boltDialer
+	idle   chan *boltConn
+	// checkAfter is how long a connection can be idle before it is reset
+	// when taken from the pool, to check that the server is still there
+	checkAfter time.Duration
+
+	lk     sync.RWMutex
+	closed bool
+}
+
+func newBoltPool(dialer *boltDialer, maxIdle int) *boltPool {
+	return &boltPool{dialer: dialer, idle: make(chan *boltConn, maxIdle), checkAfter: boltIdleCheckAfter}
+}
+
+func (p *boltPool) acquire(ctx context.Context) (*boltConn, error) {
+	p.lk.RLock()
+	closed := p.closed
+	p.lk.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	for {
+		select {
+		case c := <-p.idle:
+			if p.check(ctx, c) {
+				return c, nil
+			}
+		default:
+			return p.dialer.dial(ctx)
+		}
+	}
+}
+
+// check resets c if it has been idle for a while, closing it if that fails,
+// and returns whether it can be used.
+func (p *boltPool) check(ctx context.Context, c *boltConn) bool {
+	if time.Since(c.idleSince) < p.checkAfter {
+		return true
+	}
+	stop := c.watch(ctx)
+	err := c.reset()
+	stop()
+	if err != nil {
+		c.close()
+		return false
+	}
+	return true
+}
+
+func (p *boltPool) release(c *boltConn) {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	if !c.healthy || p.closed {
+		c.close()
+		return
+	}
+	c.idleSince = time.Now()
+	select {
+	case p.idle <- c:
+	default:
+		c.close()
+	}
+}
+
+// close closes the idle connections. Connections in use are closed when they
+// are released.
+func (p *boltPool) close() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.closed = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.close()
+		default:
+			return
+		}
+	}
+}
+
+// withConn runs f with a pooled connection, resetting the connection if f fails
+// so that it can be reused. If ctx is done while f is running the connection
+// is closed, and ctx's error is returned.
+func (p *boltPool) withConn(ctx context.Context, f func(c *boltConn) error) error {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.release(c)
+
+	stop := c.watch(ctx)
+	err = f(c)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		c.healthy = false
+		return ctx.Err()
+	}
+	if err != nil && c.healthy {
+		c.reset()
+	}
+	return err
+}
+
+// BoltCypherRunner runs each batch of queries in a single transaction using
+// the Bolt protocol, for Neo4j versions that no longer serve the REST API.
+type BoltCypherRunner struct {
+	url  string
+	pool *boltPool
+	// database is blank for the server's default database
+	database string
+	// shared is set when the pool belongs to another runner, which closes it
+	shared bool
+}
+
+func (cr *BoltCypherRunner) address() string {
+	return urlHost(cr.url)
+}
+
+func (cr *BoltCypherRunner) String() string {
+	if cr.database != "" {
+		return cr.url + " (" + cr.database + ")"
+	}
+	return cr.url
+}
+
+// Close closes the runner's connections, including those used for ensuring
+// indexes and constraints. Runners for other databases that share the
+// connections are closed too, while closing one of those does nothing.
+func (cr *BoltCypherRunner) Close(ctx context.Context) error {
+	if !cr.shared {
+		cr.pool.close()
+	}
+	return nil
+}
+
+func (cr *BoltCypherRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	return cr.CypherBatchContext(context.Background(), queries)
+}
+
+// CypherBatchContext runs the queries in a single transaction. If ctx is done
+// before the transaction commits it is abandoned, and rolled back by the server.
+// A context error doesn't mean the queries weren't written, as ctx can be done
+// after the server has committed but before it has answered, so don't blindly
+// run a batch that isn't idempotent again.
+func (cr *BoltCypherRunner) CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return cr.batch(ctx, queries, false)
+}
+
+func (cr *BoltCypherRunner) ReadCypherBatch(queries []*neoism.CypherQuery) error {
+	return cr.ReadCypherBatchContext(context.Background(), queries)
+}
+
+// ReadCypherBatchContext runs the queries in a single read transaction, which
+// a cluster member can serve without the leader.
+func (cr *BoltCypherRunner) ReadCypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return cr.batch(ctx, queries, true)
+}
+
+func (cr *BoltCypherRunner) batch(ctx context.Context, queries []*neoism.CypherQuery, read bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	begin := boltTxMetadata(cr.database)
+	if read {
+		begin["mode"] = "r"
+	}
+	return cr.pool.withConn(ctx, func(c *boltConn) error {
+		if _, err := c.request(boltMsgBegin, begin); err != nil {
+			return err
+		}
+		if err := runBoltQueries(c, queries); err != nil {
+			return err
+		}
+		_, err := c.request(boltMsgCommit)
+		return err
+	})
+}
+
+// runBoltQueries runs queries in the open transaction on c.
+func runBoltQueries(c *boltConn, queries []*neoism.CypherQuery) error {
+	for i, q := range queries {
+		params, err := boltParameters(q.Parameters)
+		if err != nil {
+			return err
+		}
+		columns, rows, err := c.run(q.Statement, params, nil)
+		if neoErr, ok := err.(*Neo4jError); ok {
+			neoErr.StatementIndex = i
+			return statementError(neoErr)
+		}
+		if err != nil {
+			return err
+		}
+		if q.Result != nil {
+			if err := unmarshalBoltRows(columns, rows, q.Result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BeginTx begins a transaction on one of the pooled connections, which is
+// kept until the transaction ends.
+func (cr *BoltCypherRunner) BeginTx(ctx context.Context) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := cr.pool.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx := &boltTx{ctx: ctx, pool: cr.pool, c: c, ended: make(chan struct{})}
+	go tx.watch()
+
+	tx.lk.Lock()
+	defer tx.lk.Unlock()
+	if _, err := c.request(boltMsgBegin, boltTxMetadata(cr.database)); err != nil {
+		return nil, tx.end(err)
+	}
+	return tx, nil
+}
+
+// boltTx is a transaction holding a pooled connection.
+type boltTx struct {
+	ctx  context.Context
+	pool *boltPool
+	c    *boltConn
+
+	// lk is held for each exchange with the server
+	lk sync.Mutex
+	// err is returned once the transaction has ended
+	err error
+
+	// connLk guards interrupting the connection against it being released
+	connLk   sync.Mutex
+	released bool
+	ended    chan struct{}
+}
+
+// watch abandons the transaction when ctx is done, interrupting any query in
+// progress. The server rolls it back when the connection closes.
+func (tx *boltTx) watch() {
+	select {
+	case <-tx.ctx.Done():
+	case <-tx.ended:
+		return
+	}
+	tx.connLk.Lock()
+	if !tx.released {
+		tx.c.interrupt()
+	}
+	tx.connLk.Unlock()
+
+	tx.lk.Lock()
+	defer tx.lk.Unlock()
+	if tx.err == nil {
+		tx.end(tx.ctx.Err())
+	}
+}
+
+// end returns the connection to the pool. It returns err, or ctx's error if
+// the failure was caused by ctx. It must be called holding lk.
+func (tx *boltTx) end(err error) error {
+	tx.err = txDoneError(tx.ctx)
+	tx.connLk.Lock()
+	tx.released = true
+	tx.connLk.Unlock()
+	close(tx.ended)
+
+	if tx.ctx.Err() != nil {
+		// the connection may have been interrupted
+		tx.c.healthy = false
+		if err != nil {
+			err = tx.ctx.Err()
+		}
+	} else if err != nil && tx.c.healthy {
+		tx.c.reset()
+	}
+	tx.pool.release(tx.c)
+	return err
+}
+
+func (tx *boltTx) Run(queries []*neoism.CypherQuery) error {
+	tx.lk.Lock()
+	defer tx.lk.Unlock()
+	if tx.err != nil {
+		return tx.err
+	}
+	if err := runBoltQueries(tx.c, queries); err != nil {
+		// the server rolls back a transaction when a query fails
+		return tx.end(err)
+	}
+	return nil
+}
+
+func (tx *boltTx) Commit() error {
+	tx.lk.Lock()
+	defer tx.lk.Unlock()
+	if tx.err != nil {
+		return tx.err
+	}
+	_, err := tx.c.request(boltMsgCommit)
+	return tx.end(err)
+}
+
+func (tx *boltTx) Rollback() error {
+	tx.lk.Lock()
+	defer tx.lk.Unlock()
+	if tx.err != nil {
+		return tx.err
+	}
+	_, err := tx.c.request(boltMsgRollback)
+	return tx.end(err)
+}
+
+// boltTxMetadata returns the metadata selecting the database a transaction
+// runs in, which is left to the server when database is blank.
+func boltTxMetadata(database string) map[string]interface{} {
+	if database == "" {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{"db": database}
+}
+
+// boltParameters converts query parameters to the types PackStream can encode by
+// making a round trip through JSON, so parameters behave exactly as they do
+// with the REST API.
+func boltParameters(params map[string]interface{}) (map[string]interface{}, error) {
+	if len(params) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	return boltNumbers(m).(map[string]interface{}), nil
+}
+
+func boltNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		for i := range x {
+			x[i] = boltNumbers(x[i])
+		}
+	case map[string]interface{}:
+		for k := range x {
+			x[k] = boltNumbers(x[k])
+		}
+	}
+	return v
+}
+
+// unmarshalBoltRows decodes rows into v, which must be a pointer to a slice of
+// structs, matching columns to `json` tags as neoism.CypherQuery.Unmarshal does.
+func unmarshalBoltRows(columns []string, rows [][]interface{}, v interface{}) error {
+	rs, err := boltRecords(columns, rows)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func boltRecords(columns []string, rows [][]interface{}) ([]map[string]interface{}, error) {
+	rs := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		m := make(map[string]interface{}, len(columns))
+		for j, value := range row {
+			if j >= len(columns) {
+				break
+			}
+			hv, err := boltValue(value)
+			if err != nil {
+				return nil, err
+			}
+			m[columns[j]] = hv
+		}
+		rs[i] = m
+	}
+	return rs, nil
+}
+
+// boltValue converts a value received over Bolt to the representation the
+// transactional REST endpoint uses: entities become their property maps, paths
+// become lists of alternating node and relationship properties, and temporal
+// values become ISO-8601 strings.
+func boltValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case []byte:
+		l := make([]interface{}, len(x))
+		for i, b := range x {
+			l[i] = int64(int8(b))
+		}
+		return l, nil
+	case []interface{}:
+		l := make([]interface{}, len(x))
+		for i, e := range x {
+			hv, err := boltValue(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = hv
+		}
+		return l, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			hv, err := boltValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = hv
+		}
+		return m, nil
+	case *packStreamStruct:
+		return boltStructValue(x)
+	}
+	return v, nil
+}
+
+func boltStructValue(s *packStreamStruct) (interface{}, error) {
+	f := s.Fields
+	need := func(n int) error {
+		if len(f) < n {
+			return fmt.Errorf("bolt: structure 0x%02X has %d fields, expected %d", s.Tag, len(f), n)
+		}
+		return nil
+	}
+	ints := func(idx ...int) ([]int64, error) {
+		out := make([]int64, len(idx))
+		for i, n := range idx {
+			v, ok := f[n].(int64)
+			if !ok {
+				return nil, fmt.Errorf("bolt: structure 0x%02X field %d is %T, expected an integer", s.Tag, n, f[n])
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+
+	switch s.Tag {
+	case 'N': // node: id, labels, properties
+		if err := need(3); err != nil {
+			return nil, err
+		}
+		return boltValue(f[2])
+	case 'R': // relationship: id, start id, end id, type, properties
+		if err := need(5); err != nil {
+			return nil, err
+		}
+		return boltValue(f[4])
+	case 'r': // unbound relationship: id, type, properties
+		if err := need(3); err != nil {
+			return nil, err
+		}
+		return boltValue(f[2])
+	case 'P': // path: nodes, relationships, sequence
+		if err := need(3); err != nil {
+			return nil, err
+		}
+		return boltPath(f[0], f[1], f[2])
+	case 'D': // date: days since epoch
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		v, err := ints(0)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(v[0]*86400, 0).UTC().Format("2006-01-02"), nil
+	case 'T': // time: nanoseconds since midnight, offset seconds
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		v, err := ints(0, 1)
+		if err != nil {
+			return nil, err
+		}
+		t := inLocation(time.Unix(0, v[0]), time.FixedZone("", int(v[1])))
+		return t.Format("15:04:05.999999999Z07:00"), nil
+	case 't': // local time: nanoseconds since midnight
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		v, err := ints(0)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(0, v[0]).UTC().Format("15:04:05.999999999"), nil
+	case 'd': // local date time: seconds, nanoseconds
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		v, err := ints(0, 1)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(v[0], v[1]).UTC().Format("2006-01-02T15:04:05.999999999"), nil
+	case 'F': // date time: local seconds, nanoseconds, offset seconds
+		if err := need(3); err != nil {
+			return nil, err
+		}
+		v, err := ints(0, 1, 2)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Unix(v[0]-v[2], v[1]).In(time.FixedZone("", int(v[2])))
+		return t.Format(time.RFC3339Nano), nil
+	case 'f': // date time: local seconds, nanoseconds, zone id
+		if err := need(3); err != nil {
+			return nil, err
+		}
+		v, err := ints(0, 1)
+		if err != nil {
+			return nil, err
+		}
+		zone, _ := f[2].(string)
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, err
+		}
+		t := inLocation(time.Unix(v[0], v[1]), loc)
+		return t.Format(time.RFC3339Nano) + "[" + zone + "]", nil
+	case 'E': // duration: months, days, seconds, nanoseconds
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		v, err := ints(0, 1, 2, 3)
+		if err != nil {
+			return nil, err
+		}
+		secs := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%d.%09d", v[2], v[3]), "0"), ".")
+		return fmt.Sprintf("P%dM%dDT%sS", v[0], v[1], secs), nil
+	case 'X', 'Y': // point: srid, x, y[, z]
+		n := 3
+		if s.Tag == 'Y' {
+			n = 4
+		}
+		if err := need(n); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"type":        "Point",
+			"coordinates": f[1:n],
+			"crs":         map[string]interface{}{"srid": f[0]},
+		}, nil
+	}
+	return nil, fmt.Errorf("bolt: unsupported structure 0x%02X in result", s.Tag)
+}
+
+// inLocation reinterprets the UTC wall clock time of t as a time in loc.
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	w := t.UTC()
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), loc)
+}
+
+func boltPath(nodesValue, relsValue, seqValue interface{}) (interface{}, error) {
+	nodes, _ := nodesValue.([]interface{})
+	rels, _ := relsValue.([]interface{})
+	seq, _ := seqValue.([]interface{})
+	if len(nodes) == 0 || len(seq)%2 != 0 {
+		return nil, fmt.Errorf("bolt: malformed path")
+	}
+
+	path := []interface{}{nodes[0]}
+	for i := 0; i < len(seq); i += 2 {
+		ri, _ := seq[i].(int64)
+		ni, _ := seq[i+1].(int64)
+		ri = int64(math.Abs(float64(ri))) - 1
+		if ri < 0 || ri >= int64(len(rels)) || ni < 0 || ni >= int64(len(nodes)) {
+			return nil, fmt.Errorf("bolt: malformed path")
+		}
+		path = append(path, rels[ri], nodes[ni])
+	}
+	return boltValue(path)
+}
+
+// boltIndexManager implements IndexManager using schema commands, so that
+// EnsureIndexes and EnsureConstraints work over Bolt.
+type boltIndexManager struct {
+	pool     *boltPool
+	database string
+}
+
+func (im *boltIndexManager) query(statement string) ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	err := im.pool.withConn(context.Background(), func(c *boltConn) error {
+		columns, rows, err := c.run(statement, nil, boltTxMetadata(im.database))
+		if err != nil {
+			return err
+		}
+		records, err = boltRecords(columns, rows)
+		return err
+	})
+	return records, err
+}
+
+func (im *boltIndexManager) exec(statement func(c *boltConn) string) error {
+	return im.pool.withConn(context.Background(), func(c *boltConn) error {
+		_, _, err := c.run(statement(c), nil, boltTxMetadata(im.database))
+		return err
+	})
+}
+
+func (im *boltIndexManager) CreateIndex(label string, propertyName string) (*neoism.Index, error) {
+	err := im.exec(func(*boltConn) string {
+		return fmt.Sprintf("CREATE INDEX FOR (n:%s) ON (n.%s)", cypherName(label), cypherName(propertyName))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &neoism.Index{Label: label, PropertyKeys: []string{propertyName}}, nil
+}
+
+// Indexes lists the single label property indexes for a label, or all of them if label is blank.
+func (im *boltIndexManager) Indexes(label string) ([]*neoism.Index, error) {
+	records, err := im.query("SHOW INDEXES")
+	if err != nil {
+		return nil, err
+	}
+	var indexes []*neoism.Index
+	for _, r := range records {
+		if r["entityType"] != "NODE" || r["type"] == "FULLTEXT" || r["type"] == "LOOKUP" {
+			continue
+		}
+		labels := stringList(r["labelsOrTypes"])
+		if len(labels) != 1 || (label != "" && labels[0] != label) {
+			continue
+		}
+		indexes = append(indexes, &neoism.Index{Label: labels[0], PropertyKeys: stringList(r["properties"])})
+	}
+	return indexes, nil
+}
+
+func (im *boltIndexManager) CreateUniqueConstraint(label string, propertyName string) (*neoism.UniqueConstraint, error) {
+	err := im.exec(func(c *boltConn) string {
+		if major, minor := c.serverVersion(); major > 4 || (major == 4 && minor >= 4) {
+			return fmt.Sprintf("CREATE CONSTRAINT FOR (n:%s) REQUIRE n.%s IS UNIQUE", cypherName(label), cypherName(propertyName))
+		}
+		return fmt.Sprintf("CREATE CONSTRAINT ON (n:%s) ASSERT n.%s IS UNIQUE", cypherName(label), cypherName(propertyName))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &neoism.UniqueConstraint{Label: label, Type: "UNIQUENESS", PropertyKeys: []string{propertyName}}, nil
+}
+
+// UniqueConstraints returns neoism.NotFound when there is no matching
+// constraint, as the REST API does.
+func (im *boltIndexManager) UniqueConstraints(label string, propertyName string) ([]*neoism.UniqueConstraint, error) {
+	records, err := im.query("SHOW CONSTRAINTS")
+	if err != nil {
+		return nil, err
+	}
+	var constraints []*neoism.UniqueConstraint
+	for _, r := range records {
+		if r["entityType"] != "NODE" || (r["type"] != "UNIQUENESS" && r["type"] != "NODE_PROPERTY_UNIQUENESS") {
+			continue
+		}
+		labels := stringList(r["labelsOrTypes"])
+		properties := stringList(r["properties"])
+		if len(labels) != 1 || labels[0] != label {
+			continue
+		}
+		if propertyName != "" && (len(properties) != 1 || properties[0] != propertyName) {
+			continue
+		}
+		constraints = append(constraints, &neoism.UniqueConstraint{Label: label, Type: "UNIQUENESS", PropertyKeys: properties})
+	}
+	if len(constraints) == 0 {
+		return nil, neoism.NotFound
+	}
+	return constraints, nil
+}
+
+var _ IndexManager = (*boltIndexManager)(nil)
+
+// cypherName quotes a label or property name for use in a statement.
+func cypherName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func stringList(v interface{}) []string {
+	l, _ := v.([]interface{})
+	out := make([]string, 0, len(l))
+	for _, e := range l {
+		if s, ok := e.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -1,9 +1,11 @@
 package neoutils
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"time"
 
@@ -17,15 +19,45 @@ type ConnectionConfig struct {
 	// CypherQuery into a single batch. BatchSize 0 disables this behaviour.
 	// Values >0 indicate the largest preferred batch size.  Actual sizes
 	// may be larger because values from a single call will never be split.
+	// BatchOptions can also limit batches by size.
 	BatchSize int
 	// Transactional indicates that the connection should use the
-	// transactional endpoints in the neo4j REST API.
+	// transactional endpoints in the neo4j REST API. Bolt connections are
+	// always transactional.
 	Transactional bool
-	// Optionally a custom http.Client can be supplied
+	// Optionally a custom http.Client can be supplied. It is not used for
+	// Bolt connections.
 	HTTPClient *http.Client
 	// BackgroundConnect indicates that NeoConnection should be available when
 	// neo4j is not available, and will connect and re-connect as required.
 	BackgroundConnect bool
+	// FailoverURLs are tried in turn when the URL given to Connect can't be
+	// reached. Once one works it is tried first from then on. URLs are not
+	// health checked, so a connection only moves to another URL after it
+	// has to reconnect, and doesn't move back when an earlier one recovers.
+	FailoverURLs []string
+	// BatchOptions tunes batching when BatchSize is >0.
+	BatchOptions BatchOptions
+	// ReconnectPolicy controls the delay between attempts to connect when
+	// BackgroundConnect is set, and whether to eventually give up.
+	ReconnectPolicy ReconnectPolicy
+	// RetryPolicy controls retrying batches that fail with transient errors.
+	// The zero value, the default, disables retries. A batch is only safe to
+	// retry if running its queries twice is harmless, as a commit that
+	// succeeded can still be reported as failed.
+	RetryPolicy RetryPolicy
+	// SchemaOptions controls how indexes and constraints are applied.
+	SchemaOptions SchemaOptions
+	// Database selects the database to use on Neo4j 4 and later, for
+	// queries, schema and health checks. Blank means the server's default
+	// database. Over HTTP it needs Transactional.
+	Database string
+	// IOTimeout limits how long a Bolt connection waits to send a message
+	// to the server or for the next part of its answer, so that a server
+	// that has gone away without closing the connection is noticed. 0 means
+	// 5 minutes, and a negative value means no limit. HTTP connections use
+	// HTTPClient's timeout instead.
+	IOTimeout time.Duration
 }
 
 func DefaultConnectionConfig() *ConnectionConfig {
@@ -48,6 +80,7 @@ func DefaultConnectionConfig() *ConnectionConfig {
 			Timeout: 60 * time.Second,
 		},
 		BackgroundConnect: true,
+		ReconnectPolicy:   DefaultReconnectPolicy(),
 	}
 }
 
@@ -55,6 +88,7 @@ func DefaultConnectionConfig() *ConnectionConfig {
 //neoURL - the path to Neo4j,
 //conf - the configuration required for logging to Neo4j,
 //log - an optional parameter for logging messages. If not provided, we initialize an object of the type go-logger v2
+//A URL whose host is a DNS SRV name, such as bolt://_neo4j._tcp.example.com, is tried at each target of the name.
 func Connect(neoURL string, conf *ConnectionConfig, log *logger.UPPLogger) (NeoConnection, error) {
 	if log == nil {
 		log = logger.NewUPPInfoLogger("neo-utils-go")
@@ -64,12 +98,17 @@ func Connect(neoURL string, conf *ConnectionConfig, log *logger.UPPLogger) (NeoC
 		conf = DefaultConnectionConfig()
 	}
 
+	eps := newEndpoints(append([]string{neoURL}, conf.FailoverURLs...), log)
+	connect := func(u string) (NeoConnection, error) {
+		return connectDefault(u, conf, log)
+	}
+
 	if !conf.BackgroundConnect {
-		return connectDefault(neoURL, conf, log)
+		return eps.connect(connect)
 	} else {
 		trying := make(chan struct{}, 1)
 		f := func() (NeoConnection, error) {
-			conn, err := connectDefault(neoURL, conf, log)
+			conn, err := eps.connect(connect)
 			select {
 			case trying <- struct{}{}:
 			default:
@@ -77,13 +116,16 @@ func Connect(neoURL string, conf *ConnectionConfig, log *logger.UPPLogger) (NeoC
 			return conn, err
 		}
 		defer func() { <-trying }()
-		return connectAuto(neoURL, f, 30*time.Second, log)
+		return connectAuto(neoURL, f, conf.ReconnectPolicy, log)
 	}
 }
 
 func connectDefault(neoURL string, conf *ConnectionConfig, log *logger.UPPLogger) (NeoConnection, error) {
+	if IsBoltURL(neoURL) {
+		return connectBolt(neoURL, conf, log)
+	}
 
-	db, err := neoism.Connect(neoURL)
+	db, err := discoverREST(neoURL, conf.Database)
 	if err != nil {
 		return nil, err
 	}
@@ -98,28 +140,128 @@ func connectDefault(neoURL string, conf *ConnectionConfig, log *logger.UPPLogger
 		db.Session.Header.Set("User-Agent", exeFile+" (using neoutils)")
 	}
 
+	return restConnection(neoURL, db, conf.Database, conf, log)
+}
+
+// discoverREST reads the REST API's discovery document. Named databases need
+// Neo4j 4 or later, which doesn't serve the /db/data/ service root that
+// neoism.Connect falls back to, so for them the server root is read instead,
+// whatever the path of neoURL.
+func discoverREST(neoURL string, database string) (*neoism.Database, error) {
+	if database == "" {
+		return neoism.Connect(neoURL)
+	}
+	u, err := url.Parse(neoURL)
+	if err != nil {
+		return nil, err
+	}
+	root := url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: "/"}
+	return neoism.Connect(root.String())
+}
+
+// restConnection returns a connection to database that uses db, which may be
+// shared with connections to other databases.
+func restConnection(neoURL string, db *neoism.Database, database string, conf *ConnectionConfig, log *logger.UPPLogger) (*DefaultNeoConnection, error) {
 	var cr CypherRunner = db
 	if conf.Transactional {
-		cr = TransactionalCypherRunner{db}
-	} else {
-		cr = db
+		cr = TransactionalCypherRunner{DB: db, Database: database}
+	} else if database != "" {
+		return nil, fmt.Errorf("cannot use database %s without a transactional connection", database)
 	}
+	cr = configureRunner(cr, conf)
 
-	if conf.BatchSize > 0 {
-		cr = NewBatchCypherRunner(cr, conf.BatchSize)
+	// the REST schema endpoints only know the default database
+	var im IndexManager = db
+	if database != "" {
+		im = nil
+	}
+	ie := newDefaultIndexEnsurer(im, TransactionalCypherRunner{DB: db, Database: database}, db.Version, conf.SchemaOptions, log)
+
+	return &DefaultNeoConnection{
+		dbURL:    neoURL,
+		database: database,
+		cr:       cr,
+		ie:       ie,
+		db:       db,
+		withDatabase: func(name string) (NeoConnection, error) {
+			return restConnection(neoURL, db, name, conf, log)
+		},
+	}, nil
+}
+
+// connectBolt connects using the Bolt protocol. Bolt connections are always
+// transactional, and the neo4j:// schemes connect directly to the given
+// server without client side routing.
+func connectBolt(neoURL string, conf *ConnectionConfig, log *logger.UPPLogger) (NeoConnection, error) {
+	userAgent := "neoutils"
+	exeName, err := osutil.Executable()
+	if err == nil {
+		_, exeFile := filepath.Split(exeName)
+		userAgent = exeFile + " (using neoutils)"
+	}
+
+	dialer, err := newBoltDialer(neoURL, userAgent)
+	if err != nil {
+		return nil, err
 	}
+	if conf.IOTimeout != 0 {
+		dialer.ioTimeout = conf.IOTimeout
+	}
+	pool := newBoltPool(dialer, 100)
 
-	ie := &defaultIndexEnsurer{db, log}
+	// fail early if the server can't be reached, as neoism.Connect does
+	var server string
+	err = pool.withConn(context.Background(), func(c *boltConn) error {
+		server = c.server
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return &DefaultNeoConnection{neoURL, cr, ie, db}, nil
+	return boltConnection(neoURL, pool, server, conf.Database, false, conf, log), nil
+}
+
+// boltConnection returns a connection to database that uses pool. Only the
+// connection that isn't shared closes the pool.
+func boltConnection(neoURL string, pool *boltPool, server string, database string, shared bool, conf *ConnectionConfig, log *logger.UPPLogger) *DefaultNeoConnection {
+	runner := &BoltCypherRunner{url: neoURL, pool: pool, database: database, shared: shared}
+	cr := configureRunner(runner, conf)
+
+	ie := newDefaultIndexEnsurer(&boltIndexManager{pool: pool, database: database}, runner, server, conf.SchemaOptions, log)
+
+	return &DefaultNeoConnection{
+		dbURL:    neoURL,
+		database: database,
+		cr:       cr,
+		ie:       ie,
+		withDatabase: func(name string) (NeoConnection, error) {
+			return boltConnection(neoURL, pool, server, name, true, conf, log), nil
+		},
+	}
+}
+
+// configureRunner adds retries and batching to cr as configured. Retries go
+// underneath batching so that each batch is retried as a whole.
+func configureRunner(cr CypherRunner, conf *ConnectionConfig) CypherRunner {
+	if conf.RetryPolicy.MaxAttempts > 1 {
+		cr = NewRetryingCypherRunner(cr, conf.RetryPolicy)
+	}
+	if conf.BatchSize > 0 {
+		cr = NewBatchCypherRunnerWithOptions(cr, conf.BatchSize, conf.BatchOptions)
+	}
+	return cr
 }
 
 type DefaultNeoConnection struct {
-	dbURL string
-	cr    CypherRunner
-	ie    IndexEnsurer
+	dbURL    string
+	database string
+	cr       CypherRunner
+	ie       IndexEnsurer
 
 	db *neoism.Database
+
+	withDatabase func(name string) (NeoConnection, error)
 }
 
 func (c *DefaultNeoConnection) CypherBatch(cypher []*neoism.CypherQuery) error {
@@ -127,6 +269,56 @@ func (c *DefaultNeoConnection) CypherBatch(cypher []*neoism.CypherQuery) error {
 
 }
 
+func (c *DefaultNeoConnection) CypherBatchContext(ctx context.Context, cypher []*neoism.CypherQuery) error {
+	return cypherBatchContext(ctx, c.cr, cypher)
+}
+
+func (c *DefaultNeoConnection) ReadCypherBatch(cypher []*neoism.CypherQuery) error {
+	return c.ReadCypherBatchContext(context.Background(), cypher)
+}
+
+// ReadCypherBatchContext runs read-only queries without batching them, in a
+// read transaction over Bolt.
+func (c *DefaultNeoConnection) ReadCypherBatchContext(ctx context.Context, cypher []*neoism.CypherQuery) error {
+	return readCypherBatchContext(ctx, c.cr, cypher)
+}
+
+// WithDatabase returns a connection to another database on the same server,
+// which shares this connection's HTTP client or Bolt connections. Closing it
+// only waits for its queued queries, while closing this connection closes
+// both.
+func (c *DefaultNeoConnection) WithDatabase(name string) (NeoConnection, error) {
+	return c.withDatabase(name)
+}
+
+// TrySubmit runs the queries, failing with ErrQueueFull rather than waiting
+// if the batch queue is full.
+func (c *DefaultNeoConnection) TrySubmit(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return trySubmit(ctx, c.cr, queries)
+}
+
+func (c *DefaultNeoConnection) Submit(queries []*neoism.CypherQuery) *Future {
+	return c.SubmitContext(context.Background(), queries)
+}
+
+// SubmitContext queues the queries without waiting for them to be written.
+// Without batching, they are written in a new goroutine.
+func (c *DefaultNeoConnection) SubmitContext(ctx context.Context, queries []*neoism.CypherQuery) *Future {
+	return submit(ctx, c.cr, queries)
+}
+
+// BeginTx begins an explicit transaction, which needs a transactional or
+// Bolt connection.
+func (c *DefaultNeoConnection) BeginTx(ctx context.Context) (Tx, error) {
+	return beginTx(ctx, c.cr)
+}
+
+// Close waits, until ctx is done, for queued queries to be written and then
+// releases the connection's resources.
+func (c *DefaultNeoConnection) Close(ctx context.Context) error {
+	return closeRunner(ctx, c.cr)
+}
+
 func (c *DefaultNeoConnection) EnsureConstraints(constraints map[string]string) error {
 	return c.ie.EnsureConstraints(constraints)
 }
@@ -135,21 +327,161 @@ func (c *DefaultNeoConnection) EnsureIndexes(indexes map[string]string) error {
 	return c.ie.EnsureIndexes(indexes)
 }
 
+// EnsureSchema creates the constraints and indexes that don't exist yet, see
+// the EnsureSchema function.
+func (c *DefaultNeoConnection) EnsureSchema(constraints []SchemaConstraint, indexes []SchemaIndex) error {
+	se, ok := c.ie.(SchemaEnsurer)
+	if !ok {
+		return fmt.Errorf("%v cannot manage schema", c)
+	}
+	return se.EnsureSchema(constraints, indexes)
+}
+
+// DiffSchema compares the declared constraints and indexes with the
+// database's, see the DiffSchema function.
+func (c *DefaultNeoConnection) DiffSchema(constraints []SchemaConstraint, indexes []SchemaIndex) (*SchemaDiff, error) {
+	sd, ok := c.ie.(SchemaDiffer)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot manage schema", c)
+	}
+	return sd.DiffSchema(constraints, indexes)
+}
+
+// PruneSchema drops the extra indexes and constraints of diff, see the
+// PruneSchema function.
+func (c *DefaultNeoConnection) PruneSchema(diff *SchemaDiff) error {
+	sd, ok := c.ie.(SchemaDiffer)
+	if !ok {
+		return fmt.Errorf("%v cannot manage schema", c)
+	}
+	return sd.PruneSchema(diff)
+}
+
+func (c *DefaultNeoConnection) unbatched() CypherRunner {
+	return unbatched(c.cr)
+}
+
+func (c *DefaultNeoConnection) address() string {
+	return urlHost(c.dbURL)
+}
+
 func (c *DefaultNeoConnection) String() string {
+	if c.database != "" {
+		return fmt.Sprintf("DefaultNeoConnection(%s, %s)", c.dbURL, c.database)
+	}
 	return fmt.Sprintf("DefaultNeoConnection(%s)", c.dbURL)
 }
 
 var _ NeoConnection = (*DefaultNeoConnection)(nil) //{}
+var _ ContextCypherRunner = (*DefaultNeoConnection)(nil)
+var _ ReadCypherRunner = (*DefaultNeoConnection)(nil)
+var _ TxBeginner = (*DefaultNeoConnection)(nil)
+var _ Closer = (*DefaultNeoConnection)(nil)
+var _ SchemaEnsurer = (*DefaultNeoConnection)(nil)
+var _ SchemaDiffer = (*DefaultNeoConnection)(nil)
+var _ DatabaseConnector = (*DefaultNeoConnection)(nil)
+
+// ensureSchemaLockName names the lock taken by connections applying schema,
+// which is shared by every service using the database.
+const ensureSchemaLockName = "neoutils.ensure-schema"
 
 type defaultIndexEnsurer struct {
-	db  *neoism.Database
-	log *logger.UPPLogger
+	// im is nil when it can't reach the database, and sm is used instead
+	im   IndexManager
+	sm   SchemaManager
+	lock *schemaLock
+	opts SchemaOptions
+	log  *logger.UPPLogger
+}
+
+// newDefaultIndexEnsurer runs schema commands and takes the schema lock with
+// cr, which must not batch queries.
+func newDefaultIndexEnsurer(im IndexManager, cr CypherRunner, serverVersion string, opts SchemaOptions, log *logger.UPPLogger) *defaultIndexEnsurer {
+	return &defaultIndexEnsurer{
+		im:   im,
+		sm:   NewCypherSchemaManager(cr, serverVersion),
+		lock: newSchemaLock(cr, ensureSchemaLockName),
+		opts: opts,
+		log:  log,
+	}
 }
 
 func (ie *defaultIndexEnsurer) EnsureIndexes(indexes map[string]string) error {
-	return EnsureIndexes(ie.db, indexes, ie.log)
+	err := ie.withLock(nil, IndexesFromMap(indexes), func(held context.Context) error {
+		if ie.im == nil {
+			return EnsureSchema(leasedSchemaManager{ie.sm, held}, nil, IndexesFromMap(indexes), ie.log)
+		}
+		return EnsureIndexes(leasedIndexManager{ie.im, held}, indexes, ie.log)
+	})
+	if err != nil {
+		return err
+	}
+	return ie.waitForIndexes(IndexesFromMap(indexes))
 }
 
 func (ie *defaultIndexEnsurer) EnsureConstraints(constraints map[string]string) error {
-	return EnsureConstraints(ie.db, constraints, ie.log)
+	return ie.withLock(ConstraintsFromMap(constraints), nil, func(held context.Context) error {
+		if ie.im == nil {
+			return EnsureSchema(leasedSchemaManager{ie.sm, held}, ConstraintsFromMap(constraints), nil, ie.log)
+		}
+		return EnsureConstraints(leasedIndexManager{ie.im, held}, constraints, ie.log)
+	})
+}
+
+func (ie *defaultIndexEnsurer) EnsureSchema(constraints []SchemaConstraint, indexes []SchemaIndex) error {
+	err := ie.withLock(constraints, indexes, func(held context.Context) error {
+		return EnsureSchema(leasedSchemaManager{ie.sm, held}, constraints, indexes, ie.log)
+	})
+	if err != nil {
+		return err
+	}
+	return ie.waitForIndexes(indexes)
+}
+
+// withLock runs apply holding the schema lock if configured to. The lock is
+// only taken if some of the constraints or indexes are missing, so instances
+// that find the schema in place don't queue up behind each other. apply is
+// passed a context that is cancelled if the lease is lost, and must stop
+// changing the schema then; the error says the lock was lost.
+func (ie *defaultIndexEnsurer) withLock(constraints []SchemaConstraint, indexes []SchemaIndex, apply func(held context.Context) error) error {
+	if !ie.opts.Lock {
+		return apply(context.Background())
+	}
+	if d, err := DiffSchema(ie.sm, constraints, indexes); err == nil && len(d.MissingConstraints) == 0 && len(d.MissingIndexes) == 0 &&
+		len(d.MismatchedConstraints) == 0 && len(d.MismatchedIndexes) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ie.opts.lockTimeout())
+	defer cancel()
+	if err := ie.lock.wait(ctx); err != nil {
+		return fmt.Errorf("cannot acquire schema lock: %w", err)
+	}
+	// the lease is renewed for as long as apply takes, whatever the timeout
+	held, release := ie.lock.hold(context.Background())
+	err := apply(held)
+	lost := held.Err() != nil
+	if releaseErr := release(); err == nil || lost {
+		// a lost lease is reported by release, and is why apply failed
+		err = releaseErr
+	}
+	return err
+}
+
+// waitForIndexes waits for indexes to be ONLINE if configured to.
+func (ie *defaultIndexEnsurer) waitForIndexes(indexes []SchemaIndex) error {
+	if !ie.opts.WaitForIndexes || len(indexes) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ie.opts.indexTimeout())
+	defer cancel()
+	return WaitForIndexes(ctx, ie.sm, indexes, ie.opts.indexPollInterval(), ie.log)
+}
+
+func (ie *defaultIndexEnsurer) DiffSchema(constraints []SchemaConstraint, indexes []SchemaIndex) (*SchemaDiff, error) {
+	return DiffSchema(ie.sm, constraints, indexes)
+}
+
+func (ie *defaultIndexEnsurer) PruneSchema(diff *SchemaDiff) error {
+	return PruneSchema(ie.sm, diff, ie.log)
 }
@@ -9,6 +9,9 @@ func UnderlyingDB(con NeoConnection) *neoism.Database {
 
 	switch c := con.(type) {
 	case *DefaultNeoConnection:
+		if c.db == nil {
+			panic("NeoConnection is not backed by a neoism.Database")
+		}
 		return c.db
 	default:
 		panic("unhandled NeoConnection type")
@@ -0,0 +1,97 @@
+package neoutils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ConnectionState is the state of a connection made in the background.
+type ConnectionState int
+
+const (
+	// Connecting means an attempt to (re)connect is in progress.
+	Connecting ConnectionState = iota
+	// Connected means the connection is usable and all requested indexes and
+	// constraints have been applied.
+	Connected
+	// Disconnected means the last attempt to connect failed, or that the
+	// connection has given up or been closed.
+	Disconnected
+	// SchemaFailed means a connection was made but applying indexes or
+	// constraints to it failed. The connection will be retried.
+	SchemaFailed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connecting:
+		return "Connecting"
+	case Connected:
+		return "Connected"
+	case Disconnected:
+		return "Disconnected"
+	case SchemaFailed:
+		return "SchemaFailed"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// connectionState tracks the current ConnectionState and tells subscribers
+// about transitions.
+type connectionState struct {
+	lk          sync.Mutex
+	state       ConnectionState
+	err         error
+	changed     chan struct{}
+	subscribers map[int]func(ConnectionState, error)
+	nextID      int
+}
+
+func newConnectionState() *connectionState {
+	return &connectionState{
+		state:       Connecting,
+		changed:     make(chan struct{}),
+		subscribers: map[int]func(ConnectionState, error){},
+	}
+}
+
+func (s *connectionState) get() (ConnectionState, error, <-chan struct{}) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.state, s.err, s.changed
+}
+
+// set records a new state and the error that caused it, if any. Subscribers
+// are only called when the state changes, outside the lock so they may query
+// the connection.
+func (s *connectionState) set(state ConnectionState, err error) {
+	s.lk.Lock()
+	old := s.state
+	s.state, s.err = state, err
+	close(s.changed)
+	s.changed = make(chan struct{})
+	var subscribers []func(ConnectionState, error)
+	if old != state {
+		for _, f := range s.subscribers {
+			subscribers = append(subscribers, f)
+		}
+	}
+	s.lk.Unlock()
+
+	for _, f := range subscribers {
+		f(state, err)
+	}
+}
+
+func (s *connectionState) subscribe(f func(ConnectionState, error)) func() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.subscribers[id] = f
+	return func() {
+		s.lk.Lock()
+		defer s.lk.Unlock()
+		delete(s.subscribers, id)
+	}
+}
@@ -0,0 +1,401 @@
+package neoutils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// cypherSchemaManager implements SchemaManager with Cypher schema commands,
+// using the syntax of the server's version.
+type cypherSchemaManager struct {
+	cr    CypherRunner
+	major int
+	minor int
+}
+
+// NewCypherSchemaManager returns a SchemaManager that runs schema commands
+// with cr, which must not batch them with other queries. serverVersion
+// selects the syntax to use, e.g. "3.5.12" or "Neo4j/4.4.3". Neo4j 3.5 and
+// 4.2 onwards are supported.
+func NewCypherSchemaManager(cr CypherRunner, serverVersion string) SchemaManager {
+	major, minor := parseServerVersion(serverVersion)
+	return &cypherSchemaManager{cr, major, minor}
+}
+
+// parseServerVersion parses versions such as "3.5.12" or the Bolt server agent "Neo4j/4.4.12".
+func parseServerVersion(v string) (major, minor int) {
+	if i := strings.IndexByte(v, '/'); i >= 0 {
+		v = v[i+1:]
+	}
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) >= 2 {
+		major, _ = strconv.Atoi(parts[0])
+		minor, _ = strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	}
+	return major, minor
+}
+
+func (sm *cypherSchemaManager) atLeast(major, minor int) bool {
+	return sm.major > major || (sm.major == major && sm.minor >= minor)
+}
+
+// schemaRecord holds the columns of SHOW INDEXES and SHOW CONSTRAINTS, and of
+// db.indexes() and db.constraints() in Neo4j 3.x.
+type schemaRecord struct {
+	Name             string      `json:"name"`
+	IndexName        string      `json:"indexName"`
+	Type             string      `json:"type"`
+	EntityType       string      `json:"entityType"`
+	LabelsOrTypes    []string    `json:"labelsOrTypes"`
+	TokenNames       []string    `json:"tokenNames"`
+	Properties       []string    `json:"properties"`
+	Uniqueness       string      `json:"uniqueness"`
+	OwningConstraint interface{} `json:"owningConstraint"`
+	Description      string      `json:"description"`
+	State            string      `json:"state"`
+	// PopulationPercent is called progress in Neo4j 3.x
+	PopulationPercent float64 `json:"populationPercent"`
+	Progress          float64 `json:"progress"`
+	FailureMessage    string  `json:"failureMessage"`
+}
+
+func (sm *cypherSchemaManager) records(statement string) ([]schemaRecord, error) {
+	var records []schemaRecord
+	err := sm.cr.CypherBatch([]*neoism.CypherQuery{{Statement: statement, Result: &records}})
+	return records, err
+}
+
+func (sm *cypherSchemaManager) SchemaIndexes() ([]SchemaIndex, error) {
+	statuses, err := sm.SchemaIndexStatuses()
+	if err != nil {
+		return nil, err
+	}
+	var indexes []SchemaIndex
+	for _, s := range statuses {
+		indexes = append(indexes, s.SchemaIndex)
+	}
+	return indexes, nil
+}
+
+func (sm *cypherSchemaManager) SchemaIndexStatuses() ([]SchemaIndexStatus, error) {
+	if sm.major < 4 {
+		return sm.legacyIndexStatuses()
+	}
+	records, err := sm.records("SHOW INDEXES")
+	if err != nil {
+		return nil, err
+	}
+	var statuses []SchemaIndexStatus
+	for _, r := range records {
+		// indexes backing constraints are reported as uniqueness UNIQUE
+		// before Neo4j 5, and with their owning constraint after
+		if r.Type == "LOOKUP" || r.Uniqueness == "UNIQUE" || r.OwningConstraint != nil || len(r.LabelsOrTypes) != 1 {
+			continue
+		}
+		i := SchemaIndex{Name: r.Name, Properties: r.Properties}
+		switch r.Type {
+		case "BTREE", "RANGE":
+			i.Type = RangeIndex
+		default:
+			i.Type = IndexType(strings.ToLower(r.Type))
+		}
+		if r.EntityType == "RELATIONSHIP" {
+			i.RelationshipType = r.LabelsOrTypes[0]
+		} else {
+			i.Label = r.LabelsOrTypes[0]
+		}
+		statuses = append(statuses, SchemaIndexStatus{i, IndexState(strings.ToUpper(r.State)), r.PopulationPercent, r.FailureMessage})
+	}
+	return statuses, nil
+}
+
+func (sm *cypherSchemaManager) legacyIndexStatuses() ([]SchemaIndexStatus, error) {
+	records, err := sm.records("CALL db.indexes()")
+	if err != nil {
+		return nil, err
+	}
+	var statuses []SchemaIndexStatus
+	for _, r := range records {
+		if len(r.TokenNames) != 1 {
+			continue
+		}
+		i := SchemaIndex{Properties: r.Properties}
+		switch r.Type {
+		case "node_label_property":
+			i.Type, i.Label = RangeIndex, r.TokenNames[0]
+		case "node_fulltext":
+			i.Type, i.Label, i.Name = FullTextIndex, r.TokenNames[0], r.IndexName
+		case "relationship_fulltext":
+			i.Type, i.RelationshipType, i.Name = FullTextIndex, r.TokenNames[0], r.IndexName
+		default:
+			// node_unique_property indexes back constraints
+			continue
+		}
+		statuses = append(statuses, SchemaIndexStatus{i, IndexState(strings.ToUpper(r.State)), r.Progress, r.FailureMessage})
+	}
+	return statuses, nil
+}
+
+func (sm *cypherSchemaManager) SchemaConstraints() ([]SchemaConstraint, error) {
+	if sm.major < 4 {
+		return sm.legacyConstraints()
+	}
+	records, err := sm.records("SHOW CONSTRAINTS")
+	if err != nil {
+		return nil, err
+	}
+	var constraints []SchemaConstraint
+	for _, r := range records {
+		if len(r.LabelsOrTypes) != 1 {
+			continue
+		}
+		c := SchemaConstraint{Name: r.Name, Properties: r.Properties}
+		switch r.Type {
+		case "UNIQUENESS", "NODE_PROPERTY_UNIQUENESS":
+			c.Type = UniqueConstraint
+		case "NODE_PROPERTY_EXISTENCE", "RELATIONSHIP_PROPERTY_EXISTENCE":
+			c.Type = ExistenceConstraint
+		case "NODE_KEY":
+			c.Type = NodeKeyConstraint
+		default:
+			c.Type = ConstraintType(strings.ToLower(r.Type))
+		}
+		if r.EntityType == "RELATIONSHIP" {
+			c.RelationshipType = r.LabelsOrTypes[0]
+		} else {
+			c.Label = r.LabelsOrTypes[0]
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
+
+var (
+	legacyNodeConstraint = regexp.MustCompile(`^CONSTRAINT ON \(\s*(\S+):(\S+)\s*\) ASSERT (.+)$`)
+	legacyRelConstraint  = regexp.MustCompile(`^CONSTRAINT ON \(\s*\)-\[\s*(\S+):(\S+)\s*\]-\(\s*\) ASSERT (.+)$`)
+	legacyExists         = regexp.MustCompile(`^exists\((.+)\)$`)
+	legacyUnique         = regexp.MustCompile(`^(.+) IS UNIQUE$`)
+	legacyNodeKey        = regexp.MustCompile(`^\((.+)\) IS NODE KEY$`)
+)
+
+// legacyConstraints parses the descriptions returned by db.constraints() in
+// Neo4j 3.x, such as "CONSTRAINT ON ( person:Person ) ASSERT person.uuid IS UNIQUE".
+func (sm *cypherSchemaManager) legacyConstraints() ([]SchemaConstraint, error) {
+	records, err := sm.records("CALL db.constraints()")
+	if err != nil {
+		return nil, err
+	}
+	var constraints []SchemaConstraint
+	for _, r := range records {
+		var c SchemaConstraint
+		var variable, assertion string
+		if m := legacyNodeConstraint.FindStringSubmatch(r.Description); m != nil {
+			variable, c.Label, assertion = m[1], unquoteName(m[2]), m[3]
+		} else if m := legacyRelConstraint.FindStringSubmatch(r.Description); m != nil {
+			variable, c.RelationshipType, assertion = m[1], unquoteName(m[2]), m[3]
+		} else {
+			continue
+		}
+
+		var properties string
+		if m := legacyExists.FindStringSubmatch(assertion); m != nil {
+			c.Type, properties = ExistenceConstraint, m[1]
+		} else if m := legacyNodeKey.FindStringSubmatch(assertion); m != nil {
+			c.Type, properties = NodeKeyConstraint, m[1]
+		} else if m := legacyUnique.FindStringSubmatch(assertion); m != nil {
+			c.Type, properties = UniqueConstraint, m[1]
+		} else {
+			continue
+		}
+		for _, p := range strings.Split(properties, ",") {
+			p = strings.TrimPrefix(strings.TrimSpace(p), variable+".")
+			c.Properties = append(c.Properties, unquoteName(p))
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
+
+func unquoteName(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, "`") && strings.HasSuffix(name, "`") {
+		return strings.Replace(name[1:len(name)-1], "``", "`", -1)
+	}
+	return name
+}
+
+func (sm *cypherSchemaManager) CreateSchemaIndex(index SchemaIndex) error {
+	q, err := sm.createIndexQuery(index)
+	if err != nil {
+		return err
+	}
+	return sm.cr.CypherBatch([]*neoism.CypherQuery{q})
+}
+
+func (sm *cypherSchemaManager) createIndexQuery(i SchemaIndex) (*neoism.CypherQuery, error) {
+	if err := i.Validate(); err != nil {
+		return nil, err
+	}
+	properties := i.AllProperties()
+
+	if i.IndexType() == FullTextIndex {
+		if !sm.atLeast(4, 3) {
+			procedure := "db.index.fulltext.createNodeIndex"
+			token := i.Label
+			if i.RelationshipType != "" {
+				procedure, token = "db.index.fulltext.createRelationshipIndex", i.RelationshipType
+			}
+			return &neoism.CypherQuery{
+				Statement:  fmt.Sprintf("CALL %s($name, $tokens, $properties)", procedure),
+				Parameters: map[string]interface{}{"name": i.Name, "tokens": []string{token}, "properties": properties},
+			}, nil
+		}
+		return &neoism.CypherQuery{Statement: fmt.Sprintf("CREATE FULLTEXT INDEX %s FOR %s ON EACH [%s]",
+			cypherName(i.Name), entityPattern(i.Label, i.RelationshipType), propertyRefs(i.Label, properties))}, nil
+	}
+
+	if i.RelationshipType != "" && !sm.atLeast(4, 3) {
+		return nil, fmt.Errorf("%v needs Neo4j 4.3 or later", i)
+	}
+	if sm.major < 4 {
+		quoted := make([]string, len(properties))
+		for n, p := range properties {
+			quoted[n] = cypherName(p)
+		}
+		return &neoism.CypherQuery{Statement: fmt.Sprintf("CREATE INDEX ON :%s(%s)", cypherName(i.Label), strings.Join(quoted, ", "))}, nil
+	}
+	return &neoism.CypherQuery{Statement: fmt.Sprintf("CREATE INDEX %sFOR %s ON (%s)",
+		optionalName(i.Name), entityPattern(i.Label, i.RelationshipType), propertyRefs(i.Label, properties))}, nil
+}
+
+func (sm *cypherSchemaManager) CreateSchemaConstraint(constraint SchemaConstraint) error {
+	q, err := sm.createConstraintQuery(constraint)
+	if err != nil {
+		return err
+	}
+	return sm.cr.CypherBatch([]*neoism.CypherQuery{q})
+}
+
+func (sm *cypherSchemaManager) createConstraintQuery(c SchemaConstraint) (*neoism.CypherQuery, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	properties := c.AllProperties()
+	refs := propertyRefs(c.Label, properties)
+	if len(properties) > 1 {
+		refs = "(" + refs + ")"
+	}
+
+	var name, requirement string
+	if sm.major >= 4 {
+		name = optionalName(c.Name)
+	}
+	switch c.ConstraintType() {
+	case UniqueConstraint:
+		if len(properties) > 1 && !sm.atLeast(4, 4) {
+			return nil, fmt.Errorf("%v needs Neo4j 4.4 or later", c)
+		}
+		requirement = refs + " IS UNIQUE"
+	case NodeKeyConstraint:
+		requirement = "(" + propertyRefs(c.Label, properties) + ") IS NODE KEY"
+	case ExistenceConstraint:
+		if sm.atLeast(4, 4) {
+			requirement = refs + " IS NOT NULL"
+		} else {
+			requirement = "exists(" + refs + ")"
+		}
+	}
+
+	if sm.atLeast(4, 4) {
+		return &neoism.CypherQuery{Statement: fmt.Sprintf("CREATE CONSTRAINT %sFOR %s REQUIRE %s",
+			name, entityPattern(c.Label, c.RelationshipType), requirement)}, nil
+	}
+	return &neoism.CypherQuery{Statement: fmt.Sprintf("CREATE CONSTRAINT %sON %s ASSERT %s",
+		name, entityPattern(c.Label, c.RelationshipType), requirement)}, nil
+}
+
+func (sm *cypherSchemaManager) DropSchemaIndex(index SchemaIndex) error {
+	q, err := sm.dropIndexQuery(index)
+	if err != nil {
+		return err
+	}
+	return sm.cr.CypherBatch([]*neoism.CypherQuery{q})
+}
+
+func (sm *cypherSchemaManager) dropIndexQuery(i SchemaIndex) (*neoism.CypherQuery, error) {
+	if sm.major >= 4 {
+		if i.Name == "" {
+			return nil, fmt.Errorf("cannot drop unnamed %v", i)
+		}
+		return &neoism.CypherQuery{Statement: "DROP INDEX " + cypherName(i.Name)}, nil
+	}
+	if i.IndexType() == FullTextIndex {
+		return &neoism.CypherQuery{
+			Statement:  "CALL db.index.fulltext.drop($name)",
+			Parameters: map[string]interface{}{"name": i.Name},
+		}, nil
+	}
+	// indexes are dropped by repeating their definition in Neo4j 3.x
+	q, err := sm.createIndexQuery(i)
+	if err != nil {
+		return nil, err
+	}
+	q.Statement = "DROP" + strings.TrimPrefix(q.Statement, "CREATE")
+	return q, nil
+}
+
+func (sm *cypherSchemaManager) DropSchemaConstraint(constraint SchemaConstraint) error {
+	q, err := sm.dropConstraintQuery(constraint)
+	if err != nil {
+		return err
+	}
+	return sm.cr.CypherBatch([]*neoism.CypherQuery{q})
+}
+
+func (sm *cypherSchemaManager) dropConstraintQuery(c SchemaConstraint) (*neoism.CypherQuery, error) {
+	if sm.major >= 4 {
+		if c.Name == "" {
+			return nil, fmt.Errorf("cannot drop unnamed %v", c)
+		}
+		return &neoism.CypherQuery{Statement: "DROP CONSTRAINT " + cypherName(c.Name)}, nil
+	}
+	q, err := sm.createConstraintQuery(c)
+	if err != nil {
+		return nil, err
+	}
+	q.Statement = "DROP" + strings.TrimPrefix(q.Statement, "CREATE")
+	return q, nil
+}
+
+// entityPattern matches nodes with a label as n, or relationships with a type as r.
+func entityPattern(label, relationshipType string) string {
+	if label != "" {
+		return fmt.Sprintf("(n:%s)", cypherName(label))
+	}
+	return fmt.Sprintf("()-[r:%s]-()", cypherName(relationshipType))
+}
+
+// propertyRefs lists the properties of the variable bound by entityPattern.
+func propertyRefs(label string, properties []string) string {
+	variable := "r"
+	if label != "" {
+		variable = "n"
+	}
+	refs := make([]string, len(properties))
+	for i, p := range properties {
+		refs[i] = variable + "." + cypherName(p)
+	}
+	return strings.Join(refs, ", ")
+}
+
+func optionalName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return cypherName(name) + " "
+}
+
+var _ SchemaManager = (*cypherSchemaManager)(nil)
@@ -0,0 +1,202 @@
+package neoutils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServerVersion(t *testing.T) {
+	for v, want := range map[string][2]int{
+		"3.5.12":       {3, 5},
+		"Neo4j/4.4.12": {4, 4},
+		"5.13-aura":    {5, 13},
+		"":             {0, 0},
+	} {
+		major, minor := parseServerVersion(v)
+		assert.Equal(t, want, [2]int{major, minor}, v)
+	}
+}
+
+func TestCreateSchemaStatements(t *testing.T) {
+	composite := SchemaIndex{Label: "Person", Properties: []string{"authority", "identifier"}}
+	named := SchemaIndex{Name: "mentions_score", RelationshipType: "MENTIONS", Property: "score"}
+	fulltext := SchemaIndex{Name: "names", Type: FullTextIndex, Label: "Concept", Properties: []string{"prefLabel", "aliases"}}
+	unique := SchemaConstraint{Label: "Person", Property: "uuid"}
+	compositeUnique := SchemaConstraint{Name: "person_id", Label: "Person", Properties: []string{"authority", "identifier"}}
+	exists := SchemaConstraint{Type: ExistenceConstraint, RelationshipType: "MENTIONS", Property: "platformVersion"}
+	nodeKey := SchemaConstraint{Type: NodeKeyConstraint, Label: "Person", Properties: []string{"authority", "identifier"}}
+
+	tests := []struct {
+		version string
+		spec    interface{}
+		want    string
+	}{
+		{"3.5.12", composite, "CREATE INDEX ON :`Person`(`authority`, `identifier`)"},
+		{"3.5.12", named, ""},
+		{"3.5.12", fulltext, "CALL db.index.fulltext.createNodeIndex($name, $tokens, $properties)"},
+		{"3.5.12", unique, "CREATE CONSTRAINT ON (n:`Person`) ASSERT n.`uuid` IS UNIQUE"},
+		{"3.5.12", compositeUnique, ""},
+		{"3.5.12", exists, "CREATE CONSTRAINT ON ()-[r:`MENTIONS`]-() ASSERT exists(r.`platformVersion`)"},
+		{"3.5.12", nodeKey, "CREATE CONSTRAINT ON (n:`Person`) ASSERT (n.`authority`, n.`identifier`) IS NODE KEY"},
+
+		{"4.2.0", composite, "CREATE INDEX FOR (n:`Person`) ON (n.`authority`, n.`identifier`)"},
+		{"4.2.0", named, ""},
+		{"4.2.0", fulltext, "CALL db.index.fulltext.createNodeIndex($name, $tokens, $properties)"},
+		{"4.2.0", exists, "CREATE CONSTRAINT ON ()-[r:`MENTIONS`]-() ASSERT exists(r.`platformVersion`)"},
+
+		{"4.3.0", named, "CREATE INDEX `mentions_score` FOR ()-[r:`MENTIONS`]-() ON (r.`score`)"},
+		{"4.3.0", fulltext, "CREATE FULLTEXT INDEX `names` FOR (n:`Concept`) ON EACH [n.`prefLabel`, n.`aliases`]"},
+		{"4.3.0", compositeUnique, ""},
+
+		{"Neo4j/4.4.12", unique, "CREATE CONSTRAINT FOR (n:`Person`) REQUIRE n.`uuid` IS UNIQUE"},
+		{"Neo4j/4.4.12", compositeUnique, "CREATE CONSTRAINT `person_id` FOR (n:`Person`) REQUIRE (n.`authority`, n.`identifier`) IS UNIQUE"},
+		{"Neo4j/5.13.0", exists, "CREATE CONSTRAINT FOR ()-[r:`MENTIONS`]-() REQUIRE r.`platformVersion` IS NOT NULL"},
+		{"Neo4j/5.13.0", nodeKey, "CREATE CONSTRAINT FOR (n:`Person`) REQUIRE (n.`authority`, n.`identifier`) IS NODE KEY"},
+	}
+	for _, test := range tests {
+		sm := NewCypherSchemaManager(nil, test.version).(*cypherSchemaManager)
+		var q *neoism.CypherQuery
+		var err error
+		switch spec := test.spec.(type) {
+		case SchemaIndex:
+			q, err = sm.createIndexQuery(spec)
+		case SchemaConstraint:
+			q, err = sm.createConstraintQuery(spec)
+		}
+		if test.want == "" {
+			assert.Error(t, err, "%s %v", test.version, test.spec)
+			continue
+		}
+		if assert.NoError(t, err, "%s %v", test.version, test.spec) {
+			assert.Equal(t, test.want, q.Statement, "%s %v", test.version, test.spec)
+		}
+	}
+}
+
+func TestDropSchemaStatements(t *testing.T) {
+	index := SchemaIndex{Name: "index_1", Label: "Person", Properties: []string{"prefLabel"}}
+	constraint := SchemaConstraint{Name: "constraint_1", Type: ExistenceConstraint, RelationshipType: "MENTIONS", Property: "platformVersion"}
+	fulltext := SchemaIndex{Name: "names", Type: FullTextIndex, Label: "Concept", Property: "prefLabel"}
+
+	sm := NewCypherSchemaManager(nil, "4.4.0").(*cypherSchemaManager)
+	q, err := sm.dropIndexQuery(index)
+	assert.NoError(t, err)
+	assert.Equal(t, "DROP INDEX `index_1`", q.Statement)
+	q, err = sm.dropConstraintQuery(constraint)
+	assert.NoError(t, err)
+	assert.Equal(t, "DROP CONSTRAINT `constraint_1`", q.Statement)
+	_, err = sm.dropIndexQuery(SchemaIndex{Label: "Person", Property: "prefLabel"})
+	assert.Error(t, err, "unnamed")
+
+	sm = NewCypherSchemaManager(nil, "3.5.12").(*cypherSchemaManager)
+	q, err = sm.dropIndexQuery(index)
+	assert.NoError(t, err)
+	assert.Equal(t, "DROP INDEX ON :`Person`(`prefLabel`)", q.Statement)
+	q, err = sm.dropIndexQuery(fulltext)
+	assert.NoError(t, err)
+	assert.Equal(t, "CALL db.index.fulltext.drop($name)", q.Statement)
+	q, err = sm.dropConstraintQuery(constraint)
+	assert.NoError(t, err)
+	assert.Equal(t, "DROP CONSTRAINT ON ()-[r:`MENTIONS`]-() ASSERT exists(r.`platformVersion`)", q.Statement)
+}
+
+func TestSchemaListings(t *testing.T) {
+	cr := &schemaListingRunner{rows: map[string]string{
+		"SHOW INDEXES": `[
+			{"name": "index_1", "type": "BTREE", "entityType": "NODE", "labelsOrTypes": ["Person"], "properties": ["prefLabel"], "uniqueness": "NONUNIQUE"},
+			{"name": "constraint_1", "type": "BTREE", "entityType": "NODE", "labelsOrTypes": ["Person"], "properties": ["uuid"], "uniqueness": "UNIQUE"},
+			{"name": "names", "type": "FULLTEXT", "entityType": "RELATIONSHIP", "labelsOrTypes": ["MENTIONS"], "properties": ["text"]},
+			{"name": "labels", "type": "LOOKUP", "entityType": "NODE", "labelsOrTypes": null, "properties": null}
+		]`,
+		"SHOW CONSTRAINTS": `[
+			{"name": "constraint_1", "type": "UNIQUENESS", "entityType": "NODE", "labelsOrTypes": ["Person"], "properties": ["uuid"]},
+			{"name": "constraint_2", "type": "RELATIONSHIP_PROPERTY_EXISTENCE", "entityType": "RELATIONSHIP", "labelsOrTypes": ["MENTIONS"], "properties": ["platformVersion"]}
+		]`,
+		"CALL db.indexes()": `[
+			{"indexName": "index_1", "type": "node_label_property", "tokenNames": ["Person"], "properties": ["prefLabel"]},
+			{"indexName": "index_2", "type": "node_unique_property", "tokenNames": ["Person"], "properties": ["uuid"]},
+			{"indexName": "names", "type": "node_fulltext", "tokenNames": ["Concept"], "properties": ["prefLabel", "aliases"]}
+		]`,
+		"CALL db.constraints()": `[
+			{"description": "CONSTRAINT ON ( person:Person ) ASSERT person.uuid IS UNIQUE"},
+			{"description": "CONSTRAINT ON ()-[ mentions:MENTIONS ]-() ASSERT exists(mentions.platformVersion)"},
+			{"description": "CONSTRAINT ON ( person:Person ) ASSERT (person.authority, person.identifier) IS NODE KEY"}
+		]`,
+	}}
+
+	sm := NewCypherSchemaManager(cr, "4.4.0")
+	indexes, err := sm.SchemaIndexes()
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaIndex{
+		{Name: "index_1", Type: RangeIndex, Label: "Person", Properties: []string{"prefLabel"}},
+		{Name: "names", Type: FullTextIndex, RelationshipType: "MENTIONS", Properties: []string{"text"}},
+	}, indexes)
+	constraints, err := sm.SchemaConstraints()
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaConstraint{
+		{Name: "constraint_1", Type: UniqueConstraint, Label: "Person", Properties: []string{"uuid"}},
+		{Name: "constraint_2", Type: ExistenceConstraint, RelationshipType: "MENTIONS", Properties: []string{"platformVersion"}},
+	}, constraints)
+
+	sm = NewCypherSchemaManager(cr, "3.5.12")
+	indexes, err = sm.SchemaIndexes()
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaIndex{
+		{Type: RangeIndex, Label: "Person", Properties: []string{"prefLabel"}},
+		{Name: "names", Type: FullTextIndex, Label: "Concept", Properties: []string{"prefLabel", "aliases"}},
+	}, indexes)
+	constraints, err = sm.SchemaConstraints()
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaConstraint{
+		{Type: UniqueConstraint, Label: "Person", Properties: []string{"uuid"}},
+		{Type: ExistenceConstraint, RelationshipType: "MENTIONS", Properties: []string{"platformVersion"}},
+		{Type: NodeKeyConstraint, Label: "Person", Properties: []string{"authority", "identifier"}},
+	}, constraints)
+}
+
+func TestSchemaIndexStatuses(t *testing.T) {
+	cr := &schemaListingRunner{rows: map[string]string{
+		"SHOW INDEXES": `[
+			{"name": "index_1", "type": "RANGE", "entityType": "NODE", "labelsOrTypes": ["Person"], "properties": ["prefLabel"], "state": "POPULATING", "populationPercent": 42.5}
+		]`,
+		"CALL db.indexes()": `[
+			{"indexName": "names", "type": "node_fulltext", "tokenNames": ["Concept"], "properties": ["prefLabel"], "state": "FAILED", "progress": 10.0, "failureMessage": "out of disk"}
+		]`,
+	}}
+
+	statuses, err := NewCypherSchemaManager(cr, "5.13.0").SchemaIndexStatuses()
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaIndexStatus{{
+		SchemaIndex:       SchemaIndex{Name: "index_1", Type: RangeIndex, Label: "Person", Properties: []string{"prefLabel"}},
+		State:             IndexPopulating,
+		PopulationPercent: 42.5,
+	}}, statuses)
+
+	statuses, err = NewCypherSchemaManager(cr, "3.5.12").SchemaIndexStatuses()
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaIndexStatus{{
+		SchemaIndex:       SchemaIndex{Name: "names", Type: FullTextIndex, Label: "Concept", Properties: []string{"prefLabel"}},
+		State:             IndexFailed,
+		PopulationPercent: 10,
+		FailureMessage:    "out of disk",
+	}}, statuses)
+}
+
+// schemaListingRunner answers statements with canned JSON rows.
+type schemaListingRunner struct {
+	rows map[string]string
+}
+
+func (cr *schemaListingRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	for _, q := range queries {
+		if q.Result != nil {
+			if err := json.Unmarshal([]byte(cr.rows[q.Statement]), q.Result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,11 +1,220 @@
 package neoutils
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
 	"github.com/jmcvetta/neoism"
 )
 
-// ConstraintViolationError is a possible error the Service can return
+// ErrClosed is returned when using a connection or runner after it has been closed.
+var ErrClosed = errors.New("neoutils: connection closed")
+
+// ErrQueueFull is returned when queries can't be queued for a batch because
+// the queue is full, see BatchOptions.QueueSize.
+var ErrQueueFull = errors.New("neoutils: batch queue is full")
+
+// Sentinel errors matched by a *Neo4jError with errors.Is, according to the
+// classification of its status code.
+var (
+	ErrClientError         = errors.New("neo4j client error")
+	ErrTransientError      = errors.New("neo4j transient error")
+	ErrDatabaseError       = errors.New("neo4j database error")
+	ErrConstraintViolation = errors.New("neo4j constraint violation")
+)
+
+// Neo4jError is a failure reported by Neo4j, identified by a status code of the
+// form Neo.<Classification>.<Category>.<Title>, e.g.
+// Neo.ClientError.Schema.ConstraintValidationFailed.
+//
+// It matches ErrClientError, ErrTransientError, ErrDatabaseError and
+// ErrConstraintViolation with errors.Is. Client errors can also be extracted
+// as an rwapi.ConstraintOrTransactionError with errors.As.
+//
+// Runners return constraint violations as an rwapi.ConstraintOrTransactionError
+// rather than a *Neo4jError, as they did before errors were classified, so
+// use IsConstraintViolation to check for them. Other client errors, such as
+// syntax errors, used to be returned as an rwapi.ConstraintOrTransactionError
+// too but are now a *Neo4jError: this breaks callers that check for them with
+// a type assertion, which need to use errors.As instead.
+type Neo4jError struct {
+	Code    string
+	Message string
+	// StatementIndex is the position in the batch of the query that failed,
+	// or -1 if the failure can't be attributed to a single query.
+	StatementIndex int
+
+	// details are all the messages reported with the failure, when there
+	// are more than Message
+	details []string
+}
+
+func newNeo4jError(code string, message string, statementIndex int) *Neo4jError {
+	return &Neo4jError{Code: code, Message: message, StatementIndex: statementIndex}
+}
+
+func (e *Neo4jError) Error() string {
+	if e.StatementIndex < 0 {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (statement %d)", e.Code, e.Message, e.StatementIndex)
+}
+
+// Classification returns the second part of the status code, e.g. ClientError.
+func (e *Neo4jError) Classification() string {
+	return e.codePart(1)
+}
+
+// Category returns the third part of the status code, e.g. Schema.
+func (e *Neo4jError) Category() string {
+	return e.codePart(2)
+}
+
+// Title returns the last part of the status code, e.g. ConstraintValidationFailed.
+func (e *Neo4jError) Title() string {
+	return e.codePart(3)
+}
+
+func (e *Neo4jError) codePart(i int) string {
+	parts := strings.SplitN(e.Code, ".", 4)
+	if len(parts) != 4 || parts[0] != "Neo" {
+		return ""
+	}
+	return parts[i]
+}
+
+// IsRetryable reports whether running the same queries again may succeed.
+func (e *Neo4jError) IsRetryable() bool {
+	switch e.Code {
+	case "Neo.TransientError.Transaction.Terminated", "Neo.TransientError.Transaction.LockClientStopped":
+		// the transaction was stopped deliberately, e.g. by an administrator
+		return false
+	case "Neo.ClientError.Cluster.NotALeader", "Neo.ClientError.General.ForbiddenOnReadOnlyDatabase":
+		// the cluster leader moved while the transaction was being written
+		return true
+	}
+	return e.Classification() == "TransientError"
+}
+
+// IsConstraintViolation reports whether the queries broke a schema constraint,
+// such as creating a duplicate of a unique property.
+func (e *Neo4jError) IsConstraintViolation() bool {
+	switch e.Code {
+	case "Neo.ClientError.Schema.ConstraintValidationFailed",
+		"Neo.ClientError.Schema.ConstraintViolation",
+		"Neo.ClientError.Statement.ConstraintVerificationFailed":
+		return true
+	}
+	return false
+}
+
+func (e *Neo4jError) Is(target error) bool {
+	switch target {
+	case ErrClientError:
+		return e.Classification() == "ClientError"
+	case ErrTransientError:
+		return e.Classification() == "TransientError"
+	case ErrDatabaseError:
+		return e.Classification() == "DatabaseError"
+	case ErrConstraintViolation:
+		return e.IsConstraintViolation()
+	}
+	return false
+}
+
+// As lets callers that check client errors for
+// rwapi.ConstraintOrTransactionError keep working, by filling it in the same
+// way as before errors were classified. Transient and database errors aren't
+// caused by the queries, so don't match.
+func (e *Neo4jError) As(target interface{}) bool {
+	t, ok := target.(*rwapi.ConstraintOrTransactionError)
+	if !ok || e.Classification() != "ClientError" {
+		return false
+	}
+	details := e.details
+	if details == nil {
+		details = []string{e.Message}
+	}
+	*t = rwapi.ConstraintOrTransactionError{
+		Message: neoism.TxQueryError.Error(),
+		Details: details,
+	}
+	return true
+}
+
+// statementError returns the error runners report for queries failing with e:
+// a constraint violation is returned as the rwapi.ConstraintOrTransactionError
+// services check the type of to report a conflict, and anything else as e.
+func statementError(e *Neo4jError) error {
+	if e.IsConstraintViolation() {
+		var txErr rwapi.ConstraintOrTransactionError
+		e.As(&txErr)
+		return txErr
+	}
+	return e
+}
+
+// IsRetryable reports whether err is a Neo4j error for which running the same
+// queries again may succeed.
+func IsRetryable(err error) bool {
+	var neoErr *Neo4jError
+	return errors.As(err, &neoErr) && neoErr.IsRetryable()
+}
+
+// IsConstraintViolation reports whether err is a Neo4j error caused by
+// breaking a schema constraint, including the rwapi.ConstraintOrTransactionError
+// runners return for them.
+func IsConstraintViolation(err error) bool {
+	var neoErr *Neo4jError
+	if errors.As(err, &neoErr) {
+		return neoErr.IsConstraintViolation()
+	}
+	var txErr rwapi.ConstraintOrTransactionError
+	return errors.As(err, &txErr)
+}
+
+// isEquivalentSchemaRule reports whether creating an index or constraint
+// failed because an identical one already exists, usually because another
+// instance created it at the same time.
+func isEquivalentSchemaRule(err error) bool {
+	var neoErr *Neo4jError
+	if errors.As(err, &neoErr) {
+		return neoErr.Code == "Neo.ClientError.Schema.EquivalentSchemaRuleAlreadyExists"
+	}
+	// the REST schema endpoints of Neo4j 3.x report kernel exceptions
+	var restErr neoism.NeoError
+	if errors.As(err, &restErr) {
+		switch restErr.Exception {
+		case "AlreadyIndexedException", "AlreadyConstrainedException", "EquivalentSchemaRuleAlreadyExistsException":
+			return true
+		}
+	}
+	return false
+}
+
+// isStatementError reports whether err was caused by the queries rather than
+// the connection or the server, so that the connection is still good and
+// running the same queries again would fail the same way.
+func isStatementError(err error) bool {
+	var neoErr *Neo4jError
+	if errors.As(err, &neoErr) {
+		return neoErr.Classification() == "ClientError"
+	}
+	var txErr rwapi.ConstraintOrTransactionError
+	return errors.As(err, &txErr)
+}
+
+// isQueueError reports whether err is from the batch queue, before the queries
+// were sent, so it says nothing about the connection.
+func isQueueError(err error) bool {
+	return errors.Is(err, ErrQueueFull) || errors.Is(err, ErrBatchTooLarge)
+}
+
+// ConstraintViolationError is a possible error the Service can return.
+//
+// Deprecated: runners return a *Neo4jError; use IsConstraintViolation.
 type ConstraintViolationError struct {
 	Msg string
 	Err error
@@ -0,0 +1,85 @@
+package neoutils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeo4jErrorClassification(t *testing.T) {
+	cases := []struct {
+		code                  string
+		sentinel              error
+		retryable, constraint bool
+	}{
+		{"Neo.ClientError.Schema.ConstraintValidationFailed", ErrClientError, false, true},
+		{"Neo.ClientError.Schema.ConstraintViolation", ErrClientError, false, true},
+		{"Neo.ClientError.Statement.SyntaxError", ErrClientError, false, false},
+		{"Neo.TransientError.Transaction.DeadlockDetected", ErrTransientError, true, false},
+		{"Neo.TransientError.General.DatabaseUnavailable", ErrTransientError, true, false},
+		{"Neo.TransientError.Transaction.Terminated", ErrTransientError, false, false},
+		{"Neo.ClientError.Cluster.NotALeader", ErrClientError, true, false},
+		{"Neo.DatabaseError.General.UnknownError", ErrDatabaseError, false, false},
+	}
+	for _, c := range cases {
+		// wrapped, as a caller might
+		err := fmt.Errorf("writing: %w", newNeo4jError(c.code, "message", 1))
+		assert.True(t, errors.Is(err, c.sentinel), c.code)
+		for _, other := range []error{ErrClientError, ErrTransientError, ErrDatabaseError} {
+			if other != c.sentinel {
+				assert.False(t, errors.Is(err, other), "%s is %v", c.code, other)
+			}
+		}
+		assert.Equal(t, c.retryable, IsRetryable(err), c.code)
+		assert.Equal(t, c.constraint, IsConstraintViolation(err), c.code)
+		assert.Equal(t, c.constraint, errors.Is(err, ErrConstraintViolation), c.code)
+	}
+}
+
+func TestNeo4jErrorCodeParts(t *testing.T) {
+	err := newNeo4jError("Neo.ClientError.Schema.ConstraintValidationFailed", "Node(0) already exists", 2)
+	assert.Equal(t, "ClientError", err.Classification())
+	assert.Equal(t, "Schema", err.Category())
+	assert.Equal(t, "ConstraintValidationFailed", err.Title())
+	assert.Equal(t, "Neo.ClientError.Schema.ConstraintValidationFailed: Node(0) already exists (statement 2)", err.Error())
+
+	err = newNeo4jError("not a code", "oops", -1)
+	assert.Equal(t, "", err.Classification())
+	assert.Equal(t, "not a code: oops", err.Error())
+}
+
+func TestNeo4jErrorAsConstraintOrTransactionError(t *testing.T) {
+	var txErr rwapi.ConstraintOrTransactionError
+	assert.True(t, errors.As(newNeo4jError("Neo.ClientError.Statement.SyntaxError", "bad syntax", 0), &txErr))
+	assert.Equal(t, rwapi.ConstraintOrTransactionError{Message: neoism.TxQueryError.Error(), Details: []string{"bad syntax"}}, txErr)
+
+	// only failures caused by the queries
+	assert.False(t, errors.As(newNeo4jError("Neo.TransientError.Transaction.DeadlockDetected", "deadlock", 0), &txErr))
+	assert.False(t, errors.As(newNeo4jError("Neo.DatabaseError.General.UnknownError", "oops", -1), &txErr))
+}
+
+func TestStatementErrors(t *testing.T) {
+	assert.True(t, isStatementError(newNeo4jError("Neo.ClientError.Statement.SyntaxError", "bad syntax", 0)))
+	assert.True(t, isStatementError(rwapi.ConstraintOrTransactionError{Message: "already exists"}))
+	assert.False(t, isStatementError(newNeo4jError("Neo.TransientError.Transaction.DeadlockDetected", "deadlock", 0)))
+	assert.False(t, isStatementError(newNeo4jError("Neo.DatabaseError.General.UnknownError", "oops", -1)))
+
+	// constraint violations keep the type services check for a conflict
+	err := statementError(newNeo4jError("Neo.ClientError.Schema.ConstraintValidationFailed", "already exists", 0))
+	assert.IsType(t, rwapi.ConstraintOrTransactionError{}, err)
+	assert.True(t, IsConstraintViolation(err))
+	err = statementError(newNeo4jError("Neo.ClientError.Statement.SyntaxError", "bad syntax", 0))
+	assert.IsType(t, &Neo4jError{}, err)
+	assert.False(t, IsConstraintViolation(err))
+}
+
+func TestNonNeo4jErrorsAreNotClassified(t *testing.T) {
+	err := errors.New("connection refused")
+	assert.False(t, IsRetryable(err))
+	assert.False(t, IsConstraintViolation(err))
+	assert.False(t, errors.Is(err, ErrClientError))
+}
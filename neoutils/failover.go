@@ -0,0 +1,135 @@
+package neoutils
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+)
+
+// endpoints chooses which of several Neo4j URLs to connect to, in order: the
+// URL that last worked is tried first, then those that have not failed, then
+// the rest from the least recently failed. This is ordered failover rather
+// than health-based selection: URLs are not probed, and the order only
+// changes when connecting succeeds or fails.
+type endpoints struct {
+	urls      []string
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+	log       *logger.UPPLogger
+
+	lk        sync.Mutex
+	preferred string
+	failed    map[string]time.Time
+}
+
+func newEndpoints(urls []string, log *logger.UPPLogger) *endpoints {
+	return &endpoints{urls: urls, lookupSRV: net.LookupSRV, log: log, failed: map[string]time.Time{}}
+}
+
+// connect tries each endpoint in turn, returning the first connection made or
+// the last error.
+func (e *endpoints) connect(connect func(neoURL string) (NeoConnection, error)) (NeoConnection, error) {
+	candidates, err := e.candidates()
+	if err != nil {
+		return nil, err
+	}
+	for i, u := range candidates {
+		conn, err := connect(u)
+		if err == nil {
+			e.succeeded(u)
+			return conn, nil
+		}
+		e.fail(u)
+		if i == len(candidates)-1 {
+			return nil, err
+		}
+		e.log.WithError(err).Warnf("cannot connect to %s, trying %s", redactURL(u), redactURL(candidates[i+1]))
+	}
+	return nil, errors.New("no neo4j URLs to connect to")
+}
+
+// candidates resolves SRV names and orders the URLs.
+func (e *endpoints) candidates() ([]string, error) {
+	var urls []string
+	var lastErr error
+	for _, u := range e.urls {
+		resolved, err := e.resolve(u)
+		if err != nil {
+			e.log.WithError(err).Warnf("cannot resolve %s", redactURL(u))
+			lastErr = err
+			continue
+		}
+		urls = append(urls, resolved...)
+	}
+	if len(urls) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	sort.SliceStable(urls, func(i, j int) bool {
+		if urls[i] == e.preferred || urls[j] == e.preferred {
+			return urls[i] == e.preferred && urls[j] != e.preferred
+		}
+		return e.failed[urls[i]].Before(e.failed[urls[j]])
+	})
+	return urls, nil
+}
+
+// resolve returns the URL, or if its host is a DNS SRV name such as
+// _neo4j._tcp.example.com, a URL for each of the name's targets in the order
+// they should be tried.
+func (e *endpoints) resolve(rawURL string) ([]string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || !strings.HasPrefix(parsed.Hostname(), "_") {
+		return []string{rawURL}, nil
+	}
+	_, records, err := e.lookupSRV("", "", parsed.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, r := range records {
+		target := *parsed
+		target.Host = net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		urls = append(urls, target.String())
+	}
+	return urls, nil
+}
+
+func (e *endpoints) succeeded(u string) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	delete(e.failed, u)
+	if e.preferred != u && len(e.failed) > 0 {
+		e.log.Infof("failed over to %s", redactURL(u))
+	}
+	e.preferred = u
+}
+
+func (e *endpoints) fail(u string) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	e.failed[u] = time.Now()
+	if e.preferred == u {
+		e.preferred = ""
+	}
+}
+
+// redactURL hides the password in a URL so that it can be logged.
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.User == nil {
+		return rawURL
+	}
+	if _, ok := parsed.User.Password(); ok {
+		parsed.User = url.UserPassword(parsed.User.Username(), "xxxxx")
+	}
+	return parsed.String()
+}
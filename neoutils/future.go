@@ -0,0 +1,104 @@
+package neoutils
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// Future is the result of queries submitted to be written without waiting,
+// see Submitter.
+type Future struct {
+	done chan struct{}
+	err  error
+
+	// lk guards then against the future being resolved
+	lk   sync.Mutex
+	then []func(err error)
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// failedFuture returns a Future that has already failed with err.
+func failedFuture(err error) *Future {
+	f := newFuture()
+	f.resolve(err)
+	return f
+}
+
+// Done is closed once the queries have been written or have failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the queries to be written, returning the error from writing
+// them, or ctx's error if it is done first. Giving up on waiting doesn't stop
+// the queries being written.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+	}
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// resolve sets the result of f. It must be called once.
+func (f *Future) resolve(err error) {
+	f.lk.Lock()
+	f.err = err
+	close(f.done)
+	then := f.then
+	f.then = nil
+	f.lk.Unlock()
+	for _, fn := range then {
+		fn(err)
+	}
+}
+
+// chain returns a Future with the result of passing f's error to fn once f is
+// resolved. fn is called by whatever resolves f, so must not block.
+func (f *Future) chain(fn func(err error) error) *Future {
+	next := newFuture()
+	f.lk.Lock()
+	select {
+	case <-f.done:
+		f.lk.Unlock()
+		next.resolve(fn(f.err))
+		return next
+	default:
+	}
+	f.then = append(f.then, func(err error) { next.resolve(fn(err)) })
+	f.lk.Unlock()
+	return next
+}
+
+// Submitter is implemented by connections and runners that can queue writes
+// without waiting for them, so that one goroutine can have many in flight.
+type Submitter interface {
+	Submit(queries []*neoism.CypherQuery) *Future
+	// SubmitContext drops the queries from their batch if ctx is done
+	// before it is sent, like CypherBatchContext.
+	SubmitContext(ctx context.Context, queries []*neoism.CypherQuery) *Future
+}
+
+// submit submits queries to cr. A cr without a queue runs them in a new
+// goroutine.
+func submit(ctx context.Context, cr CypherRunner, queries []*neoism.CypherQuery) *Future {
+	if s, ok := cr.(Submitter); ok {
+		return s.SubmitContext(ctx, queries)
+	}
+	f := newFuture()
+	go func() {
+		f.resolve(cypherBatchContext(ctx, cr, queries))
+	}()
+	return f
+}
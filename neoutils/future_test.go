@@ -0,0 +1,78 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitPipelinesWrites(t *testing.T) {
+	mr := &mockRunner{}
+	batchCypherRunner := NewBatchCypherRunnerWithOptions(mr, 100, BatchOptions{QueueSize: 100}).(*BatchCypherRunner)
+
+	var futures []*Future
+	var expected []*neoism.CypherQuery
+	for i := 0; i < 50; i++ {
+		q := &neoism.CypherQuery{Statement: fmt.Sprintf("Write %d", i)}
+		futures = append(futures, batchCypherRunner.Submit([]*neoism.CypherQuery{q}))
+		expected = append(expected, q)
+	}
+	for _, f := range futures {
+		assert.NoError(t, f.Wait(context.Background()))
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("future isn't done after Wait")
+		}
+	}
+	assert.Equal(t, expected, mr.queriesRun)
+
+	assert.NoError(t, batchCypherRunner.Close(context.Background()))
+	assert.Equal(t, ErrClosed, batchCypherRunner.Submit([]*neoism.CypherQuery{{Statement: "Late"}}).Wait(context.Background()))
+}
+
+func TestFutureWaitGivesUp(t *testing.T) {
+	gr := &gateRunner{started: make(chan []*neoism.CypherQuery), release: make(chan struct{})}
+	batchCypherRunner := NewBatchCypherRunner(gr, 3).(*BatchCypherRunner)
+
+	f := batchCypherRunner.Submit([]*neoism.CypherQuery{{Statement: "First"}})
+	<-gr.started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, f.Wait(ctx))
+
+	// giving up on waiting doesn't stop the write
+	close(gr.release)
+	<-f.Done()
+	assert.NoError(t, f.Wait(ctx))
+}
+
+func TestSubmitWithoutQueue(t *testing.T) {
+	conn := &DefaultNeoConnection{cr: &failRunner{}}
+	assert.Error(t, conn.Submit([]*neoism.CypherQuery{{Statement: "First"}}).Wait(context.Background()))
+}
+
+func TestFutureChain(t *testing.T) {
+	failed := errors.New("failed")
+	wrap := func(err error) error {
+		return fmt.Errorf("wrapped: %w", err)
+	}
+
+	f := newFuture()
+	chained := f.chain(wrap)
+	select {
+	case <-chained.Done():
+		t.Fatal("chained future resolved early")
+	default:
+	}
+	f.resolve(failed)
+	assert.True(t, errors.Is(chained.Wait(context.Background()), failed))
+
+	// chaining a resolved future resolves straight away
+	assert.EqualError(t, failedFuture(failed).chain(wrap).Wait(context.Background()), "wrapped: failed")
+}
@@ -0,0 +1,161 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	defaultIndexTimeout      = 10 * time.Minute
+	defaultIndexPollInterval = time.Second
+	defaultSchemaLockTimeout = 5 * time.Minute
+)
+
+// indexProgressLogInterval limits how often WaitForIndexes logs progress.
+var indexProgressLogInterval = 10 * time.Second
+
+// ErrIndexFailed is wrapped by the error returned when an index fails to populate.
+var ErrIndexFailed = errors.New("index population failed")
+
+// IndexState is the population state of an index, as reported by Neo4j.
+type IndexState string
+
+const (
+	IndexOnline     IndexState = "ONLINE"
+	IndexPopulating IndexState = "POPULATING"
+	IndexFailed     IndexState = "FAILED"
+)
+
+// SchemaIndexStatus is an index with its population state.
+type SchemaIndexStatus struct {
+	SchemaIndex
+	State             IndexState
+	PopulationPercent float64
+	// FailureMessage is only reported by Neo4j 3.x.
+	FailureMessage string
+}
+
+// SchemaOptions controls how connections apply indexes and constraints.
+type SchemaOptions struct {
+	// WaitForIndexes makes EnsureIndexes and EnsureSchema wait for the
+	// indexes they declare to be ONLINE, as Neo4j populates new indexes in the
+	// background and queries can't use them until then. An index that fails
+	// to populate is returned as an error. Constraints aren't waited for, as
+	// Neo4j populates the index backing a constraint before creating it.
+	WaitForIndexes bool
+	// IndexTimeout limits the wait. 0 means 10 minutes.
+	IndexTimeout time.Duration
+	// IndexPollInterval is how often index states are checked. 0 means 1 second.
+	IndexPollInterval time.Duration
+	// Lock makes instances take turns to create indexes and constraints,
+	// holding a lease on a NeoUtilsSchemaLock node, when some are missing.
+	// It is off by default, as it adds the node and a constraint on it to
+	// the database, which needs write access. Without it instances race,
+	// which is safe: one that finds an index or constraint created by
+	// another in the meantime treats it as created. If the lease is lost
+	// while schema is being applied, no more changes are made and an error
+	// wrapping the loss is returned.
+	Lock bool
+	// LockTimeout limits the wait for another instance to finish. 0 means 5 minutes.
+	LockTimeout time.Duration
+}
+
+func (o SchemaOptions) lockTimeout() time.Duration {
+	if o.LockTimeout <= 0 {
+		return defaultSchemaLockTimeout
+	}
+	return o.LockTimeout
+}
+
+func (o SchemaOptions) indexTimeout() time.Duration {
+	if o.IndexTimeout <= 0 {
+		return defaultIndexTimeout
+	}
+	return o.IndexTimeout
+}
+
+func (o SchemaOptions) indexPollInterval() time.Duration {
+	if o.IndexPollInterval <= 0 {
+		return defaultIndexPollInterval
+	}
+	return o.IndexPollInterval
+}
+
+// WaitForIndexes polls sm every interval until the indexes are ONLINE, or
+// until ctx is done. Indexes that are not listed, such as those provided by a
+// constraint, are not waited for. Progress is logged, and reported by the
+// indexesPopulating and indexPopulationPercent gauges.
+func WaitForIndexes(ctx context.Context, sm SchemaManager, indexes []SchemaIndex, interval time.Duration, log *logger.UPPLogger) error {
+	// log is an optional parameter
+	if log == nil {
+		log = logger.NewUPPInfoLogger("neo-utils-go")
+	}
+	populating := metrics.GetOrRegisterGauge("indexesPopulating", metrics.DefaultRegistry)
+	percent := metrics.GetOrRegisterGaugeFloat64("indexPopulationPercent", metrics.DefaultRegistry)
+	defer metrics.GetOrRegisterTimer("index-population", metrics.DefaultRegistry).UpdateSince(time.Now())
+
+	var lastLogged time.Time
+	for {
+		statuses, err := sm.SchemaIndexStatuses()
+		if err != nil {
+			return err
+		}
+		var pending []SchemaIndexStatus
+		for _, i := range indexes {
+			s, ok := indexStatus(statuses, i)
+			if !ok {
+				continue
+			}
+			switch s.State {
+			case IndexOnline:
+			case IndexFailed:
+				populating.Update(0)
+				if s.FailureMessage != "" {
+					return fmt.Errorf("%w: %v: %s", ErrIndexFailed, s.SchemaIndex, s.FailureMessage)
+				}
+				return fmt.Errorf("%w: %v", ErrIndexFailed, s.SchemaIndex)
+			default:
+				pending = append(pending, s)
+			}
+		}
+
+		populating.Update(int64(len(pending)))
+		if len(pending) == 0 {
+			percent.Update(100)
+			return nil
+		}
+		lowest := pending[0]
+		for _, s := range pending[1:] {
+			if s.PopulationPercent < lowest.PopulationPercent {
+				lowest = s
+			}
+		}
+		percent.Update(lowest.PopulationPercent)
+		if time.Since(lastLogged) >= indexProgressLogInterval {
+			for _, s := range pending {
+				log.Infof("Waiting for %v to come online, %.1f%% populated", s.SchemaIndex, s.PopulationPercent)
+			}
+			lastLogged = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v not online, %.1f%% populated: %w", lowest.SchemaIndex, lowest.PopulationPercent, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+func indexStatus(statuses []SchemaIndexStatus, i SchemaIndex) (SchemaIndexStatus, bool) {
+	for _, s := range statuses {
+		if s.Matches(i) {
+			return s, true
+		}
+	}
+	return SchemaIndexStatus{}, false
+}
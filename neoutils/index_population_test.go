@@ -0,0 +1,88 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForIndexesUntilOnline(t *testing.T) {
+	polls := 0
+	sm := &fakeSchemaManager{
+		indexes: []SchemaIndex{
+			{Name: "index_1", Type: RangeIndex, Label: "Person", Properties: []string{"prefLabel"}},
+			{Name: "index_2", Type: RangeIndex, Label: "Thing", Properties: []string{"prefLabel"}},
+		},
+		populate: func(i SchemaIndex) SchemaIndexStatus {
+			if i.Label == "Person" {
+				polls++
+				if polls < 3 {
+					return SchemaIndexStatus{SchemaIndex: i, State: IndexPopulating, PopulationPercent: float64(polls * 40)}
+				}
+			}
+			return SchemaIndexStatus{SchemaIndex: i, State: IndexOnline, PopulationPercent: 100}
+		},
+	}
+
+	err := WaitForIndexes(context.Background(), sm, IndexesFromMap(map[string]string{"Person": "prefLabel", "Organisation": "uuid"}),
+		time.Millisecond, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, polls)
+	assert.Equal(t, int64(0), metrics.GetOrRegisterGauge("indexesPopulating", metrics.DefaultRegistry).Value())
+	assert.Equal(t, float64(100), metrics.GetOrRegisterGaugeFloat64("indexPopulationPercent", metrics.DefaultRegistry).Value())
+}
+
+func TestWaitForIndexesReportsFailure(t *testing.T) {
+	sm := &fakeSchemaManager{
+		indexes: []SchemaIndex{{Name: "names", Type: FullTextIndex, Label: "Concept", Properties: []string{"prefLabel"}}},
+		populate: func(i SchemaIndex) SchemaIndexStatus {
+			return SchemaIndexStatus{SchemaIndex: i, State: IndexFailed, FailureMessage: "out of disk"}
+		},
+	}
+	err := WaitForIndexes(context.Background(), sm, sm.indexes, time.Millisecond, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.True(t, errors.Is(err, ErrIndexFailed))
+	assert.EqualError(t, err, "index population failed: fulltext index names on :Concept(prefLabel): out of disk")
+}
+
+func TestWaitForIndexesTimesOut(t *testing.T) {
+	sm := &fakeSchemaManager{
+		indexes: []SchemaIndex{{Type: RangeIndex, Label: "Person", Properties: []string{"prefLabel"}}},
+		populate: func(i SchemaIndex) SchemaIndexStatus {
+			return SchemaIndexStatus{SchemaIndex: i, State: IndexPopulating, PopulationPercent: 12.5}
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := WaitForIndexes(ctx, sm, sm.indexes, time.Millisecond, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.EqualError(t, err, "index on :Person(prefLabel) not online, 12.5% populated: context deadline exceeded")
+}
+
+func TestEnsureSchemaWaitsForIndexesWhenConfigured(t *testing.T) {
+	online := false
+	sm := &fakeSchemaManager{
+		populate: func(i SchemaIndex) SchemaIndexStatus {
+			if online {
+				return SchemaIndexStatus{SchemaIndex: i, State: IndexOnline, PopulationPercent: 100}
+			}
+			return SchemaIndexStatus{SchemaIndex: i, State: IndexPopulating}
+		},
+	}
+	log := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	indexes := []SchemaIndex{{Label: "Person", Property: "prefLabel"}}
+
+	ie := &defaultIndexEnsurer{sm: sm, log: log}
+	assert.NoError(t, ie.EnsureSchema(nil, indexes), "not waiting by default")
+
+	sm.indexes = nil
+	ie.opts = SchemaOptions{WaitForIndexes: true, IndexTimeout: 20 * time.Millisecond, IndexPollInterval: time.Millisecond}
+	assert.True(t, errors.Is(ie.EnsureSchema(nil, indexes), context.DeadlineExceeded))
+
+	online = true
+	assert.NoError(t, ie.EnsureSchema(nil, indexes))
+}
@@ -1,6 +1,8 @@
 package neoutils
 
 import (
+	"context"
+
 	"github.com/jmcvetta/neoism"
 )
 
@@ -8,6 +10,51 @@ type CypherRunner interface {
 	CypherBatch(queries []*neoism.CypherQuery) error
 }
 
+// ContextCypherRunner is a CypherRunner that gives up on a batch when ctx is
+// cancelled or its deadline passes. Giving up during the commit leaves the
+// outcome unknown, so a context error doesn't mean the queries weren't
+// written.
+type ContextCypherRunner interface {
+	CypherRunner
+	CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error
+}
+
+// ReadCypherRunner is implemented by connections that can run read-only
+// queries somewhere other than where writes go, such as a cluster follower.
+type ReadCypherRunner interface {
+	ReadCypherBatch(queries []*neoism.CypherQuery) error
+	ReadCypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error
+}
+
+// Closer is implemented by connections and runners that own goroutines or
+// network connections. Close stops accepting new queries and waits, until ctx
+// is done, for the queries already accepted to be written.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// ConnectionStateWatcher is implemented by connections made in the background,
+// see ConnectionConfig.BackgroundConnect.
+type ConnectionStateWatcher interface {
+	State() (ConnectionState, error)
+	WaitReady(ctx context.Context) error
+	Subscribe(f func(state ConnectionState, err error)) func()
+}
+
+// DatabaseConnector is implemented by connections that can reach the other
+// databases on their server, from Neo4j 4, without connecting again.
+type DatabaseConnector interface {
+	WithDatabase(name string) (NeoConnection, error)
+}
+
+// TrySubmitter is implemented by connections and runners that queue writes
+// to be batched, see BatchOptions.QueueSize.
+type TrySubmitter interface {
+	// TrySubmit runs the queries like CypherBatchContext, but fails with
+	// ErrQueueFull rather than waiting if the queue is full.
+	TrySubmit(ctx context.Context, queries []*neoism.CypherQuery) error
+}
+
 type IndexEnsurer interface {
 	EnsureConstraints(indexes map[string]string) error
 	EnsureIndexes(indexes map[string]string) error
@@ -17,3 +64,41 @@ type NeoConnection interface {
 	CypherRunner
 	IndexEnsurer
 }
+
+// cypherBatchContext runs queries with cr, honouring ctx if cr supports it.
+// Otherwise ctx is only checked before the queries are started.
+func cypherBatchContext(ctx context.Context, cr CypherRunner, queries []*neoism.CypherQuery) error {
+	if ccr, ok := cr.(ContextCypherRunner); ok {
+		return ccr.CypherBatchContext(ctx, queries)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cr.CypherBatch(queries)
+}
+
+// readCypherBatchContext runs read-only queries with cr, in a read
+// transaction or on a reader if cr supports it.
+func readCypherBatchContext(ctx context.Context, cr CypherRunner, queries []*neoism.CypherQuery) error {
+	if rcr, ok := cr.(ReadCypherRunner); ok {
+		return rcr.ReadCypherBatchContext(ctx, queries)
+	}
+	return cypherBatchContext(ctx, cr, queries)
+}
+
+// trySubmit runs queries with cr without waiting for room in its queue. A cr
+// without a queue runs them straight away.
+func trySubmit(ctx context.Context, cr CypherRunner, queries []*neoism.CypherQuery) error {
+	if s, ok := cr.(TrySubmitter); ok {
+		return s.TrySubmit(ctx, queries)
+	}
+	return cypherBatchContext(ctx, cr, queries)
+}
+
+// closeRunner closes cr if it holds any resources.
+func closeRunner(ctx context.Context, cr CypherRunner) error {
+	if c, ok := cr.(Closer); ok {
+		return c.Close(ctx)
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package neoutils
 
 import (
-	"errors"
 	"fmt"
 
 	"github.com/Financial-Times/go-logger/v2"
@@ -34,45 +33,15 @@ func Check(cr CypherRunner) error {
 	return nil
 }
 
-// CheckWritable calls the dbms.cluster.role() procedure and verifies the role if it's LEADER or not.
-func CheckWritable(cr CypherRunner) error {
-
-	var res []struct {
-		Role string `json:"role"`
-	}
-
-	query := &neoism.CypherQuery{
-		Statement: `CALL dbms.cluster.role()`,
-		Result:    &res,
-	}
-
-	err := cr.CypherBatch([]*neoism.CypherQuery{query})
-
-	if err != nil {
-		return err
-	}
-
-	if len(res) == 0 || res[0].Role == "" {
-		return errors.New("got empty response from dbms.cluster.role()")
-	}
-
-	role := res[0].Role
-
-	if role != "LEADER" {
-		return errors.New("role has to be LEADER for writing but it's " + role)
-	}
-
-	return nil
-}
-
 // EnsureIndexes will, for a map of labels and properties, check whether an index exists for a given property on a given label, and if missing will create one.
+// Labels are handled in sorted order, and an index created concurrently by another instance is not an error.
 func EnsureIndexes(im IndexManager, indexes map[string]string, log *logger.UPPLogger) error {
 	// log is an optional parameter
 	if log == nil {
 		log = logger.NewUPPInfoLogger("neo-utils-go")
 	}
-	for label, propertyName := range indexes {
-		err := ensureIndex(im, label, propertyName, log)
+	for _, label := range sortedKeys(indexes) {
+		err := ensureIndex(im, label, indexes[label], log)
 		if err != nil { // stop as soon as something goes wrong
 			return err
 		}
@@ -82,13 +51,14 @@ func EnsureIndexes(im IndexManager, indexes map[string]string, log *logger.UPPLo
 
 // EnsureConstraints will, for a map of labels and properties, check whether a constraint exists for a given property on a given label, and
 // if missing will create one. Creating the unique constraint ensures an index automatically.
+// Labels are handled in sorted order, and a constraint created concurrently by another instance is not an error.
 func EnsureConstraints(im IndexManager, indexes map[string]string, log *logger.UPPLogger) error {
 	// log is an optional parameter
 	if log == nil {
 		log = logger.NewUPPInfoLogger("neo-utils-go")
 	}
-	for label, propertyName := range indexes {
-		err := ensureConstraint(im, label, propertyName, log)
+	for _, label := range sortedKeys(indexes) {
+		err := ensureConstraint(im, label, indexes[label], log)
 		if err != nil { // stop as soon as something goes wrong
 			return err
 		}
@@ -97,25 +67,18 @@ func EnsureConstraints(im IndexManager, indexes map[string]string, log *logger.U
 }
 
 func ensureIndex(im IndexManager, label string, propertyName string, log *logger.UPPLogger) error {
-
-	indexes, err := im.Indexes(label)
-
-	var indexFound bool
-
+	index, err := getIndex(im, label, propertyName)
 	if err != nil && err != neoism.NotFound {
 		return err
 	}
 
-	for _, index := range indexes {
-		if len(index.PropertyKeys) == 1 && index.PropertyKeys[0] == propertyName {
-			indexFound = true
-			break
-		}
-	}
-
-	if !indexFound {
+	if index == nil {
 		log.Infof("Creating index for type %s on property %s\n", label, propertyName)
 		_, err := im.CreateIndex(label, propertyName)
+		if isEquivalentSchemaRule(err) {
+			log.Infof("Index for type %s on property %s already created\n", label, propertyName)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -131,6 +94,10 @@ func ensureConstraint(im IndexManager, label string, propertyName string, log *l
 		if err == neoism.NotFound {
 			log.Infof("Creating unique constraint for type %s on property %s\n", label, propertyName)
 			_, err = im.CreateUniqueConstraint(label, propertyName)
+			if isEquivalentSchemaRule(err) {
+				log.Infof("Unique constraint for type %s on property %s already created\n", label, propertyName)
+				return nil
+			}
 			if err != nil {
 				return fmt.Errorf("cannot create constraint for type %s on property %s\n:, %w", label, propertyName, err)
 			}
@@ -141,6 +108,7 @@ func ensureConstraint(im IndexManager, label string, propertyName string, log *l
 
 }
 
+// getIndex returns the single property index on a label, or nil if there is none.
 func getIndex(im IndexManager, label string, propertyName string) (*neoism.Index, error) {
 	indexes, err := im.Indexes(label)
 
@@ -73,6 +73,48 @@ func TestCheckErrorsIfCannotConnectToNeo4j(t *testing.T) {
 	assert.Error(t, err, "Didn't get expected error")
 }
 
+func TestEnsureIndexesAndConstraintsAreOrderedAndToleratePeers(t *testing.T) {
+	l := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+	im := &recordingIndexManager{
+		createErr: newNeo4jError("Neo.ClientError.Schema.EquivalentSchemaRuleAlreadyExists", "An equivalent index already exists", 0),
+	}
+	m := map[string]string{"Thing": "uuid", "Concept": "uuid", "Brand": "uuid", "Person": "uuid"}
+
+	assert.NoError(t, EnsureIndexes(im, m, l))
+	assert.NoError(t, EnsureConstraints(im, m, l))
+	assert.Equal(t, []string{
+		"index Brand.uuid", "index Concept.uuid", "index Person.uuid", "index Thing.uuid",
+		"constraint Brand.uuid", "constraint Concept.uuid", "constraint Person.uuid", "constraint Thing.uuid",
+	}, im.created)
+
+	im.createErr = newNeo4jError("Neo.ClientError.Schema.IndexAlreadyExists", "There already exists an index", 0)
+	assert.Error(t, EnsureIndexes(im, m, l))
+}
+
+// recordingIndexManager has no indexes or constraints, and records attempts to create them.
+type recordingIndexManager struct {
+	created   []string
+	createErr error
+}
+
+func (im *recordingIndexManager) CreateIndex(label string, propertyName string) (*neoism.Index, error) {
+	im.created = append(im.created, "index "+label+"."+propertyName)
+	return nil, im.createErr
+}
+
+func (im *recordingIndexManager) Indexes(label string) ([]*neoism.Index, error) {
+	return nil, neoism.NotFound
+}
+
+func (im *recordingIndexManager) CreateUniqueConstraint(label string, propertyName string) (*neoism.UniqueConstraint, error) {
+	im.created = append(im.created, "constraint "+label+"."+propertyName)
+	return nil, im.createErr
+}
+
+func (im *recordingIndexManager) UniqueConstraints(label string, propertyName string) ([]*neoism.UniqueConstraint, error) {
+	return nil, neoism.NotFound
+}
+
 type mockIndexManager struct {
 	existingIndexes     []*neoism.Index
 	existingConstraints []*neoism.UniqueConstraint
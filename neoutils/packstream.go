@@ -0,0 +1,368 @@
+package neoutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// PackStream is the binary serialisation format used by the Bolt protocol.
+// Only the subset needed to send cypher parameters and read results is
+// implemented here.
+
+const (
+	psNull     = 0xC0
+	psFloat64  = 0xC1
+	psFalse    = 0xC2
+	psTrue     = 0xC3
+	psInt8     = 0xC8
+	psInt16    = 0xC9
+	psInt32    = 0xCA
+	psInt64    = 0xCB
+	psBytes8   = 0xCC
+	psBytes16  = 0xCD
+	psBytes32  = 0xCE
+	psString8  = 0xD0
+	psString16 = 0xD1
+	psString32 = 0xD2
+	psList8    = 0xD4
+	psList16   = 0xD5
+	psList32   = 0xD6
+	psMap8     = 0xD8
+	psMap16    = 0xD9
+	psMap32    = 0xDA
+
+	psTinyString = 0x80
+	psTinyList   = 0x90
+	psTinyMap    = 0xA0
+	psTinyStruct = 0xB0
+)
+
+var errPackStreamTruncated = errors.New("packstream: unexpected end of data")
+
+// packStreamStruct is a PackStream structure: a tagged, fixed size list of
+// fields. Bolt messages, nodes, relationships and temporal values are all
+// encoded as structures.
+type packStreamStruct struct {
+	Tag    byte
+	Fields []interface{}
+}
+
+type packer struct {
+	buf []byte
+}
+
+func (p *packer) packStruct(tag byte, fields ...interface{}) error {
+	if len(fields) > 15 {
+		return fmt.Errorf("packstream: too many structure fields (%d)", len(fields))
+	}
+	p.buf = append(p.buf, psTinyStruct|byte(len(fields)), tag)
+	for _, f := range fields {
+		if err := p.pack(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *packer) pack(v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		p.buf = append(p.buf, psNull)
+	case bool:
+		if x {
+			p.buf = append(p.buf, psTrue)
+		} else {
+			p.buf = append(p.buf, psFalse)
+		}
+	case int:
+		p.packInt(int64(x))
+	case int8:
+		p.packInt(int64(x))
+	case int16:
+		p.packInt(int64(x))
+	case int32:
+		p.packInt(int64(x))
+	case int64:
+		p.packInt(x)
+	case uint8:
+		p.packInt(int64(x))
+	case uint16:
+		p.packInt(int64(x))
+	case uint32:
+		p.packInt(int64(x))
+	case float32:
+		p.packFloat(float64(x))
+	case float64:
+		p.packFloat(x)
+	case string:
+		p.packHeader(len(x), psTinyString, psString8, psString16, psString32)
+		p.buf = append(p.buf, x...)
+	case []byte:
+		p.packBytes(x)
+	case []string:
+		p.packHeader(len(x), psTinyList, psList8, psList16, psList32)
+		for _, s := range x {
+			p.pack(s)
+		}
+	case []interface{}:
+		p.packHeader(len(x), psTinyList, psList8, psList16, psList32)
+		for _, e := range x {
+			if err := p.pack(e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		p.packHeader(len(x), psTinyMap, psMap8, psMap16, psMap32)
+		for k, e := range x {
+			p.pack(k)
+			if err := p.pack(e); err != nil {
+				return err
+			}
+		}
+	case *packStreamStruct:
+		return p.packStruct(x.Tag, x.Fields...)
+	default:
+		return fmt.Errorf("packstream: cannot pack value of type %v", reflect.TypeOf(v))
+	}
+	return nil
+}
+
+func (p *packer) packInt(i int64) {
+	switch {
+	case i >= -16 && i <= 127:
+		p.buf = append(p.buf, byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		p.buf = append(p.buf, psInt8, byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		p.buf = append(p.buf, psInt16)
+		p.buf = appendUint16(p.buf, uint16(int16(i)))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		p.buf = append(p.buf, psInt32)
+		p.buf = appendUint32(p.buf, uint32(int32(i)))
+	default:
+		p.buf = append(p.buf, psInt64)
+		p.buf = appendUint64(p.buf, uint64(i))
+	}
+}
+
+func (p *packer) packFloat(f float64) {
+	p.buf = append(p.buf, psFloat64)
+	p.buf = appendUint64(p.buf, math.Float64bits(f))
+}
+
+func (p *packer) packBytes(b []byte) {
+	switch {
+	case len(b) <= math.MaxUint8:
+		p.buf = append(p.buf, psBytes8, byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		p.buf = append(p.buf, psBytes16)
+		p.buf = appendUint16(p.buf, uint16(len(b)))
+	default:
+		p.buf = append(p.buf, psBytes32)
+		p.buf = appendUint32(p.buf, uint32(len(b)))
+	}
+	p.buf = append(p.buf, b...)
+}
+
+func (p *packer) packHeader(n int, tiny, m8, m16, m32 byte) {
+	switch {
+	case n < 16:
+		p.buf = append(p.buf, tiny|byte(n))
+	case n <= math.MaxUint8:
+		p.buf = append(p.buf, m8, byte(n))
+	case n <= math.MaxUint16:
+		p.buf = append(p.buf, m16)
+		p.buf = appendUint16(p.buf, uint16(n))
+	default:
+		p.buf = append(p.buf, m32)
+		p.buf = appendUint32(p.buf, uint32(n))
+	}
+}
+
+type unpacker struct {
+	buf []byte
+	pos int
+}
+
+func (u *unpacker) next(n int) ([]byte, error) {
+	if n < 0 || u.pos+n > len(u.buf) {
+		return nil, errPackStreamTruncated
+	}
+	b := u.buf[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpacker) size(n int) (int, error) {
+	b, err := u.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+// unpack decodes the next value. Integers are returned as int64, floats as
+// float64, lists as []interface{}, maps as map[string]interface{} and
+// structures as *packStreamStruct.
+func (u *unpacker) unpack() (interface{}, error) {
+	b, err := u.next(1)
+	if err != nil {
+		return nil, err
+	}
+	marker := b[0]
+
+	switch {
+	case marker < 0x80 || marker >= 0xF0:
+		return int64(int8(marker)), nil
+	case marker&0xF0 == psTinyString:
+		return u.unpackString(int(marker & 0x0F))
+	case marker&0xF0 == psTinyList:
+		return u.unpackList(int(marker & 0x0F))
+	case marker&0xF0 == psTinyMap:
+		return u.unpackMap(int(marker & 0x0F))
+	case marker&0xF0 == psTinyStruct:
+		return u.unpackStruct(int(marker & 0x0F))
+	}
+
+	switch marker {
+	case psNull:
+		return nil, nil
+	case psFalse:
+		return false, nil
+	case psTrue:
+		return true, nil
+	case psFloat64:
+		b, err := u.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case psInt8:
+		b, err := u.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int8(b[0])), nil
+	case psInt16:
+		b, err := u.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int16(binary.BigEndian.Uint16(b))), nil
+	case psInt32:
+		b, err := u.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int32(binary.BigEndian.Uint32(b))), nil
+	case psInt64:
+		b, err := u.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case psBytes8, psBytes16, psBytes32:
+		n, err := u.size(1 << (marker - psBytes8))
+		if err != nil {
+			return nil, err
+		}
+		b, err := u.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case psString8, psString16, psString32:
+		n, err := u.size(1 << (marker - psString8))
+		if err != nil {
+			return nil, err
+		}
+		return u.unpackString(n)
+	case psList8, psList16, psList32:
+		n, err := u.size(1 << (marker - psList8))
+		if err != nil {
+			return nil, err
+		}
+		return u.unpackList(n)
+	case psMap8, psMap16, psMap32:
+		n, err := u.size(1 << (marker - psMap8))
+		if err != nil {
+			return nil, err
+		}
+		return u.unpackMap(n)
+	}
+	return nil, fmt.Errorf("packstream: unknown marker 0x%02X", marker)
+}
+
+func (u *unpacker) unpackString(n int) (string, error) {
+	b, err := u.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (u *unpacker) unpackList(n int) ([]interface{}, error) {
+	l := make([]interface{}, n)
+	for i := range l {
+		v, err := u.unpack()
+		if err != nil {
+			return nil, err
+		}
+		l[i] = v
+	}
+	return l, nil
+}
+
+func (u *unpacker) unpackMap(n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := u.unpack()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("packstream: map key must be a string, got %T", k)
+		}
+		v, err := u.unpack()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+func (u *unpacker) unpackStruct(n int) (*packStreamStruct, error) {
+	b, err := u.next(1)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := u.unpackList(n)
+	if err != nil {
+		return nil, err
+	}
+	return &packStreamStruct{Tag: b[0], Fields: fields}, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,72 @@
+package neoutils
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackStreamRoundTrip(t *testing.T) {
+	values := []interface{}{
+		nil,
+		true,
+		false,
+		int64(0),
+		int64(-16),
+		int64(127),
+		int64(-17),
+		int64(-128),
+		int64(128),
+		int64(math.MinInt16),
+		int64(math.MaxInt16 + 1),
+		int64(math.MinInt32 - 1),
+		int64(math.MaxInt64),
+		1.5,
+		"",
+		"hello",
+		strings.Repeat("x", 300),
+		[]byte{1, 2, 3},
+		[]interface{}{int64(1), "two", []interface{}{3.0}},
+		map[string]interface{}{"a": int64(1), "b": map[string]interface{}{"c": nil}},
+		&packStreamStruct{Tag: 'N', Fields: []interface{}{int64(1), []interface{}{"Thing"}, map[string]interface{}{}}},
+	}
+
+	for _, v := range values {
+		p := packer{}
+		assert.NoError(t, p.pack(v))
+		u := unpacker{buf: p.buf}
+		got, err := u.unpack()
+		assert.NoError(t, err)
+		assert.Equal(t, v, got)
+		assert.Equal(t, len(p.buf), u.pos, "trailing bytes for %v", v)
+	}
+}
+
+func TestPackStreamIntegerEncodings(t *testing.T) {
+	cases := map[int64][]byte{
+		1:    {0x01},
+		-16:  {0xF0},
+		-17:  {psInt8, 0xEF},
+		200:  {psInt16, 0x00, 0xC8},
+		1e6:  {psInt32, 0x00, 0x0F, 0x42, 0x40},
+		1e10: {psInt64, 0x00, 0x00, 0x00, 0x02, 0x54, 0x0B, 0xE4, 0x00},
+	}
+	for i, expected := range cases {
+		p := packer{}
+		p.packInt(i)
+		assert.Equal(t, expected, p.buf, "encoding of %d", i)
+	}
+}
+
+func TestPackStreamUnsupportedType(t *testing.T) {
+	p := packer{}
+	assert.Error(t, p.pack(struct{}{}))
+}
+
+func TestUnpackTruncated(t *testing.T) {
+	u := unpacker{buf: []byte{psString8, 0x05, 'a'}}
+	_, err := u.unpack()
+	assert.Equal(t, errPackStreamTruncated, err)
+}
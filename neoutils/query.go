@@ -0,0 +1,190 @@
+package neoutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// ErrNoRows is wrapped by the error QueryOne returns when there are no rows.
+var ErrNoRows = errors.New("neoutils: query returned no rows")
+
+// ErrTooManyRows is wrapped by the error QueryOne returns when there is more
+// than one row.
+var ErrTooManyRows = errors.New("neoutils: query returned more than one row")
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// Query runs a read-only statement in a read transaction, on a follower or
+// read replica if cr routes reads, and decodes its rows into result, which
+// must be a pointer to a slice.
+//
+// Rows are decoded into structs by matching columns to `json` tags, as
+// neoism.CypherQuery.Result is, but strictly: a column without a field, or a
+// field without a column, is an error. Fields tagged omitempty may have no
+// column. Rows are decoded into other types, such as string, from their only
+// column.
+func Query(ctx context.Context, cr CypherRunner, statement string, params map[string]interface{}, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("neoutils: Query needs a pointer to a slice, not %T", result)
+	}
+	rows, err := queryRows(ctx, cr, statement, params)
+	if err != nil {
+		return err
+	}
+	decoded, err := decodeRows(rows, rv.Elem().Type())
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(decoded)
+	return nil
+}
+
+// QueryOne runs a read-only statement as Query does, decoding its only row
+// into result, which must be a pointer. The error wraps ErrNoRows or
+// ErrTooManyRows unless there is exactly one row.
+func QueryOne(ctx context.Context, cr CypherRunner, statement string, params map[string]interface{}, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("neoutils: QueryOne needs a pointer, not %T", result)
+	}
+	rows, err := queryRows(ctx, cr, statement, params)
+	if err != nil {
+		return err
+	}
+	switch len(rows) {
+	case 0:
+		return ErrNoRows
+	case 1:
+	default:
+		return fmt.Errorf("%w: got %d", ErrTooManyRows, len(rows))
+	}
+	decoded, err := decodeRows(rows, reflect.SliceOf(rv.Elem().Type()))
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(decoded.Index(0))
+	return nil
+}
+
+func queryRows(ctx context.Context, cr CypherRunner, statement string, params map[string]interface{}) ([]map[string]json.RawMessage, error) {
+	var rows []map[string]json.RawMessage
+	err := readCypherBatchContext(ctx, cr, []*neoism.CypherQuery{{
+		Statement:  statement,
+		Parameters: params,
+		Result:     &rows,
+	}})
+	return rows, err
+}
+
+// decodeRows returns a slice of sliceType holding the decoded rows.
+func decodeRows(rows []map[string]json.RawMessage, sliceType reflect.Type) (reflect.Value, error) {
+	elemType := sliceType.Elem()
+	structType := elemType
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	// types that decode themselves, such as time.Time, come from a single column
+	byColumn := structType.Kind() == reflect.Struct && !reflect.PtrTo(structType).Implements(jsonUnmarshalerType)
+
+	out := reflect.MakeSlice(sliceType, len(rows), len(rows))
+	for i, row := range rows {
+		var b []byte
+		if byColumn {
+			if i == 0 {
+				if err := checkColumns(row, structType); err != nil {
+					return reflect.Value{}, err
+				}
+			}
+			var err error
+			if b, err = json.Marshal(row); err != nil {
+				return reflect.Value{}, err
+			}
+		} else {
+			if len(row) != 1 {
+				return reflect.Value{}, fmt.Errorf("neoutils: cannot decode %d columns into %v", len(row), elemType)
+			}
+			for _, value := range row {
+				b = value
+			}
+		}
+		v := reflect.New(elemType)
+		if err := json.Unmarshal(b, v.Interface()); err != nil {
+			return reflect.Value{}, fmt.Errorf("neoutils: row %d: %w", i, err)
+		}
+		out.Index(i).Set(v.Elem())
+	}
+	return out, nil
+}
+
+// checkColumns verifies that the columns and the struct's fields match, case
+// insensitively as encoding/json matches them.
+func checkColumns(row map[string]json.RawMessage, t reflect.Type) error {
+	fields := map[string]bool{}
+	jsonFields(t, fields)
+
+	columns := make([]string, 0, len(row))
+	for c := range row {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+	seen := map[string]bool{}
+	for _, c := range columns {
+		if _, ok := fields[strings.ToLower(c)]; !ok {
+			return fmt.Errorf("neoutils: column %s has no field in %v", c, t)
+		}
+		seen[strings.ToLower(c)] = true
+	}
+
+	var missing []string
+	for name, required := range fields {
+		if required && !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("neoutils: no column for %s in %v", strings.Join(missing, ", "), t)
+	}
+	return nil
+}
+
+// jsonFields adds the lower case names encoding/json decodes into t to
+// fields, mapped to whether they are required.
+func jsonFields(t reflect.Type, fields map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, opts = tag[:comma], tag[comma:]
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				jsonFields(ft, fields)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = !strings.Contains(opts, ",omitempty")
+	}
+}
@@ -0,0 +1,103 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConcept struct {
+	UUID      string   `json:"uuid"`
+	PrefLabel string   `json:"prefLabel"`
+	Aliases   []string `json:"aliases,omitempty"`
+}
+
+func TestQueryDecodesRows(t *testing.T) {
+	cr := &schemaListingRunner{rows: map[string]string{
+		"concepts": `[{"uuid": "1", "prefLabel": "One", "aliases": ["Uno"]}, {"uuid": "2", "prefLabel": "Two"}]`,
+		"labels":   `[{"label": "One"}, {"label": "Two"}]`,
+		"none":     `[]`,
+	}}
+
+	var concepts []testConcept
+	assert.NoError(t, Query(context.Background(), cr, "concepts", nil, &concepts))
+	assert.Equal(t, []testConcept{{"1", "One", []string{"Uno"}}, {"2", "Two", nil}}, concepts)
+
+	var pointers []*testConcept
+	assert.NoError(t, Query(context.Background(), cr, "concepts", nil, &pointers))
+	assert.Equal(t, "Two", pointers[1].PrefLabel)
+
+	var labels []string
+	assert.NoError(t, Query(context.Background(), cr, "labels", nil, &labels))
+	assert.Equal(t, []string{"One", "Two"}, labels)
+
+	assert.NoError(t, Query(context.Background(), cr, "none", nil, &concepts))
+	assert.Empty(t, concepts)
+
+	assert.Error(t, Query(context.Background(), cr, "concepts", nil, concepts))
+}
+
+func TestQueryChecksColumns(t *testing.T) {
+	cr := &schemaListingRunner{rows: map[string]string{
+		"extra":   `[{"uuid": "1", "prefLabel": "One", "type": "Person"}]`,
+		"missing": `[{"uuid": "1"}]`,
+		"wrong":   `[{"uuid": 1, "prefLabel": "One"}]`,
+	}}
+
+	var concepts []testConcept
+	assert.EqualError(t, Query(context.Background(), cr, "extra", nil, &concepts), "neoutils: column type has no field in neoutils.testConcept")
+	assert.EqualError(t, Query(context.Background(), cr, "missing", nil, &concepts), "neoutils: no column for preflabel in neoutils.testConcept")
+	assert.Error(t, Query(context.Background(), cr, "wrong", nil, &concepts))
+
+	var labels []string
+	assert.EqualError(t, Query(context.Background(), cr, "extra", nil, &labels), "neoutils: cannot decode 3 columns into string")
+}
+
+func TestQueryOne(t *testing.T) {
+	cr := &schemaListingRunner{rows: map[string]string{
+		"one":  `[{"uuid": "1", "prefLabel": "One"}]`,
+		"two":  `[{"uuid": "1", "prefLabel": "One"}, {"uuid": "2", "prefLabel": "Two"}]`,
+		"none": `[]`,
+		"time": `[{"at": "2020-01-02T03:04:05Z"}]`,
+	}}
+
+	var concept testConcept
+	assert.NoError(t, QueryOne(context.Background(), cr, "one", nil, &concept))
+	assert.Equal(t, testConcept{UUID: "1", PrefLabel: "One"}, concept)
+
+	err := QueryOne(context.Background(), cr, "two", nil, &concept)
+	assert.True(t, errors.Is(err, ErrTooManyRows), "got %v", err)
+	assert.Equal(t, ErrNoRows, QueryOne(context.Background(), cr, "none", nil, &concept))
+
+	var at time.Time
+	assert.NoError(t, QueryOne(context.Background(), cr, "time", nil, &at))
+	assert.Equal(t, 2020, at.Year())
+}
+
+func TestQueryUsesReadTransactions(t *testing.T) {
+	cr := &readRecordingRunner{schemaListingRunner{rows: map[string]string{"one": `[{"n": 1}]`}}, 0}
+
+	var n int
+	assert.NoError(t, QueryOne(context.Background(), cr, "one", nil, &n))
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, cr.reads)
+}
+
+// readRecordingRunner counts the batches run with ReadCypherBatchContext.
+type readRecordingRunner struct {
+	schemaListingRunner
+	reads int
+}
+
+func (cr *readRecordingRunner) ReadCypherBatch(queries []*neoism.CypherQuery) error {
+	return cr.ReadCypherBatchContext(context.Background(), queries)
+}
+
+func (cr *readRecordingRunner) ReadCypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	cr.reads++
+	return cr.CypherBatch(queries)
+}
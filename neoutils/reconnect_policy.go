@@ -0,0 +1,77 @@
+package neoutils
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const defaultReconnectDelay = 30 * time.Second
+
+// ErrGaveUpConnecting is wrapped by the error returned from a background
+// connection that has used up ReconnectPolicy.MaxAttempts.
+var ErrGaveUpConnecting = errors.New("gave up connecting to neo4j")
+
+// ReconnectPolicy controls how often a background connection retries after
+// failing to connect. The zero value retries every 30 seconds forever.
+type ReconnectPolicy struct {
+	// InitialDelay is the delay after the first failed attempt.
+	InitialDelay time.Duration
+	// Multiplier grows the delay after each further failed attempt. Values
+	// up to 1 keep the delay fixed.
+	Multiplier float64
+	// MaxDelay caps the delay between attempts. 0 means no cap.
+	MaxDelay time.Duration
+	// Jitter randomises each delay by up to this fraction of it, e.g. 0.2
+	// for +/-20%, so that many instances don't all retry at once.
+	Jitter float64
+	// MaxAttempts is the number of consecutive failed attempts after which
+	// the connection gives up, and all further calls fail with an error
+	// wrapping ErrGaveUpConnecting. 0 retries forever. Failing to apply
+	// schema once connected isn't counted, so is retried forever.
+	MaxAttempts int
+}
+
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		MaxDelay:     30 * time.Second,
+		Jitter:       0.2,
+	}
+}
+
+// delay returns how long to wait after the given number of consecutive failed
+// attempts, which starts at 1.
+func (p ReconnectPolicy) delay(attempt int) time.Duration {
+	initial := p.InitialDelay
+	if initial <= 0 {
+		initial = defaultReconnectDelay
+	}
+	return backoff(initial, p.Multiplier, p.MaxDelay, p.Jitter, attempt)
+}
+
+// backoff returns initial grown by multiplier for each attempt after the
+// first, capped at max if it is set, and randomised by jitter.
+func backoff(initial time.Duration, multiplier float64, max time.Duration, jitter float64, attempt int) time.Duration {
+	d := float64(initial)
+	if multiplier > 1 && attempt > 1 {
+		d *= math.Pow(multiplier, float64(attempt-1))
+	}
+	if max > 0 && d > float64(max) {
+		d = float64(max)
+	}
+	if jitter > 0 {
+		d *= 1 + jitter*(2*rand.Float64()-1)
+	}
+	// without a cap, the delay soon grows too large for a Duration
+	if d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+func (p ReconnectPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
@@ -0,0 +1,50 @@
+package neoutils
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectPolicyZeroValueIsFixed(t *testing.T) {
+	p := ReconnectPolicy{}
+	for attempt := 1; attempt < 5; attempt++ {
+		assert.Equal(t, 30*time.Second, p.delay(attempt))
+	}
+	assert.False(t, p.exhausted(1000))
+}
+
+func TestReconnectPolicyBacksOffUpToMaxDelay(t *testing.T) {
+	p := ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range expected {
+		assert.Equal(t, d, p.delay(i+1), "attempt %d", i+1)
+	}
+}
+
+func TestReconnectPolicyWithoutMaxDelayDoesNotOverflow(t *testing.T) {
+	p := ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: 0.2}
+	previous := time.Duration(0)
+	for _, attempt := range []int{30, 34, 40, 100, 2000} {
+		d := p.delay(attempt)
+		assert.True(t, d > 0 && d >= previous, "attempt %d: %s", attempt, d)
+		previous = d
+	}
+	assert.Equal(t, time.Duration(math.MaxInt64), p.delay(2000))
+}
+
+func TestReconnectPolicyJitter(t *testing.T) {
+	p := ReconnectPolicy{InitialDelay: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := p.delay(1)
+		assert.True(t, d >= 500*time.Millisecond && d <= 1500*time.Millisecond, "delay %s out of range", d)
+	}
+}
+
+func TestReconnectPolicyMaxAttempts(t *testing.T) {
+	p := ReconnectPolicy{MaxAttempts: 3}
+	assert.False(t, p.exhausted(2))
+	assert.True(t, p.exhausted(3))
+}
@@ -0,0 +1,128 @@
+package neoutils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/rcrowley/go-metrics"
+)
+
+// RetryPolicy controls how batches that fail with a transient error, such as
+// a deadlock or a cluster leader change, are retried. The zero value never
+// retries.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a batch is run, including the first.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry.
+	InitialDelay time.Duration
+	// Multiplier grows the delay before each further retry. Values up to 1
+	// keep the delay fixed.
+	Multiplier float64
+	// MaxDelay caps the delay between retries. 0 means no cap.
+	MaxDelay time.Duration
+	// Jitter randomises each delay by up to this fraction of it.
+	Jitter float64
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: 100 * time.Millisecond,
+		Multiplier:   2,
+		MaxDelay:     time.Second,
+		Jitter:       0.2,
+	}
+}
+
+// delay returns how long to wait after the given number of failed attempts,
+// which starts at 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	return backoff(p.InitialDelay, p.Multiplier, p.MaxDelay, p.Jitter, attempt)
+}
+
+// RetryingCypherRunner runs batches with another CypherRunner, running them
+// again when they fail with an error for which IsRetryable is true.
+type RetryingCypherRunner struct {
+	cr     CypherRunner
+	policy RetryPolicy
+}
+
+func NewRetryingCypherRunner(cr CypherRunner, policy RetryPolicy) CypherRunner {
+	return &RetryingCypherRunner{cr, policy}
+}
+
+func (rcr *RetryingCypherRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	return rcr.CypherBatchContext(context.Background(), queries)
+}
+
+// CypherBatchContext runs the queries, retrying transient failures until the
+// policy's attempts are used up or ctx is done.
+func (rcr *RetryingCypherRunner) CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return rcr.retry(ctx, func() error {
+		return cypherBatchContext(ctx, rcr.cr, queries)
+	})
+}
+
+func (rcr *RetryingCypherRunner) ReadCypherBatch(queries []*neoism.CypherQuery) error {
+	return rcr.ReadCypherBatchContext(context.Background(), queries)
+}
+
+// ReadCypherBatchContext runs read-only queries as the underlying runner
+// does, retrying them as CypherBatchContext does.
+func (rcr *RetryingCypherRunner) ReadCypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	return rcr.retry(ctx, func() error {
+		return readCypherBatchContext(ctx, rcr.cr, queries)
+	})
+}
+
+func (rcr *RetryingCypherRunner) retry(ctx context.Context, run func() error) error {
+	return retry(ctx, rcr.policy, "batch", run)
+}
+
+// retry calls run until it succeeds, fails with an error that isn't
+// retryable, or the policy's attempts are used up. Retries are counted by the
+// <name>Retries and <name>RetriesExhausted metrics.
+func retry(ctx context.Context, policy RetryPolicy, name string, run func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			if attempt > 1 {
+				metrics.GetOrRegisterCounter(name+"RetriesExhausted", metrics.DefaultRegistry).Inc(1)
+			}
+			return err
+		}
+
+		metrics.GetOrRegisterCounter(name+"Retries", metrics.DefaultRegistry).Inc(1)
+		select {
+		case <-time.After(policy.delay(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// BeginTx begins a transaction with the underlying runner. Its queries are
+// not retried, as a failed query ends the transaction; see WithTransaction.
+func (rcr *RetryingCypherRunner) BeginTx(ctx context.Context) (Tx, error) {
+	return beginTx(ctx, rcr.cr)
+}
+
+// Close closes the underlying runner.
+func (rcr *RetryingCypherRunner) Close(ctx context.Context) error {
+	return closeRunner(ctx, rcr.cr)
+}
+
+func (rcr *RetryingCypherRunner) String() string {
+	return fmt.Sprintf("RetryingCypherRunner(%v)", rcr.cr)
+}
+
+var _ ContextCypherRunner = (*RetryingCypherRunner)(nil)
+var _ ReadCypherRunner = (*RetryingCypherRunner)(nil)
+var _ TxBeginner = (*RetryingCypherRunner)(nil)
+var _ Closer = (*RetryingCypherRunner)(nil)
@@ -0,0 +1,92 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryingRunnerRetriesTransientErrors(t *testing.T) {
+	retries := metrics.GetOrRegisterCounter("batchRetries", metrics.DefaultRegistry)
+	before := retries.Count()
+
+	fr := &flakyRunner{failures: 2, err: newNeo4jError("Neo.TransientError.Transaction.DeadlockDetected", "deadlock", -1)}
+	rcr := NewRetryingCypherRunner(fr, RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond})
+
+	assert.NoError(t, rcr.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}}))
+	assert.Equal(t, 3, fr.attempts)
+	assert.Equal(t, int64(2), retries.Count()-before)
+}
+
+func TestRetryPolicyDelayDoesNotOverflow(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 1000, InitialDelay: 100 * time.Millisecond, Multiplier: 2}
+	assert.Equal(t, 200*time.Millisecond, p.delay(2))
+	for _, attempt := range []int{40, 100, 999} {
+		assert.Equal(t, time.Duration(math.MaxInt64), p.delay(attempt), "attempt %d", attempt)
+	}
+}
+
+func TestRetryingRunnerGivesUpAfterMaxAttempts(t *testing.T) {
+	exhausted := metrics.GetOrRegisterCounter("batchRetriesExhausted", metrics.DefaultRegistry)
+	before := exhausted.Count()
+
+	fr := &flakyRunner{failures: 5, err: newNeo4jError("Neo.ClientError.Cluster.NotALeader", "not a leader", -1)}
+	rcr := NewRetryingCypherRunner(fr, RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond})
+
+	err := rcr.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}})
+	assert.True(t, IsRetryable(err))
+	assert.Equal(t, 3, fr.attempts)
+	assert.Equal(t, int64(1), exhausted.Count()-before)
+}
+
+func TestRetryingRunnerDoesNotRetryOtherErrors(t *testing.T) {
+	for _, err := range []error{
+		newNeo4jError("Neo.ClientError.Schema.ConstraintValidationFailed", "already exists", 0),
+		errors.New("connection refused"),
+	} {
+		fr := &flakyRunner{failures: 1, err: err}
+		rcr := NewRetryingCypherRunner(fr, RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond})
+
+		assert.Equal(t, err, rcr.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}}))
+		assert.Equal(t, 1, fr.attempts)
+	}
+}
+
+func TestRetryingRunnerZeroPolicyDoesNotRetry(t *testing.T) {
+	fr := &flakyRunner{failures: 1, err: newNeo4jError("Neo.TransientError.Transaction.DeadlockDetected", "deadlock", -1)}
+	rcr := NewRetryingCypherRunner(fr, RetryPolicy{})
+
+	assert.Error(t, rcr.CypherBatch([]*neoism.CypherQuery{{Statement: "First"}}))
+	assert.Equal(t, 1, fr.attempts)
+}
+
+func TestRetryingRunnerStopsWaitingWhenContextIsDone(t *testing.T) {
+	fr := &flakyRunner{failures: 1, err: newNeo4jError("Neo.TransientError.Transaction.DeadlockDetected", "deadlock", -1)}
+	rcr := NewRetryingCypherRunner(fr, RetryPolicy{MaxAttempts: 3, InitialDelay: time.Minute}).(*RetryingCypherRunner)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, rcr.CypherBatchContext(ctx, []*neoism.CypherQuery{{Statement: "First"}}))
+	assert.Equal(t, 1, fr.attempts)
+}
+
+// flakyRunner fails the first failures batches with err.
+type flakyRunner struct {
+	failures int
+	err      error
+	attempts int
+}
+
+func (fr *flakyRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	fr.attempts++
+	if fr.attempts <= fr.failures {
+		return fr.err
+	}
+	return nil
+}
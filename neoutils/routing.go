@@ -0,0 +1,420 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/jmcvetta/neoism"
+)
+
+// ErrNoLeader is returned for writes to a routing connection that has not
+// found a writable member of the cluster.
+var ErrNoLeader = errors.New("neoutils: no writable cluster member")
+
+var errNoMembers = errors.New("neoutils: no reachable cluster members")
+
+// RoutingNeoConnection sends writes to the leader of a Neo4j cluster and
+// read-only queries, made with ReadCypherBatch, to its followers and read
+// replicas in turn. Roles are found as CheckWritable finds them, and found
+// again in the background when the leader moves or a member fails.
+type RoutingNeoConnection struct {
+	urls    []string
+	connect func(neoURL string) (NeoConnection, error)
+	role    func(cr CypherRunner) (*WritableStatus, error)
+	policy  ReconnectPolicy
+	log     *logger.UPPLogger
+
+	lk      sync.RWMutex
+	members map[string]NeoConnection
+	leader  NeoConnection
+	readers []NeoConnection
+	next    uint64
+
+	needsDiscovery chan struct{}
+	stopOnce       sync.Once
+	stop           chan struct{}
+	stopped        chan struct{}
+}
+
+// ConnectRouting connects to each of the cluster members at neoURLs, which
+// are usually one URL per core member and read replica, and routes queries
+// between them. It fails if none of them can be reached. conf applies to the
+// connection to each member, except that BackgroundConnect is ignored and
+// ReconnectPolicy paces finding the roles again after a failure.
+func ConnectRouting(neoURLs []string, conf *ConnectionConfig, log *logger.UPPLogger) (*RoutingNeoConnection, error) {
+	if log == nil {
+		log = logger.NewUPPInfoLogger("neo-utils-go")
+	}
+	if conf == nil {
+		conf = DefaultConnectionConfig()
+	}
+	memberConf := *conf
+	memberConf.BackgroundConnect = false
+
+	r := newRoutingConnection(neoURLs, func(neoURL string) (NeoConnection, error) {
+		return connectDefault(neoURL, &memberConf, log)
+	}, func(cr CypherRunner) (*WritableStatus, error) {
+		return CheckWritableDatabase(cr, conf.Database)
+	}, conf.ReconnectPolicy, log)
+	if err := r.discover(); err != nil {
+		r.closeMembers(context.Background())
+		return nil, err
+	}
+	go r.discoveryLoop()
+	return r, nil
+}
+
+func newRoutingConnection(neoURLs []string, connect func(neoURL string) (NeoConnection, error), role func(cr CypherRunner) (*WritableStatus, error), policy ReconnectPolicy, log *logger.UPPLogger) *RoutingNeoConnection {
+	return &RoutingNeoConnection{
+		urls:           neoURLs,
+		connect:        connect,
+		role:           role,
+		policy:         policy,
+		log:            log,
+		members:        map[string]NeoConnection{},
+		needsDiscovery: make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+}
+
+// discover asks every member for its role, connecting to those without a
+// connection. Members that fail are dropped until the next discovery. It
+// fails if no member answered, or none is writable.
+func (r *RoutingNeoConnection) discover() error {
+	r.lk.RLock()
+	members := make(map[string]NeoConnection, len(r.members))
+	for u, conn := range r.members {
+		members[u] = conn
+	}
+	r.lk.RUnlock()
+
+	var leader NeoConnection
+	var leaderURL string
+	var readers []NeoConnection
+	var readerURLs []string
+	var lastErr error
+	for _, u := range r.urls {
+		conn, ok := members[u]
+		if !ok {
+			var err error
+			if conn, err = r.connect(u); err != nil {
+				r.log.WithError(err).Warnf("cannot connect to cluster member %s", u)
+				lastErr = err
+				continue
+			}
+			members[u] = conn
+		}
+		status, err := r.role(conn)
+		if err != nil {
+			r.log.WithError(err).Warnf("cannot find the role of cluster member %s", u)
+			lastErr = err
+			delete(members, u)
+			// it may be flushing queries, so don't wait for it
+			go closeRunner(context.Background(), conn)
+			continue
+		}
+		switch {
+		case status.Writable && leader == nil:
+			leader, leaderURL = conn, u
+		case status.Role == RoleFollower || status.Role == RoleReadReplica:
+			readers = append(readers, conn)
+			readerURLs = append(readerURLs, u)
+		}
+	}
+
+	r.lk.Lock()
+	r.members, r.leader, r.readers = members, leader, readers
+	r.lk.Unlock()
+
+	if len(members) == 0 {
+		return fmt.Errorf("%w: %v", errNoMembers, lastErr)
+	}
+	if leader == nil {
+		return ErrNoLeader
+	}
+	r.log.Infof("routing writes to %s and reads to %v", leaderURL, readerURLs)
+	return nil
+}
+
+// discoveryLoop finds the roles again whenever asked to, until it succeeds.
+func (r *RoutingNeoConnection) discoveryLoop() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.needsDiscovery:
+		case <-r.stop:
+			return
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := r.discover()
+			if err == nil {
+				break
+			}
+			delay := r.policy.delay(attempt)
+			r.log.WithError(err).Warnf("cannot route queries to the cluster. Trying again in %s", delay)
+			select {
+			case <-time.After(delay):
+			case <-r.stop:
+				return
+			}
+		}
+	}
+}
+
+// rediscover asks the discovery loop to find the roles again.
+func (r *RoutingNeoConnection) rediscover() {
+	select {
+	case r.needsDiscovery <- struct{}{}:
+	default:
+		// already queued
+	}
+}
+
+// route asks for the roles to be found again if err shows that the leader
+// moved or a member can't be reached, and returns err.
+func (r *RoutingNeoConnection) route(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	var neoErr *Neo4jError
+	if errors.As(err, &neoErr) {
+		switch neoErr.Code {
+		case "Neo.ClientError.Cluster.NotALeader", "Neo.ClientError.General.ForbiddenOnReadOnlyDatabase":
+			r.rediscover()
+		}
+		return err
+	}
+	// the server answered, or the queries were never sent, so the member
+	// is fine
+	if !isStatementError(err) && !isQueueError(err) {
+		r.rediscover()
+	}
+	return err
+}
+
+func (r *RoutingNeoConnection) writer() (NeoConnection, error) {
+	if r.isClosed() {
+		return nil, ErrClosed
+	}
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	if r.leader == nil {
+		r.rediscover()
+		return nil, ErrNoLeader
+	}
+	return r.leader, nil
+}
+
+// reader returns the next follower or read replica, or the leader if there
+// are none.
+func (r *RoutingNeoConnection) reader() (NeoConnection, error) {
+	if r.isClosed() {
+		return nil, ErrClosed
+	}
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	if len(r.readers) == 0 {
+		if r.leader == nil {
+			r.rediscover()
+			return nil, errNoMembers
+		}
+		return r.leader, nil
+	}
+	i := atomic.AddUint64(&r.next, 1)
+	return r.readers[i%uint64(len(r.readers))], nil
+}
+
+// CypherBatch runs the queries on the leader.
+func (r *RoutingNeoConnection) CypherBatch(queries []*neoism.CypherQuery) error {
+	return r.CypherBatchContext(context.Background(), queries)
+}
+
+func (r *RoutingNeoConnection) CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	conn, err := r.writer()
+	if err != nil {
+		return err
+	}
+	return r.route(cypherBatchContext(ctx, conn, queries))
+}
+
+// ReadCypherBatch runs read-only queries on a follower or read replica.
+// Reads may not see the latest writes, which take a moment to reach them.
+func (r *RoutingNeoConnection) ReadCypherBatch(queries []*neoism.CypherQuery) error {
+	return r.ReadCypherBatchContext(context.Background(), queries)
+}
+
+func (r *RoutingNeoConnection) ReadCypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	conn, err := r.reader()
+	if err != nil {
+		return err
+	}
+	return r.route(readCypherBatchContext(ctx, conn, queries))
+}
+
+// TrySubmit runs the queries on the leader, failing with ErrQueueFull rather
+// than waiting if its batch queue is full.
+func (r *RoutingNeoConnection) TrySubmit(ctx context.Context, queries []*neoism.CypherQuery) error {
+	conn, err := r.writer()
+	if err != nil {
+		return err
+	}
+	return r.route(trySubmit(ctx, conn, queries))
+}
+
+func (r *RoutingNeoConnection) Submit(queries []*neoism.CypherQuery) *Future {
+	return r.SubmitContext(context.Background(), queries)
+}
+
+// SubmitContext queues the queries on the leader, without waiting for them
+// to be written.
+func (r *RoutingNeoConnection) SubmitContext(ctx context.Context, queries []*neoism.CypherQuery) *Future {
+	conn, err := r.writer()
+	if err != nil {
+		return failedFuture(err)
+	}
+	return submit(ctx, conn, queries).chain(r.route)
+}
+
+// BeginTx begins an explicit transaction on the leader.
+func (r *RoutingNeoConnection) BeginTx(ctx context.Context) (Tx, error) {
+	conn, err := r.writer()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := beginTx(ctx, conn)
+	return tx, r.route(err)
+}
+
+func (r *RoutingNeoConnection) EnsureConstraints(constraints map[string]string) error {
+	conn, err := r.writer()
+	if err != nil {
+		return err
+	}
+	return r.route(conn.EnsureConstraints(constraints))
+}
+
+func (r *RoutingNeoConnection) EnsureIndexes(indexes map[string]string) error {
+	conn, err := r.writer()
+	if err != nil {
+		return err
+	}
+	return r.route(conn.EnsureIndexes(indexes))
+}
+
+// EnsureSchema creates the constraints and indexes that don't exist yet on
+// the leader, see the EnsureSchema function.
+func (r *RoutingNeoConnection) EnsureSchema(constraints []SchemaConstraint, indexes []SchemaIndex) error {
+	conn, err := r.writer()
+	if err != nil {
+		return err
+	}
+	se, ok := conn.(SchemaEnsurer)
+	if !ok {
+		return fmt.Errorf("%v cannot manage schema", conn)
+	}
+	return r.route(se.EnsureSchema(constraints, indexes))
+}
+
+// DiffSchema compares the declared constraints and indexes with the leader's,
+// see the DiffSchema function.
+func (r *RoutingNeoConnection) DiffSchema(constraints []SchemaConstraint, indexes []SchemaIndex) (*SchemaDiff, error) {
+	conn, err := r.writer()
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := conn.(SchemaDiffer)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot manage schema", conn)
+	}
+	diff, err := sd.DiffSchema(constraints, indexes)
+	return diff, r.route(err)
+}
+
+// PruneSchema drops the extra indexes and constraints of diff from the
+// leader, see the PruneSchema function.
+func (r *RoutingNeoConnection) PruneSchema(diff *SchemaDiff) error {
+	conn, err := r.writer()
+	if err != nil {
+		return err
+	}
+	sd, ok := conn.(SchemaDiffer)
+	if !ok {
+		return fmt.Errorf("%v cannot manage schema", conn)
+	}
+	return r.route(sd.PruneSchema(diff))
+}
+
+// Close stops finding roles and closes the connections to every member,
+// waiting until ctx is done for queries they have accepted to be written.
+func (r *RoutingNeoConnection) Close(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	select {
+	case <-r.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return r.closeMembers(ctx)
+}
+
+func (r *RoutingNeoConnection) closeMembers(ctx context.Context) error {
+	r.lk.Lock()
+	members := r.members
+	r.members, r.leader, r.readers = map[string]NeoConnection{}, nil, nil
+	r.lk.Unlock()
+
+	var firstErr error
+	for _, conn := range members {
+		if err := closeRunner(ctx, conn); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (r *RoutingNeoConnection) isClosed() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// address is the leader's, so that CheckWritable reports where writes go.
+func (r *RoutingNeoConnection) address() string {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	if a, ok := r.leader.(addresser); ok {
+		return a.address()
+	}
+	return ""
+}
+
+// unbatched is the leader's, or r itself while there is no leader.
+func (r *RoutingNeoConnection) unbatched() CypherRunner {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	if r.leader == nil {
+		return r
+	}
+	return unbatched(r.leader)
+}
+
+func (r *RoutingNeoConnection) String() string {
+	return fmt.Sprintf("RoutingNeoConnection(%v)", r.urls)
+}
+
+var _ NeoConnection = (*RoutingNeoConnection)(nil)
+var _ ContextCypherRunner = (*RoutingNeoConnection)(nil)
+var _ ReadCypherRunner = (*RoutingNeoConnection)(nil)
+var _ TxBeginner = (*RoutingNeoConnection)(nil)
+var _ Closer = (*RoutingNeoConnection)(nil)
+var _ SchemaEnsurer = (*RoutingNeoConnection)(nil)
+var _ SchemaDiffer = (*RoutingNeoConnection)(nil)
@@ -0,0 +1,208 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCluster is a set of mock members whose roles can be changed, recording
+// which member ran each batch.
+type testCluster struct {
+	lk      sync.Mutex
+	roles   map[string]string
+	members map[NeoConnection]string
+	ran     []string
+	// fail is returned by the named member's batches
+	fail map[string]error
+}
+
+func newTestCluster(roles map[string]string) *testCluster {
+	return &testCluster{roles: roles, members: map[NeoConnection]string{}, fail: map[string]error{}}
+}
+
+func (c *testCluster) connect(neoURL string) (NeoConnection, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if _, ok := c.roles[neoURL]; !ok {
+		return nil, errors.New("connection refused")
+	}
+	conn := newMockNeoConnection()
+	conn.cypherFunc = func(queries []*neoism.CypherQuery) error {
+		c.lk.Lock()
+		defer c.lk.Unlock()
+		c.ran = append(c.ran, neoURL)
+		return c.fail[neoURL]
+	}
+	c.members[conn] = neoURL
+	return conn, nil
+}
+
+func (c *testCluster) role(cr CypherRunner) (*WritableStatus, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	role := c.roles[c.members[cr.(NeoConnection)]]
+	return &WritableStatus{Role: role, Writable: role == RoleLeader}, nil
+}
+
+func (c *testCluster) set(neoURL string, role string, fail error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.roles[neoURL] = role
+	c.fail[neoURL] = fail
+}
+
+func (c *testCluster) runs() []string {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	ran := c.ran
+	c.ran = nil
+	return ran
+}
+
+func newTestRouting(c *testCluster, urls ...string) *RoutingNeoConnection {
+	return newRoutingConnection(urls, c.connect, c.role, ReconnectPolicy{InitialDelay: 10 * time.Millisecond}, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+}
+
+func TestRoutingSendsWritesToLeaderAndSpreadsReads(t *testing.T) {
+	c := newTestCluster(map[string]string{"core-1": RoleFollower, "core-2": RoleLeader, "replica-1": RoleReadReplica})
+	r := newTestRouting(c, "core-1", "core-2", "replica-1", "core-3")
+	assert.NoError(t, r.discover())
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, r.CypherBatch([]*neoism.CypherQuery{}))
+	}
+	assert.Equal(t, []string{"core-2", "core-2"}, c.runs())
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, r.ReadCypherBatch([]*neoism.CypherQuery{}))
+	}
+	assert.ElementsMatch(t, []string{"core-1", "core-1", "replica-1", "replica-1"}, c.runs())
+}
+
+func TestRoutingNeo5Cluster(t *testing.T) {
+	databases := `[
+		{"role": "primary", "writer": false, "address": "core-1:7687"},
+		{"role": "primary", "writer": true, "address": "core-2:7687"},
+		{"role": "secondary", "writer": false, "address": "replica-1:7687"}
+	]`
+	var lk sync.Mutex
+	var ran []string
+	connect := func(neoURL string) (NeoConnection, error) {
+		scripted := newScriptedRunner("5.13.0", "enterprise", `[]`, databases)
+		conn := newMockNeoConnection()
+		conn.cypherFunc = func(queries []*neoism.CypherQuery) error {
+			lk.Lock()
+			defer lk.Unlock()
+			if _, ok := scripted.rows[queries[0].Statement]; ok {
+				return scripted.CypherBatch(queries)
+			}
+			ran = append(ran, urlHost(neoURL))
+			return nil
+		}
+		return &neo5Member{conn, neoURL}, nil
+	}
+	r := newRoutingConnection([]string{"bolt://core-1:7687", "bolt://core-2:7687", "bolt://replica-1:7687"}, connect, func(cr CypherRunner) (*WritableStatus, error) {
+		return CheckWritableDatabase(cr, "neo4j")
+	}, ReconnectPolicy{InitialDelay: 10 * time.Millisecond}, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.NoError(t, r.discover())
+
+	query := []*neoism.CypherQuery{{Statement: "MATCH (n) RETURN n"}}
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, r.CypherBatch(query))
+	}
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, r.ReadCypherBatch(query))
+	}
+	assert.Equal(t, []string{"core-2:7687", "core-2:7687"}, ran[:2])
+	assert.ElementsMatch(t, []string{"core-1:7687", "core-1:7687", "replica-1:7687", "replica-1:7687"}, ran[2:])
+}
+
+// neo5Member is a member of a mocked Neo4j 5 cluster, whose address picks out
+// its row of SHOW DATABASE.
+type neo5Member struct {
+	*mockNeoConnection
+	url string
+}
+
+func (m *neo5Member) address() string {
+	return urlHost(m.url)
+}
+
+func TestRoutingReadsFromLeaderWithoutReaders(t *testing.T) {
+	c := newTestCluster(map[string]string{"neo4j": RoleLeader})
+	r := newTestRouting(c, "neo4j")
+	assert.NoError(t, r.discover())
+
+	assert.NoError(t, r.ReadCypherBatch([]*neoism.CypherQuery{}))
+	assert.Equal(t, []string{"neo4j"}, c.runs())
+}
+
+func TestRoutingFindsNewLeader(t *testing.T) {
+	c := newTestCluster(map[string]string{"core-1": RoleLeader, "core-2": RoleFollower})
+	r := newTestRouting(c, "core-1", "core-2")
+	assert.NoError(t, r.discover())
+	go r.discoveryLoop()
+	defer r.Close(context.Background())
+
+	// the leader moves, and the old one refuses writes
+	c.set("core-1", RoleFollower, newNeo4jError("Neo.ClientError.Cluster.NotALeader", "no longer the leader", 0))
+	c.set("core-2", RoleLeader, nil)
+	err := r.CypherBatch([]*neoism.CypherQuery{})
+	assert.True(t, errors.Is(err, ErrClientError), "got %v", err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.CypherBatch([]*neoism.CypherQuery{}) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("writes were not routed to the new leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ran := c.runs()
+	assert.Equal(t, "core-2", ran[len(ran)-1])
+}
+
+func TestRoutingWithoutLeader(t *testing.T) {
+	c := newTestCluster(map[string]string{"core-1": RoleFollower})
+	r := newTestRouting(c, "core-1")
+	assert.Equal(t, ErrNoLeader, r.discover())
+
+	assert.Equal(t, ErrNoLeader, r.CypherBatch([]*neoism.CypherQuery{}))
+	assert.NoError(t, r.ReadCypherBatch([]*neoism.CypherQuery{}))
+
+	r = newTestRouting(c, "core-3")
+	assert.True(t, errors.Is(r.discover(), errNoMembers))
+}
+
+func TestRoutingClose(t *testing.T) {
+	c := newTestCluster(map[string]string{"core-1": RoleLeader, "core-2": RoleFollower})
+	closed := make(chan *closableMockNeoConnection, 2)
+	r := newRoutingConnection([]string{"core-1", "core-2"}, func(neoURL string) (NeoConnection, error) {
+		conn, err := c.connect(neoURL)
+		if err != nil {
+			return nil, err
+		}
+		closable := &closableMockNeoConnection{conn.(*mockNeoConnection), closed}
+		c.members[closable] = neoURL
+		return closable, nil
+	}, c.role, ReconnectPolicy{}, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.NoError(t, r.discover())
+	go r.discoveryLoop()
+
+	assert.NoError(t, r.Close(context.Background()))
+	assert.Len(t, closed, 2)
+	assert.Equal(t, ErrClosed, r.CypherBatch([]*neoism.CypherQuery{}))
+	assert.Equal(t, ErrClosed, r.ReadCypherBatch([]*neoism.CypherQuery{}))
+}
+
+func TestConnectRoutingUnreachable(t *testing.T) {
+	conf := DefaultConnectionConfig()
+	_, err := ConnectRouting([]string{"bolt://127.0.0.1:1"}, conf, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.True(t, errors.Is(err, errNoMembers), "got %v", err)
+}
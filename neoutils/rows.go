@@ -0,0 +1,150 @@
+package neoutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+const defaultPageSize = 1000
+
+// PageOptions controls how QueryRows pages through a result.
+type PageOptions struct {
+	// PageSize is the number of rows fetched at a time, passed to the
+	// statement as $limit. 0 means 1000.
+	PageSize int
+	// KeyColumn selects keyset pagination: each page after the first is
+	// fetched with $after set to the KeyColumn value of the last row, and
+	// the statement should return the rows after it in key order. Otherwise
+	// the statement is passed $skip, the number of rows already fetched.
+	KeyColumn string
+	// After is the value of $after for the first page with KeyColumn. If it
+	// is nil, $after is null on the first page, and as nothing compares
+	// greater than null the statement must skip its key predicate then, e.g.
+	// WHERE $after IS NULL OR c.uuid > $after.
+	After interface{}
+}
+
+func (o PageOptions) pageSize() int {
+	if o.PageSize <= 0 {
+		return defaultPageSize
+	}
+	return o.PageSize
+}
+
+// Rows iterates over a result a page at a time, see QueryRows.
+type Rows struct {
+	ctx       context.Context
+	cr        CypherRunner
+	statement string
+	params    map[string]interface{}
+	opts      PageOptions
+
+	page    []map[string]json.RawMessage
+	i       int
+	fetched int
+	after   interface{}
+	last    bool
+	err     error
+}
+
+// QueryRows runs a read-only statement a page at a time, so that results too
+// large to hold in memory can be read. Each page is a separate query, run
+// when the rows before it have been read, and so sees the database as it is
+// then. The statement must return at most $limit rows, after skipping $skip
+// rows or, with PageOptions.KeyColumn, starting after the key $after:
+//
+//	MATCH (c:Concept) WHERE $after IS NULL OR c.uuid > $after
+//	RETURN c.uuid AS uuid, c.prefLabel AS prefLabel ORDER BY c.uuid LIMIT $limit
+//
+// Iteration stops when a page is short, ctx is done or a query fails.
+func QueryRows(ctx context.Context, cr CypherRunner, statement string, params map[string]interface{}, opts PageOptions) *Rows {
+	return &Rows{ctx: ctx, cr: cr, statement: statement, params: params, opts: opts, after: opts.After}
+}
+
+// Next advances to the next row, fetching the next page if needed. It
+// returns false at the end of the result or on an error, see Err.
+func (r *Rows) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.i+1 < len(r.page) {
+		r.i++
+		return true
+	}
+	if r.last {
+		r.page = nil
+		return false
+	}
+	if err := r.fetch(); err != nil {
+		r.err, r.page = err, nil
+		return false
+	}
+	r.i = 0
+	return len(r.page) > 0
+}
+
+func (r *Rows) fetch() error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	limit := r.opts.pageSize()
+	params := make(map[string]interface{}, len(r.params)+2)
+	for k, v := range r.params {
+		params[k] = v
+	}
+	params["limit"] = limit
+	if r.opts.KeyColumn != "" {
+		params["after"] = r.after
+	} else {
+		params["skip"] = r.fetched
+	}
+
+	page, err := queryRows(r.ctx, r.cr, r.statement, params)
+	if err != nil {
+		return err
+	}
+	if len(page) > limit {
+		return fmt.Errorf("neoutils: got %d rows for a page of %d, the statement must use $limit", len(page), limit)
+	}
+	r.page, r.fetched, r.last = page, r.fetched+len(page), len(page) < limit
+
+	if r.opts.KeyColumn != "" && len(page) > 0 {
+		key, ok := page[len(page)-1][r.opts.KeyColumn]
+		if !ok {
+			return fmt.Errorf("neoutils: no key column %s", r.opts.KeyColumn)
+		}
+		// numbers stay exact, for keys such as ids
+		d := json.NewDecoder(bytes.NewReader(key))
+		d.UseNumber()
+		if err := d.Decode(&r.after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan decodes the current row into dest, which must be a pointer, as Query
+// decodes rows.
+func (r *Rows) Scan(dest interface{}) error {
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("neoutils: Scan needs a pointer, not %T", dest)
+	}
+	if r.i >= len(r.page) {
+		return fmt.Errorf("neoutils: Scan called without a row")
+	}
+	decoded, err := decodeRows(r.page[r.i:r.i+1], reflect.SliceOf(rv.Elem().Type()))
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(decoded.Index(0))
+	return nil
+}
+
+// Err returns the error that stopped iteration, if any.
+func (r *Rows) Err() error {
+	return r.err
+}
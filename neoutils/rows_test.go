@@ -0,0 +1,121 @@
+package neoutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+// pagingRunner serves the numbers 1 to n as rows with a column n, a page at
+// a time as the $skip or $after and $limit parameters ask.
+type pagingRunner struct {
+	n     int
+	pages []map[string]interface{}
+}
+
+func (cr *pagingRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	for _, q := range queries {
+		cr.pages = append(cr.pages, q.Parameters)
+		first := 1
+		if skip, ok := q.Parameters["skip"].(int); ok {
+			first += skip
+		}
+		if after, ok := q.Parameters["after"].(json.Number); ok {
+			n, _ := after.Int64()
+			first = int(n) + 1
+		}
+		rows := []map[string]int{}
+		for n := first; n <= cr.n && len(rows) < q.Parameters["limit"].(int); n++ {
+			rows = append(rows, map[string]int{"n": n})
+		}
+		b, _ := json.Marshal(rows)
+		if err := json.Unmarshal(b, q.Result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestQueryRowsPagesWithSkip(t *testing.T) {
+	cr := &pagingRunner{n: 5}
+	rows := QueryRows(context.Background(), cr, "numbers", map[string]interface{}{"label": "Thing"}, PageOptions{PageSize: 2})
+
+	var got []int
+	for rows.Next() {
+		var row struct {
+			N int `json:"n"`
+		}
+		assert.NoError(t, rows.Scan(&row))
+		got = append(got, row.N)
+		// pages are only fetched as they are needed
+		assert.Len(t, cr.pages, (row.N+1)/2)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, got)
+	assert.Equal(t, []map[string]interface{}{
+		{"label": "Thing", "limit": 2, "skip": 0},
+		{"label": "Thing", "limit": 2, "skip": 2},
+		{"label": "Thing", "limit": 2, "skip": 4},
+	}, cr.pages)
+	assert.False(t, rows.Next())
+}
+
+func TestQueryRowsPagesWithKeys(t *testing.T) {
+	cr := &pagingRunner{n: 4}
+	rows := QueryRows(context.Background(), cr, "numbers", nil, PageOptions{PageSize: 2, KeyColumn: "n", After: json.Number("0")})
+
+	var got []int
+	for rows.Next() {
+		var n int
+		assert.NoError(t, rows.Scan(&n))
+		got = append(got, n)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []int{1, 2, 3, 4}, got)
+	// the last page is empty, as the one before it was full
+	assert.Len(t, cr.pages, 3)
+	assert.Equal(t, json.Number("4"), cr.pages[2]["after"])
+
+	// without After, the first page is passed a null $after
+	cr = &pagingRunner{n: 3}
+	rows = QueryRows(context.Background(), cr, "numbers", nil, PageOptions{PageSize: 2, KeyColumn: "n"})
+	got = nil
+	for rows.Next() {
+		var n int
+		assert.NoError(t, rows.Scan(&n))
+		got = append(got, n)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []int{1, 2, 3}, got)
+	assert.Contains(t, cr.pages[0], "after")
+	assert.Nil(t, cr.pages[0]["after"])
+
+	rows = QueryRows(context.Background(), cr, "numbers", nil, PageOptions{PageSize: 2, KeyColumn: "id", After: json.Number("0")})
+	assert.False(t, rows.Next())
+	assert.EqualError(t, rows.Err(), "neoutils: no key column id")
+}
+
+func TestQueryRowsStopsWhenCancelled(t *testing.T) {
+	cr := &pagingRunner{n: 5}
+	ctx, cancel := context.WithCancel(context.Background())
+	rows := QueryRows(ctx, cr, "numbers", nil, PageOptions{PageSize: 2})
+
+	assert.True(t, rows.Next())
+	cancel()
+	// the rows already fetched can still be read
+	assert.True(t, rows.Next())
+	assert.False(t, rows.Next())
+	assert.Equal(t, context.Canceled, rows.Err())
+	assert.Len(t, cr.pages, 1)
+}
+
+func TestQueryRowsNeedsLimit(t *testing.T) {
+	cr := &schemaListingRunner{rows: map[string]string{"all": `[{"n": 1}, {"n": 2}, {"n": 3}]`}}
+	rows := QueryRows(context.Background(), cr, "all", nil, PageOptions{PageSize: 2})
+	assert.False(t, rows.Next())
+	assert.EqualError(t, rows.Err(), fmt.Sprintf("neoutils: got %d rows for a page of %d, the statement must use $limit", 3, 2))
+}
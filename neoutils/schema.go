@@ -0,0 +1,360 @@
+package neoutils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Financial-Times/go-logger/v2"
+)
+
+// IndexType is the kind of a SchemaIndex.
+type IndexType string
+
+const (
+	// RangeIndex is an ordinary property index, called a b-tree index before Neo4j 5.
+	RangeIndex IndexType = "range"
+	// FullTextIndex is a Lucene index for full-text search, used through the
+	// db.index.fulltext.queryNodes and queryRelationships procedures.
+	FullTextIndex IndexType = "fulltext"
+)
+
+// ConstraintType is the kind of a SchemaConstraint.
+type ConstraintType string
+
+const (
+	UniqueConstraint    ConstraintType = "unique"
+	ExistenceConstraint ConstraintType = "exists"
+	NodeKeyConstraint   ConstraintType = "node_key"
+)
+
+// SchemaIndex is an index on one or more properties of nodes with a label, or
+// of relationships with a type.
+type SchemaIndex struct {
+	// Name is required for full-text indexes and optional otherwise. It is
+	// ignored by Neo4j 3.x, except for full-text indexes.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Type defaults to RangeIndex.
+	Type IndexType `json:"type,omitempty" yaml:"type,omitempty"`
+	// Exactly one of Label and RelationshipType is set. Relationship range
+	// indexes need Neo4j 4.3 or later.
+	Label            string `json:"label,omitempty" yaml:"label,omitempty"`
+	RelationshipType string `json:"relationshipType,omitempty" yaml:"relationshipType,omitempty"`
+	// Property is shorthand for a single element Properties.
+	Property   string   `json:"property,omitempty" yaml:"property,omitempty"`
+	Properties []string `json:"properties,omitempty" yaml:"properties,omitempty"`
+}
+
+// SchemaConstraint is a constraint on one or more properties of nodes with a
+// label, or, for existence constraints, of relationships with a type.
+// Existence and node key constraints need Neo4j Enterprise Edition.
+type SchemaConstraint struct {
+	// Name is optional, and ignored by Neo4j 3.x.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Type defaults to UniqueConstraint.
+	Type             ConstraintType `json:"type,omitempty" yaml:"type,omitempty"`
+	Label            string         `json:"label,omitempty" yaml:"label,omitempty"`
+	RelationshipType string         `json:"relationshipType,omitempty" yaml:"relationshipType,omitempty"`
+	// Property is shorthand for a single element Properties.
+	Property   string   `json:"property,omitempty" yaml:"property,omitempty"`
+	Properties []string `json:"properties,omitempty" yaml:"properties,omitempty"`
+}
+
+// SchemaManager lists, creates and drops indexes and constraints of every
+// kind described by SchemaIndex and SchemaConstraint. Indexes that back a
+// constraint are listed as constraints only.
+type SchemaManager interface {
+	SchemaIndexes() ([]SchemaIndex, error)
+	SchemaConstraints() ([]SchemaConstraint, error)
+	CreateSchemaIndex(index SchemaIndex) error
+	CreateSchemaConstraint(constraint SchemaConstraint) error
+	// DropSchemaIndex and DropSchemaConstraint take values listed by
+	// SchemaIndexes and SchemaConstraints, which are named from Neo4j 4.
+	DropSchemaIndex(index SchemaIndex) error
+	DropSchemaConstraint(constraint SchemaConstraint) error
+	// SchemaIndexStatuses lists the same indexes as SchemaIndexes, with
+	// their population state.
+	SchemaIndexStatuses() ([]SchemaIndexStatus, error)
+}
+
+// SchemaEnsurer is implemented by connections that can create every kind of
+// index and constraint, see EnsureSchema.
+type SchemaEnsurer interface {
+	EnsureSchema(constraints []SchemaConstraint, indexes []SchemaIndex) error
+}
+
+// EnsureSchema creates the constraints, and then the indexes, that don't exist
+// yet, in the order given. An existing index or constraint matches if it is of
+// the same type on the same label or relationship type and properties,
+// whatever its name. One created concurrently by another instance is not an error.
+func EnsureSchema(sm SchemaManager, constraints []SchemaConstraint, indexes []SchemaIndex, log *logger.UPPLogger) error {
+	// log is an optional parameter
+	if log == nil {
+		log = logger.NewUPPInfoLogger("neo-utils-go")
+	}
+	for _, c := range constraints {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, i := range indexes {
+		if err := i.Validate(); err != nil {
+			return err
+		}
+	}
+
+	existingConstraints, err := sm.SchemaConstraints()
+	if err != nil {
+		return err
+	}
+	for _, c := range constraints {
+		if containsConstraint(existingConstraints, c) {
+			continue
+		}
+		log.Infof("Creating %v", c)
+		if err := sm.CreateSchemaConstraint(c); isEquivalentSchemaRule(err) {
+			log.Infof("%v already created", c)
+		} else if err != nil {
+			return fmt.Errorf("cannot create %v: %w", c, err)
+		}
+		existingConstraints = append(existingConstraints, c)
+	}
+
+	existingIndexes, err := sm.SchemaIndexes()
+	if err != nil {
+		return err
+	}
+	for _, i := range indexes {
+		if containsIndex(existingIndexes, i) || indexedByConstraint(existingConstraints, i) {
+			continue
+		}
+		log.Infof("Creating %v", i)
+		if err := sm.CreateSchemaIndex(i); isEquivalentSchemaRule(err) {
+			log.Infof("%v already created", i)
+		} else if err != nil {
+			return fmt.Errorf("cannot create %v: %w", i, err)
+		}
+		existingIndexes = append(existingIndexes, i)
+	}
+	return nil
+}
+
+// ConstraintsFromMap converts the label to property map taken by
+// EnsureConstraints, sorted by label.
+func ConstraintsFromMap(constraints map[string]string) []SchemaConstraint {
+	var cs []SchemaConstraint
+	for _, label := range sortedKeys(constraints) {
+		cs = append(cs, SchemaConstraint{Type: UniqueConstraint, Label: label, Properties: []string{constraints[label]}})
+	}
+	return cs
+}
+
+// IndexesFromMap converts the label to property map taken by EnsureIndexes,
+// sorted by label.
+func IndexesFromMap(indexes map[string]string) []SchemaIndex {
+	var is []SchemaIndex
+	for _, label := range sortedKeys(indexes) {
+		is = append(is, SchemaIndex{Type: RangeIndex, Label: label, Properties: []string{indexes[label]}})
+	}
+	return is
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsIndex(indexes []SchemaIndex, i SchemaIndex) bool {
+	for _, e := range indexes {
+		if e.Matches(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsConstraint(constraints []SchemaConstraint, c SchemaConstraint) bool {
+	for _, e := range constraints {
+		if e.Matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedByConstraint reports whether a range index is made redundant by the
+// index backing a unique or node key constraint, which Neo4j won't duplicate.
+func indexedByConstraint(constraints []SchemaConstraint, i SchemaIndex) bool {
+	if i.IndexType() != RangeIndex || i.Label == "" {
+		return false
+	}
+	for _, c := range constraints {
+		t := c.ConstraintType()
+		if (t == UniqueConstraint || t == NodeKeyConstraint) && c.Label == i.Label && equalStrings(c.AllProperties(), i.AllProperties()) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexType returns the type, defaulting to RangeIndex.
+func (i SchemaIndex) IndexType() IndexType {
+	if i.Type == "" {
+		return RangeIndex
+	}
+	return i.Type
+}
+
+// AllProperties returns Properties, or Property if that is used instead.
+func (i SchemaIndex) AllProperties() []string {
+	return allProperties(i.Property, i.Properties)
+}
+
+// Matches reports whether two indexes are equivalent, ignoring their names.
+func (i SchemaIndex) Matches(o SchemaIndex) bool {
+	return i.IndexType() == o.IndexType() &&
+		i.Label == o.Label &&
+		i.RelationshipType == o.RelationshipType &&
+		equalStrings(i.AllProperties(), o.AllProperties())
+}
+
+// Validate checks that the index is complete and of a known type.
+func (i SchemaIndex) Validate() error {
+	if err := validateEntity(i.Label, i.RelationshipType, i.Property, i.Properties); err != nil {
+		return fmt.Errorf("invalid index: %w", err)
+	}
+	switch i.IndexType() {
+	case RangeIndex:
+	case FullTextIndex:
+		if i.Name == "" {
+			return errors.New("invalid index: full-text indexes need a name")
+		}
+	default:
+		return fmt.Errorf("invalid index: unknown type %q", i.Type)
+	}
+	return nil
+}
+
+func (i SchemaIndex) String() string {
+	var b strings.Builder
+	if i.IndexType() != RangeIndex {
+		b.WriteString(string(i.IndexType()) + " ")
+	}
+	b.WriteString("index ")
+	if i.Name != "" {
+		b.WriteString(i.Name + " ")
+	}
+	b.WriteString("on " + entityString(i.Label, i.RelationshipType, i.AllProperties()))
+	return b.String()
+}
+
+// ConstraintType returns the type, defaulting to UniqueConstraint.
+func (c SchemaConstraint) ConstraintType() ConstraintType {
+	if c.Type == "" {
+		return UniqueConstraint
+	}
+	return c.Type
+}
+
+// AllProperties returns Properties, or Property if that is used instead.
+func (c SchemaConstraint) AllProperties() []string {
+	return allProperties(c.Property, c.Properties)
+}
+
+// Matches reports whether two constraints are equivalent, ignoring their names.
+func (c SchemaConstraint) Matches(o SchemaConstraint) bool {
+	return c.ConstraintType() == o.ConstraintType() &&
+		c.Label == o.Label &&
+		c.RelationshipType == o.RelationshipType &&
+		equalStrings(c.AllProperties(), o.AllProperties())
+}
+
+// Validate checks that the constraint is complete and of a known type.
+func (c SchemaConstraint) Validate() error {
+	if err := validateEntity(c.Label, c.RelationshipType, c.Property, c.Properties); err != nil {
+		return fmt.Errorf("invalid constraint: %w", err)
+	}
+	switch c.ConstraintType() {
+	case UniqueConstraint, NodeKeyConstraint:
+		if c.Label == "" {
+			return fmt.Errorf("invalid constraint: %s constraints need a label", c.ConstraintType())
+		}
+	case ExistenceConstraint:
+		if len(c.AllProperties()) != 1 {
+			return errors.New("invalid constraint: existence constraints need exactly one property")
+		}
+	default:
+		return fmt.Errorf("invalid constraint: unknown type %q", c.Type)
+	}
+	return nil
+}
+
+func (c SchemaConstraint) String() string {
+	var b strings.Builder
+	switch c.ConstraintType() {
+	case ExistenceConstraint:
+		b.WriteString("existence")
+	case NodeKeyConstraint:
+		b.WriteString("node key")
+	default:
+		b.WriteString(string(c.ConstraintType()))
+	}
+	b.WriteString(" constraint ")
+	if c.Name != "" {
+		b.WriteString(c.Name + " ")
+	}
+	b.WriteString("on " + entityString(c.Label, c.RelationshipType, c.AllProperties()))
+	return b.String()
+}
+
+func allProperties(property string, properties []string) []string {
+	if property != "" {
+		return []string{property}
+	}
+	return properties
+}
+
+func validateEntity(label, relationshipType, property string, properties []string) error {
+	if (label == "") == (relationshipType == "") {
+		return errors.New("exactly one of label and relationshipType is needed")
+	}
+	if property != "" && len(properties) > 0 {
+		return errors.New("only one of property and properties can be used")
+	}
+	all := allProperties(property, properties)
+	if len(all) == 0 {
+		return errors.New("no properties")
+	}
+	for _, p := range all {
+		if p == "" {
+			return errors.New("blank property")
+		}
+	}
+	return nil
+}
+
+// entityString describes properties of a label as :Label(a, b) and of a
+// relationship type as [:TYPE](a, b).
+func entityString(label, relationshipType string, properties []string) string {
+	if label != "" {
+		return fmt.Sprintf(":%s(%s)", label, strings.Join(properties, ", "))
+	}
+	return fmt.Sprintf("[:%s](%s)", relationshipType, strings.Join(properties, ", "))
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package neoutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Financial-Times/go-logger/v2"
+)
+
+// SchemaDiff compares the indexes and constraints a service declares with
+// those in the database, see DiffSchema.
+type SchemaDiff struct {
+	MissingConstraints    []SchemaConstraint
+	ExtraConstraints      []SchemaConstraint
+	MismatchedConstraints []SchemaConstraintMismatch
+	MissingIndexes        []SchemaIndex
+	ExtraIndexes          []SchemaIndex
+	MismatchedIndexes     []SchemaIndexMismatch
+}
+
+// SchemaConstraintMismatch pairs a declared constraint with an existing one
+// that has the same name, or is on the same properties, but is otherwise different.
+type SchemaConstraintMismatch struct {
+	Declared SchemaConstraint
+	Existing SchemaConstraint
+}
+
+// SchemaIndexMismatch pairs a declared index with an existing one that has
+// the same name, or is on the same properties, but is otherwise different.
+type SchemaIndexMismatch struct {
+	Declared SchemaIndex
+	Existing SchemaIndex
+}
+
+// SchemaDiffer is implemented by connections that can compare the schema a
+// service declares with the database's, see DiffSchema and PruneSchema.
+type SchemaDiffer interface {
+	DiffSchema(constraints []SchemaConstraint, indexes []SchemaIndex) (*SchemaDiff, error)
+	PruneSchema(diff *SchemaDiff) error
+}
+
+// internalLabels are the labels of the nodes kept by the schema lock and
+// SchemaMigrator, whose constraints are never extra, so that pruning can't
+// remove the uniqueness they rely on.
+var internalLabels = map[string]bool{"NeoUtilsSchemaLock": true, "NeoUtilsSchemaVersion": true}
+
+// DiffSchema compares the declared constraints and indexes with those sm
+// reports. Existing ones match as they do for EnsureSchema, ignoring names,
+// and a declared range index is not missing if an existing unique or node key
+// constraint provides it. Indexes backing constraints, and the constraints
+// and indexes neoutils creates for its own nodes, are never extra.
+func DiffSchema(sm SchemaManager, constraints []SchemaConstraint, indexes []SchemaIndex) (*SchemaDiff, error) {
+	for _, c := range constraints {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, i := range indexes {
+		if err := i.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	existingConstraints, err := sm.SchemaConstraints()
+	if err != nil {
+		return nil, err
+	}
+	existingIndexes, err := sm.SchemaIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &SchemaDiff{}
+	used := make([]bool, len(existingConstraints))
+	var unmatched []SchemaConstraint
+	for _, c := range constraints {
+		if n := indexOfConstraint(existingConstraints, used, c.Matches); n >= 0 {
+			used[n] = true
+		} else {
+			unmatched = append(unmatched, c)
+		}
+	}
+	// look for mismatches once all exact matches have been taken
+	for _, c := range unmatched {
+		if n := indexOfConstraint(existingConstraints, used, c.conflicts); n >= 0 {
+			used[n] = true
+			d.MismatchedConstraints = append(d.MismatchedConstraints, SchemaConstraintMismatch{c, existingConstraints[n]})
+		} else {
+			d.MissingConstraints = append(d.MissingConstraints, c)
+		}
+	}
+	for n, c := range existingConstraints {
+		if !used[n] && !internalLabels[c.Label] {
+			d.ExtraConstraints = append(d.ExtraConstraints, c)
+		}
+	}
+
+	used = make([]bool, len(existingIndexes))
+	var unmatchedIndexes []SchemaIndex
+	for _, i := range indexes {
+		if n := indexOfIndex(existingIndexes, used, i.Matches); n >= 0 {
+			used[n] = true
+		} else if !indexedByConstraint(existingConstraints, i) {
+			unmatchedIndexes = append(unmatchedIndexes, i)
+		}
+	}
+	for _, i := range unmatchedIndexes {
+		if n := indexOfIndex(existingIndexes, used, i.conflicts); n >= 0 {
+			used[n] = true
+			d.MismatchedIndexes = append(d.MismatchedIndexes, SchemaIndexMismatch{i, existingIndexes[n]})
+		} else {
+			d.MissingIndexes = append(d.MissingIndexes, i)
+		}
+	}
+	for n, i := range existingIndexes {
+		if !used[n] && !internalLabels[i.Label] {
+			d.ExtraIndexes = append(d.ExtraIndexes, i)
+		}
+	}
+	return d, nil
+}
+
+func indexOfConstraint(constraints []SchemaConstraint, used []bool, match func(SchemaConstraint) bool) int {
+	for n, c := range constraints {
+		if !used[n] && match(c) {
+			return n
+		}
+	}
+	return -1
+}
+
+func indexOfIndex(indexes []SchemaIndex, used []bool, match func(SchemaIndex) bool) int {
+	for n, i := range indexes {
+		if !used[n] && match(i) {
+			return n
+		}
+	}
+	return -1
+}
+
+// conflicts reports whether o has the same name as c, or is on the same
+// properties, so is most likely meant to be c.
+func (c SchemaConstraint) conflicts(o SchemaConstraint) bool {
+	if c.Name != "" && c.Name == o.Name {
+		return true
+	}
+	return c.Label == o.Label && c.RelationshipType == o.RelationshipType && equalStrings(c.AllProperties(), o.AllProperties())
+}
+
+// conflicts reports whether o has the same name as i, or is on the same
+// properties, so is most likely meant to be i.
+func (i SchemaIndex) conflicts(o SchemaIndex) bool {
+	if i.Name != "" && i.Name == o.Name {
+		return true
+	}
+	return i.Label == o.Label && i.RelationshipType == o.RelationshipType && equalStrings(i.AllProperties(), o.AllProperties())
+}
+
+// Empty reports whether the database has exactly the declared schema.
+func (d *SchemaDiff) Empty() bool {
+	return len(d.MissingConstraints) == 0 && len(d.ExtraConstraints) == 0 && len(d.MismatchedConstraints) == 0 &&
+		len(d.MissingIndexes) == 0 && len(d.ExtraIndexes) == 0 && len(d.MismatchedIndexes) == 0
+}
+
+// String lists the differences one per line, e.g. "missing index on :Person(prefLabel)".
+func (d *SchemaDiff) String() string {
+	var b strings.Builder
+	for _, c := range d.MissingConstraints {
+		fmt.Fprintf(&b, "missing %v\n", c)
+	}
+	for _, m := range d.MismatchedConstraints {
+		fmt.Fprintf(&b, "mismatched %v, found %v\n", m.Declared, m.Existing)
+	}
+	for _, c := range d.ExtraConstraints {
+		fmt.Fprintf(&b, "extra %v\n", c)
+	}
+	for _, i := range d.MissingIndexes {
+		fmt.Fprintf(&b, "missing %v\n", i)
+	}
+	for _, m := range d.MismatchedIndexes {
+		fmt.Fprintf(&b, "mismatched %v, found %v\n", m.Declared, m.Existing)
+	}
+	for _, i := range d.ExtraIndexes {
+		fmt.Fprintf(&b, "extra %v\n", i)
+	}
+	return b.String()
+}
+
+// PruneSchema drops the extra indexes, and then the extra constraints, of a
+// diff. Mismatches are left alone, as they usually need a migration, as are
+// the constraints and indexes neoutils creates for its own nodes.
+func PruneSchema(sm SchemaManager, diff *SchemaDiff, log *logger.UPPLogger) error {
+	// log is an optional parameter
+	if log == nil {
+		log = logger.NewUPPInfoLogger("neo-utils-go")
+	}
+	for _, i := range diff.ExtraIndexes {
+		if internalLabels[i.Label] {
+			continue
+		}
+		log.Infof("Dropping %v", i)
+		if err := sm.DropSchemaIndex(i); err != nil {
+			return fmt.Errorf("cannot drop %v: %w", i, err)
+		}
+	}
+	for _, c := range diff.ExtraConstraints {
+		if internalLabels[c.Label] {
+			continue
+		}
+		log.Infof("Dropping %v", c)
+		if err := sm.DropSchemaConstraint(c); err != nil {
+			return fmt.Errorf("cannot drop %v: %w", c, err)
+		}
+	}
+	return nil
+}
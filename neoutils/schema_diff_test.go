@@ -0,0 +1,90 @@
+package neoutils
+
+import (
+	"testing"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSchema(t *testing.T) {
+	sm := &fakeSchemaManager{
+		constraints: []SchemaConstraint{
+			{Name: "constraint_1", Type: UniqueConstraint, Label: "Person", Properties: []string{"uuid"}},
+			{Name: "constraint_2", Type: UniqueConstraint, Label: "Organisation", Properties: []string{"uuid"}},
+			{Name: "constraint_3", Type: UniqueConstraint, Label: "Thing", Properties: []string{"authority", "identifier"}},
+		},
+		indexes: []SchemaIndex{
+			{Name: "index_1", Type: RangeIndex, Label: "Person", Properties: []string{"prefLabel"}},
+			{Name: "index_2", Type: RangeIndex, Label: "Company", Properties: []string{"prefLabel"}},
+			{Name: "names", Type: FullTextIndex, Label: "Concept", Properties: []string{"prefLabel"}},
+		},
+	}
+	constraints := append(ConstraintsFromMap(map[string]string{"Person": "uuid", "Concept": "uuid"}),
+		SchemaConstraint{Type: NodeKeyConstraint, Label: "Thing", Properties: []string{"authority", "identifier"}})
+	indexes := append(IndexesFromMap(map[string]string{"Person": "prefLabel", "Organisation": "uuid"}),
+		SchemaIndex{Name: "names", Type: FullTextIndex, Label: "Concept", Properties: []string{"prefLabel", "aliases"}})
+
+	d, err := DiffSchema(sm, constraints, indexes)
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaConstraint{{Type: UniqueConstraint, Label: "Concept", Properties: []string{"uuid"}}}, d.MissingConstraints)
+	assert.Equal(t, []SchemaConstraintMismatch{{constraints[2], sm.constraints[2]}}, d.MismatchedConstraints)
+	assert.Equal(t, []SchemaConstraint{sm.constraints[1]}, d.ExtraConstraints)
+	// the Organisation index is provided by the existing constraint
+	assert.Empty(t, d.MissingIndexes)
+	assert.Equal(t, []SchemaIndexMismatch{{indexes[2], sm.indexes[2]}}, d.MismatchedIndexes)
+	assert.Equal(t, []SchemaIndex{sm.indexes[1]}, d.ExtraIndexes)
+	assert.False(t, d.Empty())
+	assert.Equal(t, `missing unique constraint on :Concept(uuid)
+mismatched node key constraint on :Thing(authority, identifier), found unique constraint constraint_3 on :Thing(authority, identifier)
+extra unique constraint constraint_2 on :Organisation(uuid)
+mismatched fulltext index names on :Concept(prefLabel, aliases), found fulltext index names on :Concept(prefLabel)
+extra index index_2 on :Company(prefLabel)
+`, d.String())
+
+	assert.NoError(t, PruneSchema(sm, d, logger.NewUPPLogger("neo-utils-go-test", "PANIC")))
+	assert.Equal(t, []string{
+		"index index_2 on :Company(prefLabel)",
+		"unique constraint constraint_2 on :Organisation(uuid)",
+	}, sm.dropped)
+
+	d, err = DiffSchema(sm, constraints, indexes)
+	assert.NoError(t, err)
+	assert.Empty(t, d.ExtraConstraints)
+	assert.Empty(t, d.ExtraIndexes)
+	assert.Len(t, d.MismatchedIndexes, 1, "mismatches are not pruned")
+}
+
+func TestDiffSchemaWhenInSync(t *testing.T) {
+	sm := &fakeSchemaManager{}
+	constraints := ConstraintsFromMap(map[string]string{"Person": "uuid"})
+	indexes := IndexesFromMap(map[string]string{"Person": "prefLabel"})
+	assert.NoError(t, EnsureSchema(sm, constraints, indexes, logger.NewUPPLogger("neo-utils-go-test", "PANIC")))
+
+	d, err := DiffSchema(sm, constraints, indexes)
+	assert.NoError(t, err)
+	assert.True(t, d.Empty())
+	assert.Equal(t, "", d.String())
+
+	_, err = DiffSchema(sm, nil, []SchemaIndex{{Label: "Person"}})
+	assert.Error(t, err)
+}
+
+func TestPruneSchemaKeepsInternalConstraints(t *testing.T) {
+	sm := &fakeSchemaManager{
+		constraints: []SchemaConstraint{
+			{Name: "constraint_1", Type: UniqueConstraint, Label: "NeoUtilsSchemaLock", Properties: []string{"name"}},
+			{Name: "constraint_2", Type: UniqueConstraint, Label: "NeoUtilsSchemaVersion", Properties: []string{"name"}},
+			{Name: "constraint_3", Type: UniqueConstraint, Label: "Organisation", Properties: []string{"uuid"}},
+		},
+	}
+
+	d, err := DiffSchema(sm, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []SchemaConstraint{sm.constraints[2]}, d.ExtraConstraints)
+
+	// even if a diff lists them
+	d.ExtraConstraints = append(d.ExtraConstraints, sm.constraints[0], sm.constraints[1])
+	assert.NoError(t, PruneSchema(sm, d, logger.NewUPPLogger("neo-utils-go-test", "PANIC")))
+	assert.Equal(t, []string{"unique constraint constraint_3 on :Organisation(uuid)"}, sm.dropped)
+}
@@ -0,0 +1,229 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// errSchemaLockLost is returned when a schema lock's lease could not be renewed
+// because another instance has taken it over.
+var errSchemaLockLost = errors.New("schema lock lost to another instance")
+
+// schemaLock is a lease on a lock node in the database, so that only one
+// instance of a service changes its schema at a time. An instance that dies
+// holding the lock only blocks the others until the lease expires. Its queries
+// bypass any batching, so that they are neither held up by nor roll back
+// other writes.
+type schemaLock struct {
+	cr    CypherRunner
+	name  string
+	owner string
+	ttl   time.Duration
+	poll  time.Duration
+
+	// lk guards constrained, which is set once the unique constraint on
+	// lock names is known to exist
+	lk          sync.Mutex
+	constrained bool
+}
+
+func newSchemaLock(cr CypherRunner, name string) *schemaLock {
+	host, _ := os.Hostname()
+	return &schemaLock{
+		cr:    cr,
+		name:  name,
+		owner: fmt.Sprintf("%s/%d/%x", host, os.Getpid(), rand.Int63()),
+		ttl:   2 * time.Minute,
+		poll:  time.Second,
+	}
+}
+
+// tryAcquire takes or renews the lease, reporting whether it is now held.
+func (l *schemaLock) tryAcquire(ctx context.Context) (bool, error) {
+	var res []struct {
+		Owner string `json:"owner"`
+	}
+	// setting lockedAt takes the node's write lock before the owner is read,
+	// so that two instances can't both see the lock as free
+	err := cypherBatchContext(ctx, unbatched(l.cr), []*neoism.CypherQuery{{
+		Statement: `MERGE (l:NeoUtilsSchemaLock {name: $name})
+			SET l.lockedAt = timestamp()
+			WITH l
+			WHERE l.owner IS NULL OR l.owner = $owner OR l.expires < timestamp()
+			SET l.owner = $owner, l.expires = timestamp() + $ttl
+			RETURN l.owner AS owner`,
+		Parameters: map[string]interface{}{"name": l.name, "owner": l.owner, "ttl": l.ttl.Milliseconds()},
+		Result:     &res,
+	}})
+	if err != nil {
+		return false, err
+	}
+	return len(res) == 1 && res[0].Owner == l.owner, nil
+}
+
+// acquire waits until the lease is held or ctx is done. The returned context
+// is cancelled if the lease is lost, and release must be called when done.
+func (l *schemaLock) acquire(ctx context.Context) (context.Context, func() error, error) {
+	if err := l.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+	held, release := l.hold(ctx)
+	return held, release, nil
+}
+
+// ensureConstraint creates the unique constraint on lock names the first time
+// it's called. Without it, two instances starting against an empty database
+// can each MERGE their own lock node and both hold the lock.
+func (l *schemaLock) ensureConstraint() error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.constrained {
+		return nil
+	}
+	if err := ensureUniqueConstraint(unbatched(l.cr), "NeoUtilsSchemaLock", "name"); err != nil {
+		return err
+	}
+	l.constrained = true
+	return nil
+}
+
+// ensureUniqueConstraint creates a unique constraint on label(property),
+// succeeding if another instance already has.
+func ensureUniqueConstraint(cr CypherRunner, label, property string) error {
+	version, _, err := kernelVersion(cr)
+	if err != nil {
+		return err
+	}
+	sm := NewCypherSchemaManager(cr, version)
+	err = sm.CreateSchemaConstraint(SchemaConstraint{Label: label, Property: property})
+	if err != nil && !isEquivalentSchemaRule(err) {
+		return fmt.Errorf("cannot create unique constraint on :%s(%s): %w", label, property, err)
+	}
+	return nil
+}
+
+// wait polls until the lease is held or ctx is done.
+func (l *schemaLock) wait(ctx context.Context) error {
+	if err := l.ensureConstraint(); err != nil {
+		return err
+	}
+	for {
+		ok, err := l.tryAcquire(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-time.After(l.poll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// hold renews a lease that has just been acquired until release is called or
+// ctx is done. The returned context is cancelled if the lease is lost.
+func (l *schemaLock) hold(ctx context.Context) (context.Context, func() error) {
+	held, cancel := context.WithCancel(ctx)
+	lost := make(chan error, 1)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		for {
+			select {
+			case <-time.After(l.ttl / 3):
+			case <-held.Done():
+				return
+			}
+			ok, err := l.tryAcquire(held)
+			if err == nil && !ok {
+				err = errSchemaLockLost
+			}
+			if err != nil && held.Err() == nil {
+				lost <- err
+				cancel()
+				return
+			}
+		}
+	}()
+
+	release := func() error {
+		cancel()
+		<-renewed
+		select {
+		case err := <-lost:
+			return fmt.Errorf("schema lock %s: %w", l.name, err)
+		default:
+		}
+		return cypherBatchContext(context.Background(), unbatched(l.cr), []*neoism.CypherQuery{{
+			Statement:  `MATCH (l:NeoUtilsSchemaLock {name: $name, owner: $owner}) REMOVE l.owner, l.expires`,
+			Parameters: map[string]interface{}{"name": l.name, "owner": l.owner},
+		}})
+	}
+	return held, release
+}
+
+// leasedSchemaManager stops changing the schema once ctx, the context of a
+// held lease, is done, so that an instance that has lost the schema lock
+// doesn't carry on alongside the one that took it over.
+type leasedSchemaManager struct {
+	SchemaManager
+	ctx context.Context
+}
+
+func (sm leasedSchemaManager) CreateSchemaIndex(index SchemaIndex) error {
+	if err := sm.ctx.Err(); err != nil {
+		return err
+	}
+	return sm.SchemaManager.CreateSchemaIndex(index)
+}
+
+func (sm leasedSchemaManager) CreateSchemaConstraint(constraint SchemaConstraint) error {
+	if err := sm.ctx.Err(); err != nil {
+		return err
+	}
+	return sm.SchemaManager.CreateSchemaConstraint(constraint)
+}
+
+func (sm leasedSchemaManager) DropSchemaIndex(index SchemaIndex) error {
+	if err := sm.ctx.Err(); err != nil {
+		return err
+	}
+	return sm.SchemaManager.DropSchemaIndex(index)
+}
+
+func (sm leasedSchemaManager) DropSchemaConstraint(constraint SchemaConstraint) error {
+	if err := sm.ctx.Err(); err != nil {
+		return err
+	}
+	return sm.SchemaManager.DropSchemaConstraint(constraint)
+}
+
+// leasedIndexManager is leasedSchemaManager for an IndexManager.
+type leasedIndexManager struct {
+	IndexManager
+	ctx context.Context
+}
+
+func (im leasedIndexManager) CreateIndex(label string, propertyName string) (*neoism.Index, error) {
+	if err := im.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return im.IndexManager.CreateIndex(label, propertyName)
+}
+
+func (im leasedIndexManager) CreateUniqueConstraint(label string, propertyName string) (*neoism.UniqueConstraint, error) {
+	if err := im.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return im.IndexManager.CreateUniqueConstraint(label, propertyName)
+}
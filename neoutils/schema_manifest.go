@@ -0,0 +1,89 @@
+package neoutils
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SchemaManifest declares the schema a service needs as a list of migrations,
+// applied in order of version by a SchemaMigrator.
+type SchemaManifest struct {
+	// Name identifies the manifest in the database, so that services sharing
+	// a database can each keep their own version. Usually the service name.
+	Name       string            `json:"name" yaml:"name"`
+	Migrations []SchemaMigration `json:"migrations" yaml:"migrations"`
+}
+
+// SchemaMigration is a single versioned step of a SchemaManifest. Constraints
+// are applied first, then indexes, and then the statements are run in a
+// single transaction together with recording the new version.
+type SchemaMigration struct {
+	Version     int                `json:"version" yaml:"version"`
+	Description string             `json:"description,omitempty" yaml:"description,omitempty"`
+	Constraints []SchemaConstraint `json:"constraints,omitempty" yaml:"constraints,omitempty"`
+	Indexes     []SchemaIndex      `json:"indexes,omitempty" yaml:"indexes,omitempty"`
+	Statements  []string           `json:"statements,omitempty" yaml:"statements,omitempty"`
+}
+
+// LoadSchemaManifest reads a manifest from a YAML or JSON file.
+func LoadSchemaManifest(path string) (*SchemaManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseSchemaManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// ParseSchemaManifest parses a manifest in YAML or JSON, which is a subset of
+// YAML, and checks that it is valid. Unknown fields are rejected so that typos
+// don't go unnoticed.
+func ParseSchemaManifest(data []byte) (*SchemaManifest, error) {
+	var m SchemaManifest
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid schema manifest: %w", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Validate checks that the manifest is named, that versions are positive and
+// strictly increasing, and that every index and constraint is valid.
+func (m *SchemaManifest) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("invalid schema manifest: no name")
+	}
+	last := 0
+	for _, mig := range m.Migrations {
+		if mig.Version <= last {
+			return fmt.Errorf("invalid schema manifest: migration version %d must be greater than %d", mig.Version, last)
+		}
+		last = mig.Version
+		for _, c := range mig.Constraints {
+			if err := c.Validate(); err != nil {
+				return fmt.Errorf("invalid schema manifest: migration %d: %w", mig.Version, err)
+			}
+		}
+		for _, i := range mig.Indexes {
+			if err := i.Validate(); err != nil {
+				return fmt.Errorf("invalid schema manifest: migration %d: %w", mig.Version, err)
+			}
+		}
+	}
+	return nil
+}
+
+// LatestVersion returns the version of the last migration, or 0 if there are none.
+func (m *SchemaManifest) LatestVersion() int {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
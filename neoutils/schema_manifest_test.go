@@ -0,0 +1,101 @@
+package neoutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchemaYAML = `
+name: people-rw
+migrations:
+  - version: 1
+    description: people
+    constraints:
+      - label: Person
+        property: uuid
+    indexes:
+      - label: Person
+        property: prefLabel
+  - version: 2
+    description: backfill
+    statements:
+      - MATCH (p:Person) WHERE p.prefLabel IS NULL SET p.prefLabel = p.name
+`
+
+func TestParseSchemaManifestYAMLAndJSON(t *testing.T) {
+	expected := &SchemaManifest{
+		Name: "people-rw",
+		Migrations: []SchemaMigration{
+			{
+				Version:     1,
+				Description: "people",
+				Constraints: []SchemaConstraint{{Label: "Person", Property: "uuid"}},
+				Indexes:     []SchemaIndex{{Label: "Person", Property: "prefLabel"}},
+			},
+			{
+				Version:     2,
+				Description: "backfill",
+				Statements:  []string{"MATCH (p:Person) WHERE p.prefLabel IS NULL SET p.prefLabel = p.name"},
+			},
+		},
+	}
+
+	m, err := ParseSchemaManifest([]byte(testSchemaYAML))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+	assert.Equal(t, 2, m.LatestVersion())
+
+	m, err = ParseSchemaManifest([]byte(`{
+		"name": "people-rw",
+		"migrations": [
+			{"version": 1, "description": "people",
+			 "constraints": [{"label": "Person", "property": "uuid"}],
+			 "indexes": [{"label": "Person", "property": "prefLabel"}]},
+			{"version": 2, "description": "backfill",
+			 "statements": ["MATCH (p:Person) WHERE p.prefLabel IS NULL SET p.prefLabel = p.name"]}
+		]
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+}
+
+func TestParseSchemaManifestRejectsInvalidManifests(t *testing.T) {
+	for name, manifest := range map[string]string{
+		"no name":               `migrations: [{version: 1}]`,
+		"unknown field":         `{name: x, migrations: [{version: 1, indices: []}]}`,
+		"zero version":          `{name: x, migrations: [{version: 0}]}`,
+		"versions out of order": `{name: x, migrations: [{version: 2}, {version: 1}]}`,
+		"duplicate versions":    `{name: x, migrations: [{version: 1}, {version: 1}]}`,
+		"index property":        `{name: x, migrations: [{version: 1, indexes: [{label: Person}]}]}`,
+		"constraint label":      `{name: x, migrations: [{version: 1, constraints: [{property: uuid}]}]}`,
+		"unnamed fulltext":      `{name: x, migrations: [{version: 1, indexes: [{type: fulltext, label: Person, property: name}]}]}`,
+		"constraint type":       `{name: x, migrations: [{version: 1, constraints: [{type: primary, label: Person, property: uuid}]}]}`,
+		"not yaml":              `{name: [`,
+	} {
+		_, err := ParseSchemaManifest([]byte(manifest))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadSchemaManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neoutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schema.yaml")
+	if err := ioutil.WriteFile(path, []byte(testSchemaYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadSchemaManifest(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "people-rw", m.Name)
+
+	_, err = LoadSchemaManifest(filepath.Join(dir, "missing.yaml"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,222 @@
+package neoutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/jmcvetta/neoism"
+)
+
+// SchemaMigrator brings a database up to date with a SchemaManifest. The
+// version applied is recorded in a NeoUtilsSchemaVersion node named after the
+// manifest, and a NeoUtilsSchemaLock node ensures that only one instance
+// migrates at a time.
+type SchemaMigrator struct {
+	conn     NeoConnection
+	manifest *SchemaManifest
+	lock     *schemaLock
+	log      *logger.UPPLogger
+}
+
+// NewSchemaMigrator returns a migrator applying manifest with conn. Background
+// connections must be ready, see ConnectionStateWatcher.WaitReady.
+func NewSchemaMigrator(conn NeoConnection, manifest *SchemaManifest, log *logger.UPPLogger) *SchemaMigrator {
+	// log is an optional parameter
+	if log == nil {
+		log = logger.NewUPPInfoLogger("neo-utils-go")
+	}
+	return &SchemaMigrator{
+		conn:     conn,
+		manifest: manifest,
+		lock:     newSchemaLock(conn, manifest.Name),
+		log:      log,
+	}
+}
+
+// SchemaPlan lists the migrations needed to bring a database up to date.
+type SchemaPlan struct {
+	Name string
+	// From is the version currently applied, 0 if none.
+	From int
+	// To is the version the database will be at once Steps are applied.
+	To    int
+	Steps []SchemaMigration
+}
+
+func (p *SchemaPlan) String() string {
+	if len(p.Steps) == 0 {
+		return fmt.Sprintf("schema %q is up to date at version %d\n", p.Name, p.From)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "schema %q: version %d -> %d\n", p.Name, p.From, p.To)
+	for _, step := range p.Steps {
+		fmt.Fprintf(&b, "  migration %d", step.Version)
+		if step.Description != "" {
+			fmt.Fprintf(&b, ": %s", step.Description)
+		}
+		b.WriteString("\n")
+		for _, c := range step.Constraints {
+			fmt.Fprintf(&b, "    create %v\n", c)
+		}
+		for _, i := range step.Indexes {
+			fmt.Fprintf(&b, "    create %v\n", i)
+		}
+		for _, s := range step.Statements {
+			fmt.Fprintf(&b, "    run %s\n", strings.Join(strings.Fields(s), " "))
+		}
+	}
+	return b.String()
+}
+
+// AppliedVersion returns the version recorded in the database, 0 if none.
+func (m *SchemaMigrator) AppliedVersion(ctx context.Context) (int, error) {
+	var res []struct {
+		Version int `json:"version"`
+	}
+	err := cypherBatchContext(ctx, m.conn, []*neoism.CypherQuery{{
+		Statement:  `MATCH (v:NeoUtilsSchemaVersion {name: $name}) RETURN v.version AS version`,
+		Parameters: map[string]interface{}{"name": m.manifest.Name},
+		Result:     &res,
+	}})
+	if err != nil {
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, nil
+	}
+	return res[0].Version, nil
+}
+
+// Plan returns the migrations that have not been applied yet.
+func (m *SchemaMigrator) Plan(ctx context.Context) (*SchemaPlan, error) {
+	applied, err := m.AppliedVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.plan(applied), nil
+}
+
+func (m *SchemaMigrator) plan(applied int) *SchemaPlan {
+	p := &SchemaPlan{Name: m.manifest.Name, From: applied, To: applied}
+	for _, mig := range m.manifest.Migrations {
+		if mig.Version > applied {
+			p.Steps = append(p.Steps, mig)
+			p.To = mig.Version
+		}
+	}
+	return p
+}
+
+// DryRun writes the plan to w without changing the database.
+func (m *SchemaMigrator) DryRun(ctx context.Context, w io.Writer) (*SchemaPlan, error) {
+	p, err := m.Plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, p.String()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Migrate applies pending migrations in order, holding the schema lock. If a
+// migration fails, the versions before it remain applied and the next call
+// carries on from there.
+func (m *SchemaMigrator) Migrate(ctx context.Context) (err error) {
+	held, release, err := m.lock.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot acquire schema lock %s: %w", m.manifest.Name, err)
+	}
+	defer func() {
+		if releaseErr := release(); err == nil {
+			err = releaseErr
+		}
+	}()
+
+	// another instance may have migrated while this one waited for the lock
+	p, err := m.Plan(held)
+	if err != nil {
+		return err
+	}
+	if latest := m.manifest.LatestVersion(); p.From > latest {
+		m.log.Warnf("schema %s is at version %d, which is newer than the latest known version %d", p.Name, p.From, latest)
+	}
+	if len(p.Steps) > 0 {
+		// so that the version can't be recorded in two nodes with the same name
+		if err := ensureUniqueConstraint(unbatched(m.conn), "NeoUtilsSchemaVersion", "name"); err != nil {
+			return err
+		}
+	}
+	for _, step := range p.Steps {
+		m.log.Infof("applying schema %s migration %d %s", p.Name, step.Version, step.Description)
+		if err := m.apply(held, step); err != nil {
+			return fmt.Errorf("schema %s migration %d failed: %w", p.Name, step.Version, err)
+		}
+	}
+	return nil
+}
+
+func (m *SchemaMigrator) apply(ctx context.Context, step SchemaMigration) error {
+	if err := m.ensureSchema(step); err != nil {
+		return err
+	}
+
+	queries := make([]*neoism.CypherQuery, 0, len(step.Statements)+1)
+	for _, s := range step.Statements {
+		queries = append(queries, &neoism.CypherQuery{Statement: s})
+	}
+	queries = append(queries, &neoism.CypherQuery{
+		Statement: `MERGE (v:NeoUtilsSchemaVersion {name: $name})
+			SET v.version = $version, v.description = $description, v.appliedAt = timestamp()`,
+		Parameters: map[string]interface{}{"name": m.manifest.Name, "version": step.Version, "description": step.Description},
+	})
+	return cypherBatchContext(ctx, m.conn, queries)
+}
+
+// currentConnector is implemented by background connections, whose
+// IndexEnsurer and SchemaEnsurer methods only queue schema to be applied on
+// the next connect, to give the connection in use.
+type currentConnector interface {
+	current() (NeoConnection, error)
+}
+
+// ensureSchema creates the step's constraints and indexes, falling back to
+// IndexEnsurer for connections that don't implement SchemaEnsurer, which only
+// handles unique constraints and range indexes on a single node property.
+// The schema is applied before returning, so that the version isn't recorded
+// if it fails.
+func (m *SchemaMigrator) ensureSchema(step SchemaMigration) error {
+	conn := m.conn
+	if cc, ok := conn.(currentConnector); ok {
+		var err error
+		if conn, err = cc.current(); err != nil {
+			return err
+		}
+	}
+	if se, ok := conn.(SchemaEnsurer); ok {
+		return se.EnsureSchema(step.Constraints, step.Indexes)
+	}
+	// one at a time, as the maps only hold one property per label
+	for _, c := range step.Constraints {
+		properties := c.AllProperties()
+		if c.ConstraintType() != UniqueConstraint || c.Label == "" || len(properties) != 1 {
+			return fmt.Errorf("%v needs a connection implementing SchemaEnsurer", c)
+		}
+		if err := conn.EnsureConstraints(map[string]string{c.Label: properties[0]}); err != nil {
+			return err
+		}
+	}
+	for _, i := range step.Indexes {
+		properties := i.AllProperties()
+		if i.IndexType() != RangeIndex || i.Label == "" || len(properties) != 1 {
+			return fmt.Errorf("%v needs a connection implementing SchemaEnsurer", i)
+		}
+		if err := conn.EnsureIndexes(map[string]string{i.Label: properties[0]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
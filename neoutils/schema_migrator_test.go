@@ -0,0 +1,404 @@
+package neoutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateAppliesAllMigrationsInOrder(t *testing.T) {
+	db := newFakeSchemaDB()
+	m := newTestSchemaMigrator(t, db)
+
+	assert.NoError(t, m.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"constraint Person.uuid",
+		"index Person.prefLabel",
+		"version 1",
+		"MATCH (p:Person) WHERE p.prefLabel IS NULL SET p.prefLabel = p.name",
+		"version 2",
+	}, db.applied)
+	assert.Equal(t, "", db.lockOwner, "lock not released")
+	assert.Equal(t, []string{
+		"CREATE CONSTRAINT FOR (n:`NeoUtilsSchemaLock`) REQUIRE n.`name` IS UNIQUE",
+		"CREATE CONSTRAINT FOR (n:`NeoUtilsSchemaVersion`) REQUIRE n.`name` IS UNIQUE",
+	}, db.constraints)
+
+	version, err := m.AppliedVersion(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	// nothing left to do
+	db.applied = nil
+	assert.NoError(t, m.Migrate(context.Background()))
+	assert.Empty(t, db.applied)
+}
+
+func TestMigrateOnlyAppliesPendingMigrations(t *testing.T) {
+	db := newFakeSchemaDB()
+	db.version = 1
+	m := newTestSchemaMigrator(t, db)
+
+	assert.NoError(t, m.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"MATCH (p:Person) WHERE p.prefLabel IS NULL SET p.prefLabel = p.name",
+		"version 2",
+	}, db.applied)
+}
+
+func TestMigrateStopsAtFailedMigration(t *testing.T) {
+	db := newFakeSchemaDB()
+	manifest, err := ParseSchemaManifest([]byte(`
+name: people-rw
+migrations:
+  - version: 1
+    statements: [CREATE (:Thing)]
+  - version: 2
+    statements: [FAIL]
+  - version: 3
+    statements: [CREATE (:Other)]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewSchemaMigrator(db, manifest, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+
+	err = m.Migrate(context.Background())
+	assert.Error(t, err)
+	assert.True(t, IsConstraintViolation(err))
+	assert.Equal(t, 1, db.version)
+	assert.Equal(t, []string{"CREATE (:Thing)", "version 1"}, db.applied)
+	assert.Equal(t, "", db.lockOwner, "lock not released")
+}
+
+func TestDryRunDoesNotChangeTheDatabase(t *testing.T) {
+	db := newFakeSchemaDB()
+	db.version = 1
+	m := newTestSchemaMigrator(t, db)
+
+	var out bytes.Buffer
+	p, err := m.DryRun(context.Background(), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, p.From)
+	assert.Equal(t, 2, p.To)
+	assert.Equal(t, `schema "people-rw": version 1 -> 2
+  migration 2: backfill
+    run MATCH (p:Person) WHERE p.prefLabel IS NULL SET p.prefLabel = p.name
+`, out.String())
+	assert.Empty(t, db.applied)
+
+	db.version = 2
+	out.Reset()
+	_, err = m.DryRun(context.Background(), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "schema \"people-rw\" is up to date at version 2\n", out.String())
+}
+
+func TestPlanListsSchemaChanges(t *testing.T) {
+	m := newTestSchemaMigrator(t, newFakeSchemaDB())
+	assert.Equal(t, `schema "people-rw": version 0 -> 2
+  migration 1: people
+    create unique constraint on :Person(uuid)
+    create index on :Person(prefLabel)
+  migration 2: backfill
+    run MATCH (p:Person) WHERE p.prefLabel IS NULL SET p.prefLabel = p.name
+`, m.plan(0).String())
+}
+
+func TestMigrateUsesSchemaEnsurer(t *testing.T) {
+	db := &schemaEnsuringDB{newFakeSchemaDB(), &fakeSchemaManager{}}
+	manifest, err := ParseSchemaManifest([]byte(`
+name: people-rw
+migrations:
+  - version: 1
+    constraints:
+      - type: node_key
+        label: Person
+        properties: [authority, identifier]
+    indexes:
+      - name: names
+        type: fulltext
+        label: Person
+        properties: [prefLabel, aliases]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewSchemaMigrator(db, manifest, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+
+	assert.NoError(t, m.Migrate(context.Background()))
+	assert.Equal(t, []string{
+		"node key constraint on :Person(authority, identifier)",
+		"fulltext index names on :Person(prefLabel, aliases)",
+	}, db.sm.created)
+	assert.Equal(t, 1, db.version)
+
+	// without SchemaEnsurer, only what fits the IndexEnsurer maps can be applied
+	plain := newFakeSchemaDB()
+	m = NewSchemaMigrator(plain, manifest, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.Error(t, m.Migrate(context.Background()))
+	assert.Equal(t, 0, plain.version)
+}
+
+func TestMigrateAppliesSchemaThroughBackgroundConnection(t *testing.T) {
+	db := &schemaEnsuringDB{newFakeSchemaDB(), &fakeSchemaManager{err: errors.New("duplicate data")}}
+	conn, err := connectAuto("http://localhost:7474/db/data/", func() (NeoConnection, error) { return db, nil }, ReconnectPolicy{}, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRunner(context.Background(), conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.(ConnectionStateWatcher).WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m := newTestSchemaMigrator(t, db.fakeSchemaDB)
+	m.conn = conn
+
+	// the schema isn't just queued, so the version isn't recorded when it fails
+	err = m.Migrate(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 0, db.version)
+
+	db.sm.err = nil
+	assert.NoError(t, m.Migrate(ctx))
+	assert.Equal(t, 2, db.version)
+	assert.Equal(t, []string{"unique constraint on :Person(uuid)", "index on :Person(prefLabel)"}, db.sm.created)
+}
+
+func TestMigrateWaitsForLock(t *testing.T) {
+	db := newFakeSchemaDB()
+	db.lockOwner = "another instance"
+	db.lockExpires = time.Now().Add(time.Hour)
+	m := newTestSchemaMigrator(t, db)
+	m.lock.poll = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := m.Migrate(ctx)
+	assert.Error(t, err)
+	assert.Empty(t, db.applied)
+
+	// an expired lease can be taken over
+	db.lockExpires = time.Now().Add(-time.Second)
+	assert.NoError(t, m.Migrate(context.Background()))
+	assert.Equal(t, 2, db.version)
+}
+
+func TestSchemaLockIsExclusive(t *testing.T) {
+	db := newFakeSchemaDB()
+	first := newSchemaLock(db, "people-rw")
+	second := newSchemaLock(db, "people-rw")
+
+	_, release, err := first.acquire(context.Background())
+	assert.NoError(t, err)
+	ok, err := second.tryAcquire(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, release())
+	ok, err = second.tryAcquire(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSchemaLockRaceOnEmptyDatabase(t *testing.T) {
+	db := newFakeSchemaDB()
+	acquired := make(chan *schemaLock, 2)
+	failed := make(chan error, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		l := newSchemaLock(db, "people-rw")
+		l.poll = 5 * time.Millisecond
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if err := l.wait(ctx); err != nil {
+				failed <- err
+				return
+			}
+			acquired <- l
+		}()
+	}
+	wg.Wait()
+	close(acquired)
+	close(failed)
+
+	// both created the constraint, one of them finding it already exists
+	assert.Equal(t, []string{"CREATE CONSTRAINT FOR (n:`NeoUtilsSchemaLock`) REQUIRE n.`name` IS UNIQUE"}, db.constraints)
+	assert.Len(t, acquired, 1)
+	for err := range failed {
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), err.Error())
+	}
+	l := <-acquired
+	assert.Equal(t, l.owner, db.lockOwner)
+}
+
+func TestSchemaLockBypassesBatching(t *testing.T) {
+	db := newFakeSchemaDB()
+	batched := NewBatchCypherRunner(db, 10)
+	// a closed runner fails anything queued on it
+	assert.NoError(t, closeRunner(context.Background(), batched))
+	l := newSchemaLock(&DefaultNeoConnection{cr: batched}, "people-rw")
+
+	_, release, err := l.acquire(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, l.owner, db.lockOwner)
+	assert.NoError(t, release())
+	assert.Equal(t, "", db.lockOwner, "lock not released")
+}
+
+func TestSchemaLockLossCancelsContext(t *testing.T) {
+	db := newFakeSchemaDB()
+	l := newSchemaLock(db, "people-rw")
+	l.ttl = 30 * time.Millisecond
+
+	held, release, err := l.acquire(context.Background())
+	assert.NoError(t, err)
+	db.mu.Lock()
+	db.lockOwner = "another instance"
+	db.lockExpires = time.Now().Add(time.Hour)
+	db.mu.Unlock()
+
+	select {
+	case <-held.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled after losing the lock")
+	}
+	assert.Error(t, release())
+}
+
+func newTestSchemaMigrator(t *testing.T, db *fakeSchemaDB) *SchemaMigrator {
+	manifest, err := ParseSchemaManifest([]byte(testSchemaYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSchemaMigrator(db, manifest, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+}
+
+// fakeSchemaDB interprets the statements used by SchemaMigrator, recording the
+// schema changes and statements applied. The statement FAIL fails its batch.
+// Merging a lock or version node before its unique constraint exists fails, as
+// without the constraint a real database could create duplicates.
+type fakeSchemaDB struct {
+	mu          sync.Mutex
+	version     int
+	lockOwner   string
+	lockExpires time.Time
+	applied     []string
+	constraints []string
+}
+
+func newFakeSchemaDB() *fakeSchemaDB {
+	return &fakeSchemaDB{}
+}
+
+func (db *fakeSchemaDB) CypherBatch(queries []*neoism.CypherQuery) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// batches are transactions, so only keep their changes if they all succeed
+	var applied []string
+	version := db.version
+	for i, q := range queries {
+		var rows interface{}
+		switch {
+		case strings.HasPrefix(q.Statement, "CALL dbms.components()"):
+			rows = []map[string]interface{}{{"name": "Neo4j Kernel", "versions": []string{"4.4.0"}, "edition": "enterprise"}}
+		case strings.HasPrefix(q.Statement, "CREATE CONSTRAINT"):
+			if db.hasConstraint(q.Statement) {
+				return newNeo4jError("Neo.ClientError.Schema.EquivalentSchemaRuleAlreadyExists", "an equivalent constraint already exists", i)
+			}
+			db.constraints = append(db.constraints, q.Statement)
+		case strings.HasPrefix(q.Statement, "MERGE (l:NeoUtilsSchemaLock"):
+			if !db.hasConstraint(":`NeoUtilsSchemaLock`)") {
+				return fmt.Errorf("lock node merged without a unique constraint on its name")
+			}
+			owner := q.Parameters["owner"].(string)
+			if db.lockOwner == "" || db.lockOwner == owner || db.lockExpires.Before(time.Now()) {
+				db.lockOwner = owner
+				db.lockExpires = time.Now().Add(time.Duration(q.Parameters["ttl"].(int64)) * time.Millisecond)
+				rows = []map[string]interface{}{{"owner": owner}}
+			}
+		case strings.HasPrefix(q.Statement, "MATCH (l:NeoUtilsSchemaLock"):
+			if db.lockOwner == q.Parameters["owner"] {
+				db.lockOwner = ""
+			}
+		case strings.HasPrefix(q.Statement, "MATCH (v:NeoUtilsSchemaVersion"):
+			if db.version > 0 {
+				rows = []map[string]interface{}{{"version": db.version}}
+			}
+		case strings.HasPrefix(q.Statement, "MERGE (v:NeoUtilsSchemaVersion"):
+			if !db.hasConstraint(":`NeoUtilsSchemaVersion`)") {
+				return fmt.Errorf("version node merged without a unique constraint on its name")
+			}
+			version = q.Parameters["version"].(int)
+			applied = append(applied, "version "+strconv.Itoa(version))
+		case q.Statement == "FAIL":
+			return newNeo4jError("Neo.ClientError.Schema.ConstraintValidationFailed", "already exists", i)
+		default:
+			applied = append(applied, q.Statement)
+		}
+
+		if q.Result != nil {
+			b, _ := json.Marshal(rows)
+			if err := json.Unmarshal(b, q.Result); err != nil {
+				return err
+			}
+		}
+	}
+	db.version = version
+	db.applied = append(db.applied, applied...)
+	return nil
+}
+
+// hasConstraint reports whether a constraint statement containing s has been run.
+func (db *fakeSchemaDB) hasConstraint(s string) bool {
+	for _, c := range db.constraints {
+		if strings.Contains(c, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *fakeSchemaDB) EnsureConstraints(constraints map[string]string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for label, property := range constraints {
+		db.applied = append(db.applied, "constraint "+label+"."+property)
+	}
+	return nil
+}
+
+func (db *fakeSchemaDB) EnsureIndexes(indexes map[string]string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for label, property := range indexes {
+		db.applied = append(db.applied, "index "+label+"."+property)
+	}
+	return nil
+}
+
+// schemaEnsuringDB adds SchemaEnsurer to fakeSchemaDB.
+type schemaEnsuringDB struct {
+	*fakeSchemaDB
+	sm *fakeSchemaManager
+}
+
+func (db *schemaEnsuringDB) EnsureSchema(constraints []SchemaConstraint, indexes []SchemaIndex) error {
+	return EnsureSchema(db.sm, constraints, indexes, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+}
@@ -0,0 +1,231 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaSpecStrings(t *testing.T) {
+	assert.Equal(t, "index on :Person(prefLabel)", SchemaIndex{Label: "Person", Property: "prefLabel"}.String())
+	assert.Equal(t, "fulltext index names on :Concept(prefLabel, aliases)",
+		SchemaIndex{Name: "names", Type: FullTextIndex, Label: "Concept", Properties: []string{"prefLabel", "aliases"}}.String())
+	assert.Equal(t, "index on [:MENTIONS](score)", SchemaIndex{RelationshipType: "MENTIONS", Property: "score"}.String())
+	assert.Equal(t, "unique constraint on :Person(uuid)", SchemaConstraint{Label: "Person", Property: "uuid"}.String())
+	assert.Equal(t, "existence constraint on [:MENTIONS](platformVersion)",
+		SchemaConstraint{Type: ExistenceConstraint, RelationshipType: "MENTIONS", Property: "platformVersion"}.String())
+	assert.Equal(t, "node key constraint person_key on :Person(authority, identifier)",
+		SchemaConstraint{Name: "person_key", Type: NodeKeyConstraint, Label: "Person", Properties: []string{"authority", "identifier"}}.String())
+}
+
+func TestSchemaSpecValidation(t *testing.T) {
+	assert.NoError(t, SchemaIndex{Label: "Person", Properties: []string{"a", "b"}}.Validate())
+	assert.Error(t, SchemaIndex{Property: "a"}.Validate(), "no label or type")
+	assert.Error(t, SchemaIndex{Label: "Person", RelationshipType: "KNOWS", Property: "a"}.Validate(), "both label and type")
+	assert.Error(t, SchemaIndex{Label: "Person"}.Validate(), "no properties")
+	assert.Error(t, SchemaIndex{Label: "Person", Property: "a", Properties: []string{"b"}}.Validate(), "property and properties")
+	assert.Error(t, SchemaIndex{Type: FullTextIndex, Label: "Person", Property: "a"}.Validate(), "unnamed full-text index")
+	assert.Error(t, SchemaIndex{Type: "spatial", Label: "Person", Property: "a"}.Validate(), "unknown type")
+
+	assert.NoError(t, SchemaConstraint{Type: ExistenceConstraint, RelationshipType: "KNOWS", Property: "since"}.Validate())
+	assert.Error(t, SchemaConstraint{RelationshipType: "KNOWS", Property: "since"}.Validate(), "unique relationship constraint")
+	assert.Error(t, SchemaConstraint{Type: NodeKeyConstraint, RelationshipType: "KNOWS", Property: "since"}.Validate(), "relationship node key")
+	assert.Error(t, SchemaConstraint{Type: ExistenceConstraint, Label: "Person", Properties: []string{"a", "b"}}.Validate(), "composite existence")
+	assert.Error(t, SchemaConstraint{Type: "other", Label: "Person", Property: "a"}.Validate(), "unknown type")
+}
+
+func TestEnsureSchemaOnlyCreatesMissingSchema(t *testing.T) {
+	sm := &fakeSchemaManager{
+		indexes:     []SchemaIndex{{Name: "index_1", Type: RangeIndex, Label: "Person", Properties: []string{"prefLabel"}}},
+		constraints: []SchemaConstraint{{Name: "constraint_1", Type: UniqueConstraint, Label: "Person", Properties: []string{"uuid"}}},
+	}
+	constraints := []SchemaConstraint{
+		{Label: "Person", Property: "uuid"},
+		{Type: NodeKeyConstraint, Label: "Person", Properties: []string{"authority", "identifier"}},
+	}
+	indexes := []SchemaIndex{
+		{Label: "Person", Property: "prefLabel"},
+		// covered by the node key constraint
+		{Label: "Person", Properties: []string{"authority", "identifier"}},
+		{Name: "names", Type: FullTextIndex, Label: "Person", Properties: []string{"prefLabel", "aliases"}},
+	}
+	log := logger.NewUPPLogger("neo-utils-go-test", "PANIC")
+
+	assert.NoError(t, EnsureSchema(sm, constraints, indexes, log))
+	assert.Equal(t, []string{
+		"node key constraint on :Person(authority, identifier)",
+		"fulltext index names on :Person(prefLabel, aliases)",
+	}, sm.created)
+
+	// everything exists now
+	sm.created = nil
+	assert.NoError(t, EnsureSchema(sm, constraints, indexes, log))
+	assert.Empty(t, sm.created)
+}
+
+func TestEnsureSchemaValidatesFirst(t *testing.T) {
+	sm := &fakeSchemaManager{}
+	err := EnsureSchema(sm, []SchemaConstraint{{Label: "Person", Property: "uuid"}}, []SchemaIndex{{Label: "Person"}}, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.Error(t, err)
+	assert.Empty(t, sm.created)
+}
+
+func TestEnsureSchemaReportsFailures(t *testing.T) {
+	sm := &fakeSchemaManager{err: errors.New("boom")}
+	err := EnsureSchema(sm, []SchemaConstraint{{Label: "Person", Property: "uuid"}}, nil, logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.EqualError(t, err, "cannot create unique constraint on :Person(uuid): boom")
+}
+
+func TestEnsureSchemaToleratesConcurrentCreation(t *testing.T) {
+	sm := &fakeSchemaManager{err: newNeo4jError("Neo.ClientError.Schema.EquivalentSchemaRuleAlreadyExists", "An equivalent constraint already exists", 0)}
+	err := EnsureSchema(sm, []SchemaConstraint{{Label: "Person", Property: "uuid"}}, []SchemaIndex{{Label: "Person", Property: "prefLabel"}},
+		logger.NewUPPLogger("neo-utils-go-test", "PANIC"))
+	assert.NoError(t, err)
+}
+
+func TestEnsureSchemaTakesLockWhenSchemaIsMissing(t *testing.T) {
+	db := newFakeSchemaDB()
+	sm := &fakeSchemaManager{}
+	ie := &defaultIndexEnsurer{
+		im:   &recordingIndexManager{},
+		sm:   sm,
+		lock: newSchemaLock(db, ensureSchemaLockName),
+		opts: SchemaOptions{Lock: true, LockTimeout: 30 * time.Millisecond},
+		log:  logger.NewUPPLogger("neo-utils-go-test", "PANIC"),
+	}
+	ie.lock.poll = time.Millisecond
+	constraints := []SchemaConstraint{{Label: "Person", Property: "uuid"}}
+
+	// another instance is applying schema
+	db.lockOwner = "another instance"
+	db.lockExpires = time.Now().Add(time.Hour)
+	err := ie.EnsureSchema(constraints, nil)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Empty(t, sm.created)
+
+	db.lockOwner = ""
+	assert.NoError(t, ie.EnsureSchema(constraints, nil))
+	assert.Equal(t, []string{"unique constraint on :Person(uuid)"}, sm.created)
+	assert.Equal(t, "", db.lockOwner, "lock not released")
+
+	// nothing to do, so no need to wait for the lock
+	db.lockOwner = "another instance"
+	assert.NoError(t, ie.EnsureSchema(constraints, nil))
+}
+
+func TestEnsureSchemaStopsWhenLockIsLost(t *testing.T) {
+	db := newFakeSchemaDB()
+	sm := &fakeSchemaManager{}
+	ie := &defaultIndexEnsurer{
+		sm:   &stealingSchemaManager{fakeSchemaManager: sm, db: db},
+		lock: newSchemaLock(db, ensureSchemaLockName),
+		opts: SchemaOptions{Lock: true},
+		log:  logger.NewUPPLogger("neo-utils-go-test", "PANIC"),
+	}
+	ie.lock.ttl = 30 * time.Millisecond
+
+	err := ie.EnsureSchema([]SchemaConstraint{{Label: "Person", Property: "uuid"}, {Label: "Thing", Property: "uuid"}}, nil)
+	assert.True(t, errors.Is(err, errSchemaLockLost), "got %v", err)
+	assert.Equal(t, []string{"unique constraint on :Person(uuid)"}, sm.created)
+}
+
+// stealingSchemaManager has another instance take over the schema lock while
+// its first constraint is being created, until the lease has been lost.
+type stealingSchemaManager struct {
+	*fakeSchemaManager
+	db     *fakeSchemaDB
+	stolen bool
+}
+
+func (sm *stealingSchemaManager) CreateSchemaConstraint(constraint SchemaConstraint) error {
+	if !sm.stolen {
+		sm.stolen = true
+		sm.db.mu.Lock()
+		sm.db.lockOwner = "another instance"
+		sm.db.lockExpires = time.Now().Add(time.Hour)
+		sm.db.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	return sm.fakeSchemaManager.CreateSchemaConstraint(constraint)
+}
+
+// fakeSchemaManager records the indexes and constraints created and dropped in it.
+type fakeSchemaManager struct {
+	indexes     []SchemaIndex
+	constraints []SchemaConstraint
+	created     []string
+	dropped     []string
+	err         error
+	// populate, if set, reports index states; otherwise indexes are ONLINE
+	populate func(i SchemaIndex) SchemaIndexStatus
+}
+
+func (sm *fakeSchemaManager) SchemaIndexes() ([]SchemaIndex, error) {
+	return sm.indexes, nil
+}
+
+func (sm *fakeSchemaManager) SchemaConstraints() ([]SchemaConstraint, error) {
+	return sm.constraints, nil
+}
+
+func (sm *fakeSchemaManager) SchemaIndexStatuses() ([]SchemaIndexStatus, error) {
+	var statuses []SchemaIndexStatus
+	for _, i := range sm.indexes {
+		if sm.populate != nil {
+			statuses = append(statuses, sm.populate(i))
+		} else {
+			statuses = append(statuses, SchemaIndexStatus{SchemaIndex: i, State: IndexOnline, PopulationPercent: 100})
+		}
+	}
+	return statuses, nil
+}
+
+func (sm *fakeSchemaManager) CreateSchemaIndex(index SchemaIndex) error {
+	if sm.err != nil {
+		return sm.err
+	}
+	sm.indexes = append(sm.indexes, index)
+	sm.created = append(sm.created, index.String())
+	return nil
+}
+
+func (sm *fakeSchemaManager) CreateSchemaConstraint(constraint SchemaConstraint) error {
+	if sm.err != nil {
+		return sm.err
+	}
+	sm.constraints = append(sm.constraints, constraint)
+	sm.created = append(sm.created, constraint.String())
+	return nil
+}
+
+func (sm *fakeSchemaManager) DropSchemaIndex(index SchemaIndex) error {
+	if sm.err != nil {
+		return sm.err
+	}
+	for n, i := range sm.indexes {
+		if i.Name == index.Name && i.Matches(index) {
+			sm.indexes = append(sm.indexes[:n], sm.indexes[n+1:]...)
+			break
+		}
+	}
+	sm.dropped = append(sm.dropped, index.String())
+	return nil
+}
+
+func (sm *fakeSchemaManager) DropSchemaConstraint(constraint SchemaConstraint) error {
+	if sm.err != nil {
+		return sm.err
+	}
+	for n, c := range sm.constraints {
+		if c.Name == constraint.Name && c.Matches(constraint) {
+			sm.constraints = append(sm.constraints[:n], sm.constraints[n+1:]...)
+			break
+		}
+	}
+	sm.dropped = append(sm.dropped, constraint.String())
+	return nil
+}
@@ -1,30 +1,249 @@
 package neoutils
 
 import (
-	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
 	"github.com/jmcvetta/neoism"
 )
 
-type TransactionalCypherRunner struct{ DB *neoism.Database }
+type TransactionalCypherRunner struct {
+	DB *neoism.Database
+	// Database is the database to run queries against, using the Neo4j 4
+	// HTTP API. Blank means the server's default database. Neo4j 4 doesn't
+	// serve /db/data/, so DB must be connected to the server root, e.g.
+	// http://localhost:7474/.
+	Database string
+}
+
+func (cr TransactionalCypherRunner) address() string {
+	return urlHost(cr.DB.Url)
+}
 
 func (cr TransactionalCypherRunner) String() string {
 	return cr.DB.Url
 }
 
 func (cr TransactionalCypherRunner) CypherBatch(queries []*neoism.CypherQuery) error {
-	tx, err := cr.DB.Begin(queries)
+	return cr.CypherBatchContext(context.Background(), queries)
+}
+
+// CypherBatchContext runs the queries in a single transaction, aborting any
+// in-flight HTTP request when ctx is done. A context error doesn't mean the
+// queries weren't written: if ctx is done while the commit is in flight, the
+// server may already have committed them, so don't blindly run a batch that
+// isn't idempotent again.
+func (cr TransactionalCypherRunner) CypherBatchContext(ctx context.Context, queries []*neoism.CypherQuery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db, err := cr.forDatabase(cr.withContext(ctx))
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin(queries)
 	if err != nil {
 		if tx != nil {
-			tx.Rollback()
+			rollbackREST(cr.DB, tx)
+		}
+		return txError(ctx, tx, queries, err)
+	}
+	if err := tx.Commit(); err != nil {
+		if ctx.Err() != nil {
+			// the commit was abandoned, so the transaction may still be
+			// open, holding its locks until the server times it out
+			rollbackREST(cr.DB, tx)
+		}
+		return txError(ctx, tx, nil, err)
+	}
+	return nil
+}
+
+// rollbackREST rolls tx back using db, whose requests aren't bound to a
+// context, so that it works once the context tx was begun with is done.
+func rollbackREST(db *neoism.Database, tx *neoism.Tx) error {
+	var ne neoism.NeoError
+	resp, err := db.Session.Delete(tx.Location, nil, nil, &ne)
+	if err != nil {
+		return err
+	}
+	if resp.Status() != http.StatusOK {
+		return ne
+	}
+	return nil
+}
+
+// txError converts the error from running queries in tx, which may be nil,
+// to a statement error, or to ctx's error if ctx caused it.
+func txError(ctx context.Context, tx *neoism.Tx, queries []*neoism.CypherQuery, err error) error {
+	if err == neoism.TxQueryError && tx != nil && len(tx.Errors) > 0 {
+		// the REST API doesn't say which statement failed unless there's only one
+		index := -1
+		if len(queries) == 1 {
+			index = 0
 		}
-		if err == neoism.TxQueryError {
-			txErr := rwapi.ConstraintOrTransactionError{Message: err.Error()}
+		neoErr := newNeo4jError(tx.Errors[0].Code, tx.Errors[0].Message, index)
+		if len(tx.Errors) > 1 {
 			for _, e := range tx.Errors {
-				txErr.Details = append(txErr.Details, e.Message)
+				neoErr.details = append(neoErr.details, e.Message)
 			}
-			err = txErr
 		}
-		return err
+		return statementError(neoErr)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// BeginTx opens a transaction, which is rolled back if ctx is done before it
+// is committed.
+func (cr TransactionalCypherRunner) BeginTx(ctx context.Context) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db, err := cr.forDatabase(cr.withContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin([]*neoism.CypherQuery{})
+	if err != nil {
+		return nil, txError(ctx, nil, nil, err)
+	}
+	t := &restTx{ctx: ctx, tx: tx, db: cr.DB, ended: make(chan struct{})}
+	go t.watch()
+	return t, nil
+}
+
+// restTx is a transaction open on the REST API. Its requests are bound to
+// ctx, apart from the rollback when ctx is done, which uses db.
+type restTx struct {
+	ctx context.Context
+	tx  *neoism.Tx
+	db  *neoism.Database
+
+	lk sync.Mutex
+	// err is returned once the transaction has ended
+	err   error
+	ended chan struct{}
+}
+
+func (t *restTx) watch() {
+	select {
+	case <-t.ctx.Done():
+	case <-t.ended:
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.err == nil {
+		t.end()
+		t.rollback()
+	}
+}
+
+// end must be called holding lk.
+func (t *restTx) end() {
+	t.err = txDoneError(t.ctx)
+	close(t.ended)
+}
+
+// rollback deletes the transaction, whether or not ctx is done.
+func (t *restTx) rollback() error {
+	return rollbackREST(t.db, t.tx)
+}
+
+func (t *restTx) Run(queries []*neoism.CypherQuery) error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	if err := t.tx.Query(queries); err != nil {
+		// the server rolls back a transaction when a query fails, but not
+		// when the request is interrupted
+		t.end()
+		t.rollback()
+		return txError(t.ctx, t.tx, queries, err)
+	}
+	return nil
+}
+
+func (t *restTx) Commit() error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	t.end()
+	if err := t.tx.Commit(); err != nil {
+		if t.ctx.Err() != nil {
+			t.rollback()
+		}
+		return txError(t.ctx, t.tx, nil, err)
+	}
+	return nil
+}
+
+func (t *restTx) Rollback() error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	t.end()
+	return t.rollback()
+}
+
+// forDatabase returns db, or a copy of it that begins transactions in
+// cr.Database.
+func (cr TransactionalCypherRunner) forDatabase(db *neoism.Database) (*neoism.Database, error) {
+	if cr.Database == "" {
+		return db, nil
+	}
+	u, err := url.Parse(db.Url)
+	if err != nil {
+		return nil, err
+	}
+	dbCopy := *db
+	dbCopy.HrefTransaction = fmt.Sprintf("%s://%s/db/%s/tx", u.Scheme, u.Host, url.PathEscape(cr.Database))
+	return &dbCopy, nil
+}
+
+// withContext returns a copy of the database whose HTTP requests are bound to ctx.
+func (cr TransactionalCypherRunner) withContext(ctx context.Context) *neoism.Database {
+	if ctx.Done() == nil {
+		return cr.DB
+	}
+
+	client := http.DefaultClient
+	if cr.DB.Session.Client != nil {
+		client = cr.DB.Session.Client
+	}
+	boundClient := *client
+	boundClient.Transport = contextTransport{ctx, client.Transport}
+
+	session := *cr.DB.Session
+	session.Client = &boundClient
+
+	db := *cr.DB
+	db.Session = &session
+	return &db
+}
+
+// contextTransport attaches a context to every request it sends.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
 	}
-	return tx.Commit()
+	return base.RoundTrip(req.WithContext(t.ctx))
 }
@@ -0,0 +1,69 @@
+package neoutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// ErrTxDone is wrapped by the error returned when using a transaction that
+// has already been committed or rolled back, including by a failed query or
+// its context.
+var ErrTxDone = errors.New("neoutils: transaction has already been committed or rolled back")
+
+// Tx is a transaction that stays open across calls to Run, so that queries
+// can depend on the results of earlier ones. It is rolled back if a query
+// fails, or when the context it was begun with is done.
+type Tx interface {
+	// Run runs the queries in the transaction, decoding their results.
+	Run(queries []*neoism.CypherQuery) error
+	Commit() error
+	// Rollback returns an error wrapping ErrTxDone if the transaction has
+	// already ended, so it can be deferred.
+	Rollback() error
+}
+
+// TxBeginner is implemented by connections and runners that can begin
+// explicit transactions.
+type TxBeginner interface {
+	BeginTx(ctx context.Context) (Tx, error)
+}
+
+// txDoneError returns the error for using a transaction that has ended,
+// saying if ctx ended it.
+func txDoneError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrTxDone, err)
+	}
+	return ErrTxDone
+}
+
+// beginTx begins a transaction with cr, or returns an error if it can't
+// begin transactions, like the non-transactional REST runner.
+func beginTx(ctx context.Context, cr CypherRunner) (Tx, error) {
+	b, ok := cr.(TxBeginner)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot begin transactions", cr)
+	}
+	return b.BeginTx(ctx)
+}
+
+// WithTransaction runs f in a transaction begun with cr and commits it, or
+// rolls it back if f returns an error. The whole of f is run again in a new
+// transaction when it fails with a transient error, as policy allows, so f
+// must not have other side effects. DefaultRetryPolicy suits most uses.
+func WithTransaction(ctx context.Context, cr CypherRunner, policy RetryPolicy, f func(tx Tx) error) error {
+	return retry(ctx, policy, "transaction", func() error {
+		tx, err := beginTx(ctx, cr)
+		if err != nil {
+			return err
+		}
+		if err := f(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
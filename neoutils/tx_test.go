@@ -0,0 +1,249 @@
+package neoutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltTxRunsQueriesAndCommits(t *testing.T) {
+	s := newFakeBoltServer(t, func(req *packStreamStruct) []*packStreamStruct {
+		switch req.Tag {
+		case boltMsgRun:
+			return []*packStreamStruct{boltFields("n")}
+		case boltMsgPull:
+			return []*packStreamStruct{boltRecord(int64(41)), boltSuccess(map[string]interface{}{})}
+		}
+		return nil
+	})
+	defer s.close()
+	cr := newTestBoltRunner(t, s)
+
+	tx, err := cr.BeginTx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []struct {
+		N int `json:"n"`
+	}
+	assert.NoError(t, tx.Run([]*neoism.CypherQuery{{Statement: "MATCH (c:Counter) RETURN c.n AS n", Result: &res}}))
+	assert.Equal(t, 41, res[0].N)
+	assert.NoError(t, tx.Run([]*neoism.CypherQuery{{Statement: "MATCH (c:Counter) SET c.n = $n", Parameters: map[string]interface{}{"n": res[0].N + 1}}}))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, ErrTxDone, tx.Rollback())
+
+	assert.Equal(t, []byte{boltMsgHello, boltMsgBegin, boltMsgRun, boltMsgPull, boltMsgRun, boltMsgPull, boltMsgCommit}, s.tags())
+
+	// the connection went back to the pool
+	assert.NoError(t, cr.CypherBatch([]*neoism.CypherQuery{}))
+	assert.Equal(t, 1, s.connections())
+}
+
+func TestBoltTxRollsBack(t *testing.T) {
+	s := newFakeBoltServer(t, nil)
+	defer s.close()
+	cr := newTestBoltRunner(t, s)
+
+	tx, err := cr.BeginTx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, tx.Rollback())
+	assert.Equal(t, ErrTxDone, tx.Commit())
+	assert.Equal(t, []byte{boltMsgHello, boltMsgBegin, boltMsgRollback}, s.tags())
+}
+
+func TestBoltTxRolledBackOnTimeout(t *testing.T) {
+	s := newFakeBoltServer(t, nil)
+	defer s.close()
+	cr := newTestBoltRunner(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tx, err := cr.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+	time.Sleep(10 * time.Millisecond)
+
+	err = tx.Run([]*neoism.CypherQuery{{Statement: "RETURN 1"}})
+	assert.True(t, errors.Is(err, ErrTxDone), "got %v", err)
+	assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+
+	// the connection was closed, so the server rolls the transaction back
+	assert.NoError(t, cr.CypherBatch([]*neoism.CypherQuery{}))
+	assert.Equal(t, 2, s.connections())
+}
+
+// newTestTxAPI serves a transaction on the REST API, recording the requests
+// made to it.
+func newTestTxAPI(t *testing.T, query func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *neoism.Database, func() []string) {
+	var lk sync.Mutex
+	var requests []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/db/data/" {
+			json.NewEncoder(w).Encode(map[string]string{"neo4j_version": "3.5.0", "transaction": srv.URL + "/db/data/transaction"})
+			return
+		}
+		lk.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		lk.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/db/data/transaction":
+			writeTestTx(w, r, `[]`, `[]`)
+		case r.Method == http.MethodPost && r.URL.Path == "/db/data/transaction/1":
+			query(w, r)
+		case r.URL.Path == "/db/data/transaction/1/commit" || r.Method == http.MethodDelete:
+			w.Write([]byte(`{"results":[],"errors":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	db, err := neoism.Connect(srv.URL + "/db/data/")
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return srv, db, func() []string {
+		lk.Lock()
+		defer lk.Unlock()
+		return requests
+	}
+}
+
+func TestRESTTxRunsQueriesAndCommits(t *testing.T) {
+	srv, db, requests := newTestTxAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[{"columns":["n"],"data":[{"row":[41]}]}],"errors":[]}`))
+	})
+	defer srv.Close()
+
+	tx, err := TransactionalCypherRunner{DB: db}.BeginTx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []struct {
+		N int `json:"n"`
+	}
+	assert.NoError(t, tx.Run([]*neoism.CypherQuery{{Statement: "MATCH (c:Counter) RETURN c.n AS n", Result: &res}}))
+	assert.Equal(t, 41, res[0].N)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, ErrTxDone, tx.Commit())
+	assert.Equal(t, []string{"POST /db/data/transaction", "POST /db/data/transaction/1", "POST /db/data/transaction/1/commit"}, requests())
+}
+
+func TestRESTTxStatementErrorEndsTransaction(t *testing.T) {
+	srv, db, requests := newTestTxAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[],"errors":[{"code":"Neo.ClientError.Statement.SyntaxError","message":"bad"}]}`))
+	})
+	defer srv.Close()
+
+	tx, err := TransactionalCypherRunner{DB: db}.BeginTx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Run([]*neoism.CypherQuery{{Statement: "RETRUN 1"}})
+	var neoErr *Neo4jError
+	if assert.True(t, errors.As(err, &neoErr)) {
+		assert.Equal(t, "Neo.ClientError.Statement.SyntaxError", neoErr.Code)
+		assert.Equal(t, 0, neoErr.StatementIndex)
+	}
+	assert.Equal(t, ErrTxDone, tx.Rollback())
+	assert.Equal(t, "DELETE /db/data/transaction/1", requests()[2])
+}
+
+func TestRESTTxRolledBackOnTimeout(t *testing.T) {
+	srv, db, requests := newTestTxAPI(t, nil)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := TransactionalCypherRunner{DB: db}.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(requests()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("transaction was not rolled back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "DELETE /db/data/transaction/1", requests()[1])
+	assert.True(t, errors.Is(tx.Commit(), ErrTxDone))
+}
+
+func TestBeginTxNeedsTransactions(t *testing.T) {
+	_, err := (&DefaultNeoConnection{cr: &schemaListingRunner{}}).BeginTx(context.Background())
+	assert.Error(t, err)
+}
+
+// fakeTx records what happens to a transaction.
+type fakeTx struct {
+	events *[]string
+	commit error
+}
+
+func (tx *fakeTx) Run(queries []*neoism.CypherQuery) error {
+	*tx.events = append(*tx.events, "run")
+	return nil
+}
+
+func (tx *fakeTx) Commit() error {
+	*tx.events = append(*tx.events, "commit")
+	return tx.commit
+}
+
+func (tx *fakeTx) Rollback() error {
+	*tx.events = append(*tx.events, "rollback")
+	return nil
+}
+
+// txRunner begins fakeTxs, whose commits fail with the errors in commits.
+type txRunner struct {
+	schemaListingRunner
+	events  []string
+	commits []error
+}
+
+func (cr *txRunner) BeginTx(ctx context.Context) (Tx, error) {
+	cr.events = append(cr.events, "begin")
+	var commit error
+	if len(cr.commits) > 0 {
+		commit, cr.commits = cr.commits[0], cr.commits[1:]
+	}
+	return &fakeTx{&cr.events, commit}, nil
+}
+
+func TestWithTransactionRetriesTransientErrors(t *testing.T) {
+	cr := &txRunner{commits: []error{newNeo4jError("Neo.TransientError.Transaction.DeadlockDetected", "deadlock", -1)}}
+	calls := 0
+	err := WithTransaction(context.Background(), cr, RetryPolicy{MaxAttempts: 3}, func(tx Tx) error {
+		calls++
+		return tx.Run([]*neoism.CypherQuery{{Statement: "RETURN 1"}})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []string{"begin", "run", "commit", "begin", "run", "commit"}, cr.events)
+}
+
+func TestWithTransactionRollsBackOnError(t *testing.T) {
+	cr := &txRunner{}
+	failed := errors.New("not found")
+	err := WithTransaction(context.Background(), cr, RetryPolicy{MaxAttempts: 3}, func(tx Tx) error {
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	assert.Equal(t, []string{"begin", "rollback"}, cr.events)
+}
@@ -0,0 +1,248 @@
+package neoutils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmcvetta/neoism"
+)
+
+// Cluster roles reported by WritableStatus.
+const (
+	RoleLeader      = "LEADER"
+	RoleFollower    = "FOLLOWER"
+	RoleReadReplica = "READ_REPLICA"
+	// RoleStandalone is a server that isn't part of a cluster, which is always writable.
+	RoleStandalone = "STANDALONE"
+)
+
+// WritableStatus describes whether the server a CypherRunner is connected to
+// accepts writes for a database.
+type WritableStatus struct {
+	Writable bool
+	// Role is one of the Role constants, or another role reported by the server.
+	Role string
+	// Database is blank for Neo4j 3.x, which has a single database.
+	Database string
+	// Address is the host and port connected to, if known.
+	Address string
+	Version string
+	Edition string
+}
+
+func (s *WritableStatus) String() string {
+	var b strings.Builder
+	b.WriteString(s.Role)
+	if s.Database != "" {
+		fmt.Fprintf(&b, " for database %s", s.Database)
+	}
+	if s.Address != "" {
+		fmt.Fprintf(&b, " at %s", s.Address)
+	}
+	fmt.Fprintf(&b, " (Neo4j %s %s)", s.Version, s.Edition)
+	return b.String()
+}
+
+// CheckWritable calls the dbms.cluster.role() procedure and verifies the role if it's LEADER or not.
+// Standalone servers are writable. See CheckWritableDatabase for details.
+func CheckWritable(cr CypherRunner) error {
+	status, err := CheckWritableDatabase(cr, "")
+	if err != nil {
+		return err
+	}
+	if !status.Writable {
+		return errors.New("role has to be LEADER for writing but it's " + status.Role)
+	}
+	return nil
+}
+
+// kernelVersion returns the version and edition of the server cr is
+// connected to.
+func kernelVersion(cr CypherRunner) (version string, edition string, err error) {
+	var components []struct {
+		Name     string   `json:"name"`
+		Versions []string `json:"versions"`
+		Edition  string   `json:"edition"`
+	}
+	err = cr.CypherBatch([]*neoism.CypherQuery{{
+		Statement: `CALL dbms.components() YIELD name, versions, edition RETURN name, versions, edition`,
+		Result:    &components,
+	}})
+	if err != nil {
+		return "", "", err
+	}
+	for _, c := range components {
+		if c.Name == "Neo4j Kernel" && len(c.Versions) > 0 {
+			version, edition = c.Versions[0], c.Edition
+		}
+	}
+	return version, edition, nil
+}
+
+// CheckWritableDatabase reports whether the server cr is connected to accepts
+// writes for database, or for the default database if it is blank. The
+// server's version and edition select the procedure to call: Community
+// Edition and servers outside a cluster are standalone, Neo4j 3.x clusters
+// have a single database, and from Neo4j 4 the role is per database. Neo4j 5
+// has no cluster mode, so its role comes from SHOW DATABASE instead.
+func CheckWritableDatabase(cr CypherRunner, database string) (*WritableStatus, error) {
+	status := &WritableStatus{}
+	var err error
+	status.Version, status.Edition, err = kernelVersion(cr)
+	if err != nil {
+		return nil, err
+	}
+	major, _ := parseServerVersion(status.Version)
+
+	if major >= 4 {
+		status.Database = database
+		if status.Database == "" {
+			if status.Database, err = currentDatabase(cr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if a, ok := cr.(addresser); ok {
+		status.Address = a.address()
+	}
+
+	if status.Edition == "community" {
+		status.Role, status.Writable = RoleStandalone, true
+		return status, nil
+	}
+	if major >= 5 {
+		if err := databaseRole(cr, status); err != nil {
+			return nil, err
+		}
+		return status, nil
+	}
+	// rather than calling it and failing, which would fail any queries
+	// batched with it
+	clustered, err := hasProcedure(cr, "dbms.cluster.role")
+	if err != nil {
+		return nil, err
+	}
+	if !clustered {
+		status.Role, status.Writable = RoleStandalone, true
+		return status, nil
+	}
+
+	var res []struct {
+		Role string `json:"role"`
+	}
+	query := &neoism.CypherQuery{
+		Statement: `CALL dbms.cluster.role()`,
+		Result:    &res,
+	}
+	if major >= 4 {
+		query.Statement = `CALL dbms.cluster.role($database)`
+		query.Parameters = map[string]interface{}{"database": status.Database}
+	}
+	if err := cr.CypherBatch([]*neoism.CypherQuery{query}); err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 || res[0].Role == "" {
+		return nil, errors.New("got empty response from dbms.cluster.role()")
+	}
+	status.Role = strings.ToUpper(res[0].Role)
+	status.Writable = status.Role == RoleLeader || status.Role == RoleStandalone
+	return status, nil
+}
+
+// databaseRole sets the role of the server cr is connected to from SHOW
+// DATABASE, which from Neo4j 5 lists a row for each server hosting the
+// database. Primaries other than the writer are reported as followers and
+// secondaries as read replicas, as for earlier versions.
+func databaseRole(cr CypherRunner, status *WritableStatus) error {
+	var res []struct {
+		Role    string `json:"role"`
+		Writer  bool   `json:"writer"`
+		Address string `json:"address"`
+	}
+	err := cr.CypherBatch([]*neoism.CypherQuery{{
+		Statement:  `SHOW DATABASE $database YIELD role, writer, address`,
+		Parameters: map[string]interface{}{"database": status.Database},
+		Result:     &res,
+	}})
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("database %s not found by SHOW DATABASE", status.Database)
+	}
+	row := 0
+	if len(res) > 1 {
+		row = -1
+		for i, r := range res {
+			if status.Address != "" && r.Address == status.Address {
+				row = i
+			}
+		}
+		if row < 0 {
+			return fmt.Errorf("cannot tell which of the %d servers hosting database %s is %q", len(res), status.Database, status.Address)
+		}
+	}
+
+	status.Writable = res[row].Writer
+	switch role := strings.ToUpper(res[row].Role); {
+	case status.Writable:
+		status.Role = RoleLeader
+	case role == "PRIMARY":
+		status.Role = RoleFollower
+	case role == "SECONDARY":
+		status.Role = RoleReadReplica
+	default:
+		status.Role = role
+	}
+	return nil
+}
+
+// currentDatabase returns the name of the database queries run against by default.
+func currentDatabase(cr CypherRunner) (string, error) {
+	var res []struct {
+		Name string `json:"name"`
+	}
+	err := cr.CypherBatch([]*neoism.CypherQuery{{
+		Statement: `CALL db.info() YIELD name RETURN name`,
+		Result:    &res,
+	}})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 0 {
+		return "", errors.New("got empty response from db.info()")
+	}
+	return res[0].Name, nil
+}
+
+// hasProcedure reports whether the server has a procedure. The cluster
+// procedures are only registered in cluster mode.
+func hasProcedure(cr CypherRunner, name string) (bool, error) {
+	var res []struct {
+		Name string `json:"name"`
+	}
+	err := cr.CypherBatch([]*neoism.CypherQuery{{
+		Statement:  `CALL dbms.procedures() YIELD name WHERE name = $name RETURN name`,
+		Parameters: map[string]interface{}{"name": name},
+		Result:     &res,
+	}})
+	return len(res) > 0, err
+}
+
+// addresser is implemented by connections and runners that know the address
+// of the server they connect to.
+type addresser interface {
+	address() string
+}
+
+// urlHost returns the host and port of a URL, or the URL itself if it can't be parsed.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Host
+}
@@ -0,0 +1,126 @@
+package neoutils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jmcvetta/neoism"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckWritableNeo3Cluster(t *testing.T) {
+	cr := newScriptedRunner("3.5.12", "enterprise", `[{"name": "dbms.cluster.role"}]`, `[{"role": "FOLLOWER"}]`)
+
+	status, err := CheckWritableDatabase(cr, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &WritableStatus{Role: RoleFollower, Version: "3.5.12", Edition: "enterprise"}, status)
+	assert.EqualError(t, CheckWritable(cr), "role has to be LEADER for writing but it's FOLLOWER")
+	assert.Contains(t, cr.statements, "CALL dbms.cluster.role()")
+}
+
+func TestCheckWritableNeo4DatabaseRole(t *testing.T) {
+	cr := newScriptedRunner("4.4.12", "enterprise", `[{"name": "dbms.cluster.role"}]`, `[{"role": "leader"}]`)
+
+	status, err := CheckWritableDatabase(cr, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &WritableStatus{Writable: true, Role: RoleLeader, Database: "neo4j", Version: "4.4.12", Edition: "enterprise"}, status)
+	assert.Equal(t, map[string]interface{}{"database": "neo4j"}, cr.parameters["CALL dbms.cluster.role($database)"])
+
+	_, err = CheckWritableDatabase(cr, "people")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"database": "people"}, cr.parameters["CALL dbms.cluster.role($database)"])
+	assert.NoError(t, CheckWritable(cr))
+}
+
+func TestCheckWritableNeo5ClusterFollower(t *testing.T) {
+	cr := &addressedRunner{newScriptedRunner("5.13.0", "enterprise", `[]`, `[
+		{"role": "primary", "writer": true, "address": "neo4j-1:7687"},
+		{"role": "primary", "writer": false, "address": "neo4j-0:7687"},
+		{"role": "secondary", "writer": false, "address": "neo4j-2:7687"}
+	]`)}
+
+	status, err := CheckWritableDatabase(cr, "people")
+	assert.NoError(t, err)
+	assert.Equal(t, &WritableStatus{Role: RoleFollower, Database: "people", Address: "neo4j-0:7687", Version: "5.13.0", Edition: "enterprise"}, status)
+	assert.Equal(t, map[string]interface{}{"database": "people"}, cr.parameters["SHOW DATABASE $database YIELD role, writer, address"])
+	assert.NotContains(t, cr.statements, "SHOW PROCEDURES YIELD name WHERE name = $name RETURN name")
+	assert.EqualError(t, CheckWritable(cr), "role has to be LEADER for writing but it's FOLLOWER")
+
+	// without knowing its address, the server can't be picked out
+	_, err = CheckWritableDatabase(cr.scriptedRunner, "people")
+	assert.Error(t, err)
+}
+
+func TestCheckWritableNeo5SingleServer(t *testing.T) {
+	cr := newScriptedRunner("5.13.0", "enterprise", `[]`, `[{"role": "primary", "writer": true, "address": "localhost:7687"}]`)
+	status, err := CheckWritableDatabase(cr, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &WritableStatus{Writable: true, Role: RoleLeader, Database: "neo4j", Version: "5.13.0", Edition: "enterprise"}, status)
+}
+
+func TestCheckWritableStandalone(t *testing.T) {
+	cr := newScriptedRunner("4.4.12", "enterprise", `[]`, `[]`)
+	status, err := CheckWritableDatabase(cr, "neo4j")
+	assert.NoError(t, err)
+	assert.Equal(t, &WritableStatus{Writable: true, Role: RoleStandalone, Database: "neo4j", Version: "4.4.12", Edition: "enterprise"}, status)
+	assert.Contains(t, cr.statements, "CALL dbms.procedures() YIELD name WHERE name = $name RETURN name")
+	assert.NotContains(t, cr.statements, "CALL dbms.cluster.role($database)")
+
+	cr = newScriptedRunner("3.5.12", "community", `[]`, `[]`)
+	status, err = CheckWritableDatabase(cr, "")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleStandalone, status.Role)
+	assert.Len(t, cr.statements, 1, "community edition has no clusters")
+}
+
+func TestCheckWritableEmptyRole(t *testing.T) {
+	cr := newScriptedRunner("4.4.12", "enterprise", `[{"name": "dbms.cluster.role"}]`, `[]`)
+	assert.EqualError(t, CheckWritable(cr), "got empty response from dbms.cluster.role()")
+}
+
+func TestCheckWritableAddress(t *testing.T) {
+	cr := &addressedRunner{newScriptedRunner("3.5.12", "community", `[]`, `[]`)}
+	status, err := CheckWritableDatabase(cr, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "neo4j-0:7687", status.Address)
+}
+
+// scriptedRunner answers the queries made by CheckWritableDatabase.
+type scriptedRunner struct {
+	rows       map[string]string
+	statements []string
+	parameters map[string]map[string]interface{}
+}
+
+func newScriptedRunner(version, edition, procedures, roles string) *scriptedRunner {
+	return &scriptedRunner{
+		rows: map[string]string{
+			"CALL dbms.components() YIELD name, versions, edition RETURN name, versions, edition": `[{"name": "Neo4j Kernel", "versions": ["` + version + `"], "edition": "` + edition + `"}]`,
+			"CALL db.info() YIELD name RETURN name":                                               `[{"name": "neo4j"}]`,
+			"CALL dbms.procedures() YIELD name WHERE name = $name RETURN name":                    procedures,
+			"CALL dbms.cluster.role()":                                                            roles,
+			"CALL dbms.cluster.role($database)":                                                   roles,
+			"SHOW DATABASE $database YIELD role, writer, address":                                 roles,
+		},
+		parameters: map[string]map[string]interface{}{},
+	}
+}
+
+func (cr *scriptedRunner) CypherBatch(queries []*neoism.CypherQuery) error {
+	for _, q := range queries {
+		cr.statements = append(cr.statements, q.Statement)
+		cr.parameters[q.Statement] = q.Parameters
+		if err := json.Unmarshal([]byte(cr.rows[q.Statement]), q.Result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type addressedRunner struct {
+	*scriptedRunner
+}
+
+func (cr *addressedRunner) address() string {
+	return urlHost("bolt://neo4j-0:7687")
+}